@@ -0,0 +1,18 @@
+# Registers an existing bucket as a Nomad CSI volume: nomad volume register volume.hcl
+id          = "my-bucket"
+name        = "my-bucket"
+type        = "csi"
+plugin_id   = "s3.csi.irbe.dev"
+# external_id is the CSI volume id, which csi-s3 uses as the bucket name
+external_id = "my-bucket"
+
+capability {
+  access_mode     = "multi-node-multi-writer"
+  attachment_mode = "file-system"
+}
+
+# passed to NodePublishVolume as CSI secrets
+secrets {
+  AWS_ACCESS_KEY_ID     = "<access key id>"
+  AWS_SECRET_ACCESS_KEY = "<secret access key>"
+}
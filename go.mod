@@ -3,12 +3,23 @@ module github.com/irbekrm/csi-s3
 go 1.16
 
 require (
+	github.com/aws/aws-sdk-go v1.41.0
 	github.com/container-storage-interface/spec v1.3.0
-	github.com/golang/mock v1.3.1
-	github.com/golang/protobuf v1.4.2
+	github.com/go-logr/logr v1.2.0
+	github.com/golang/mock v1.4.4
+	github.com/golang/protobuf v1.5.2
 	github.com/google/fscrypt v0.2.9
+	github.com/hanwen/go-fuse/v2 v2.1.0
 	github.com/kubernetes-csi/csi-lib-utils v0.9.0
+	github.com/kubernetes-csi/csi-test/v4 v4.2.0
 	github.com/pkg/errors v0.9.1
-	google.golang.org/grpc v1.32.0
-	k8s.io/klog v1.0.0
+	github.com/prometheus/client_golang v1.11.0
+	go.opentelemetry.io/otel v1.0.1
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.0.1
+	go.opentelemetry.io/otel/sdk v1.0.1
+	go.opentelemetry.io/otel/trace v1.0.1
+	google.golang.org/grpc v1.41.0
+	google.golang.org/protobuf v1.27.1
+	k8s.io/klog/v2 v2.60.1
+	sigs.k8s.io/yaml v1.2.0
 )
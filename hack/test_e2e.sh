@@ -0,0 +1,15 @@
+#!/bin/bash
+
+set -eux
+
+# the end-to-end tests mount FUSE filesystems, so they need root and /dev/fuse.
+# Unless already in such an environment, they run in a privileged container
+if [[ "${E2E_IN_CONTAINER:-}" == "true" ]]; then
+  go test -tags e2e -count 1 -v ./test/e2e/...
+  exit 0
+fi
+
+# build an image with the contents of the repo
+docker build -t "csi-s3/tests:latest" -f build/Dockerfile.test .
+
+docker run -t --privileged --device /dev/fuse -e E2E_IN_CONTAINER=true --entrypoint ./hack/test_e2e.sh "csi-s3/tests:latest"
@@ -2,4 +2,4 @@
 
 set -eux
 
-go test -count 1 -v ./...
\ No newline at end of file
+go test -race -count 1 -v ./...
\ No newline at end of file
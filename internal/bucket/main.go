@@ -0,0 +1,286 @@
+package bucket
+
+//go:generate mockgen -source=main.go -destination=../../mocks/mock_bucket.go -package=mocks
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// defaultRegion is used to create buckets and find buckets' regions if no region is configured
+const defaultRegion = "us-east-1"
+
+var (
+	// ErrNotFound is returned when the bucket does not exist
+	ErrNotFound = errors.New("bucket not found")
+	// ErrAlreadyOwned is returned when creating a bucket that the caller already owns
+	ErrAlreadyOwned = errors.New("bucket already owned by you")
+	// ErrObjectNotFound is returned when an object does not exist
+	ErrObjectNotFound = errors.New("object not found")
+)
+
+// Client performs bucket level operations against an S3 API
+type Client interface {
+	// Exists checks whether the bucket exists and is accessible with the client's credentials
+	Exists(ctx context.Context, name string) (bool, error)
+	// Tags returns the bucket's tags
+	Tags(ctx context.Context, name string) (map[string]string, error)
+	// SetTags adds tags to the bucket's tags, replacing the values of existing keys
+	SetTags(ctx context.Context, name string, tags map[string]string) error
+	// Usage returns the total size in bytes of the current versions of the bucket's objects
+	Usage(ctx context.Context, name string) (int64, error)
+	// Empty checks whether the bucket has no objects
+	Empty(ctx context.Context, name string) (bool, error)
+	// Create creates the bucket in the client's region
+	Create(ctx context.Context, name string, opts CreateOptions) error
+	// Configure applies settings to the bucket
+	Configure(ctx context.Context, name string, s Settings) error
+	// Delete deletes the bucket along with all of its objects and their versions
+	Delete(ctx context.Context, name string) error
+	// CopyObjects copies objects under srcPrefix in src to dst, replacing srcPrefix with dstPrefix in their keys.
+	// Objects that have already been copied to dst are skipped. Returns the total size of the source objects
+	CopyObjects(ctx context.Context, src, srcPrefix, dst, dstPrefix string, opts CopyOptions) (int64, error)
+	// DeleteObjects deletes the current versions of objects under prefix
+	DeleteObjects(ctx context.Context, name, prefix string) error
+	// PutObject writes data to the object at key
+	PutObject(ctx context.Context, name, key string, data []byte) error
+	// GetObject reads the object at key
+	GetObject(ctx context.Context, name, key string) ([]byte, error)
+	// ListPrefixes returns the common prefixes, ending in /, directly under prefix
+	ListPrefixes(ctx context.Context, name, prefix string) ([]string, error)
+}
+
+// Options configure how a Client connects to S3
+type Options struct {
+	// Endpoint is the URL of the S3 API. AWS S3 is used if empty
+	Endpoint string
+	// Region is the region in which buckets are created. Requests for a bucket are signed for the bucket's region
+	Region    string
+	PathStyle bool
+	AccessKey string
+	SecretKey string
+	// UserAgent is appended to the SDK's user agent of each request
+	UserAgent string
+}
+
+// CreateOptions configure a new bucket
+type CreateOptions struct {
+	// ObjectLock enables object lock, which can only be done when the bucket is created. It also enables versioning
+	ObjectLock bool
+}
+
+// New returns a Client that authenticates with the given options' credentials
+func New(o Options) (Client, error) {
+	region := o.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	cfg := &aws.Config{
+		Region:           aws.String(region),
+		Credentials:      credentials.NewStaticCredentials(o.AccessKey, o.SecretKey, ""),
+		S3ForcePathStyle: aws.Bool(o.PathStyle),
+	}
+	if o.Endpoint != "" {
+		cfg.Endpoint = aws.String(o.Endpoint)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating S3 session: %w", err)
+	}
+	svc := newS3(sess, region, o.UserAgent)
+	return client{s3: svc, region: region, regions: newRegions(sess, o.UserAgent, region, svc)}, nil
+}
+
+// client sends requests for a bucket signed for the bucket's region, see s3For
+type client struct {
+	// s3 signs requests for region, in which buckets are created
+	s3      *s3.S3
+	region  string
+	regions *regions
+}
+
+// Exists checks whether the bucket exists and is accessible with the client's credentials
+func (c client) Exists(ctx context.Context, name string) (bool, error) {
+	svc, err := c.s3For(ctx, name)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = svc.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String(name)})
+	if isNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed checking bucket %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// Tags returns the bucket's tags
+func (c client) Tags(ctx context.Context, name string) (map[string]string, error) {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetBucketTaggingWithContext(ctx, &s3.GetBucketTaggingInput{Bucket: aws.String(name)})
+	// a bucket without tags has no tag set
+	if errCode(err) == "NoSuchTagSet" {
+		return map[string]string{}, nil
+	}
+	if isNotFound(err) {
+		return nil, fmt.Errorf("failed getting tags of bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed getting tags of bucket %s: %w", name, err)
+	}
+	tags := make(map[string]string, len(out.TagSet))
+	for _, t := range out.TagSet {
+		tags[aws.StringValue(t.Key)] = aws.StringValue(t.Value)
+	}
+	return tags, nil
+}
+
+// SetTags adds tags to the bucket's tags, replacing the values of existing keys.
+// S3 can only replace the whole tag set, so tags set concurrently by others may be lost
+func (c client) SetTags(ctx context.Context, name string, tags map[string]string) error {
+	current, err := c.Tags(ctx, name)
+	if err != nil {
+		return err
+	}
+	for k, v := range tags {
+		current[k] = v
+	}
+	tagSet := make([]*s3.Tag, 0, len(current))
+	for k, v := range current {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutBucketTaggingWithContext(ctx, &s3.PutBucketTaggingInput{
+		Bucket:  aws.String(name),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	if err != nil {
+		return fmt.Errorf("failed setting tags of bucket %s: %w", name, err)
+	}
+	return nil
+}
+
+// Usage returns the total size in bytes of the current versions of the bucket's objects.
+// It lists every object, so it is slow for large buckets
+func (c client) Usage(ctx context.Context, name string) (int64, error) {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return 0, err
+	}
+	var size int64
+	err = svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(name)}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			size += aws.Int64Value(o.Size)
+		}
+		return true
+	})
+	if isNotFound(err) {
+		return 0, fmt.Errorf("failed listing objects of bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed listing objects of bucket %s: %w", name, err)
+	}
+	return size, nil
+}
+
+// Empty checks whether the bucket has no objects. Only the first object is listed
+func (c client) Empty(ctx context.Context, name string) (bool, error) {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	out, err := svc.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(name), MaxKeys: aws.Int64(1)})
+	if isNotFound(err) {
+		return false, fmt.Errorf("failed listing objects of bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed listing objects of bucket %s: %w", name, err)
+	}
+	return len(out.Contents) == 0, nil
+}
+
+// Create creates the bucket in the client's region
+func (c client) Create(ctx context.Context, name string, opts CreateOptions) error {
+	in := &s3.CreateBucketInput{Bucket: aws.String(name)}
+	if opts.ObjectLock {
+		in.ObjectLockEnabledForBucket = aws.Bool(true)
+	}
+	// us-east-1 is the default location and must not be given as a constraint
+	if c.region != defaultRegion {
+		in.CreateBucketConfiguration = &s3.CreateBucketConfiguration{LocationConstraint: aws.String(c.region)}
+	}
+	_, err := c.s3.CreateBucketWithContext(ctx, in)
+	if errCode(err) == s3.ErrCodeBucketAlreadyOwnedByYou {
+		return fmt.Errorf("failed creating bucket %s: %w", name, ErrAlreadyOwned)
+	}
+	if err != nil {
+		return fmt.Errorf("failed creating bucket %s: %w", name, err)
+	}
+	c.regions.set(name, c.region)
+	return nil
+}
+
+// Delete deletes the bucket along with all of its objects and their versions
+func (c client) Delete(ctx context.Context, name string) error {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return err
+	}
+	var ids []*s3.ObjectIdentifier
+	err = svc.ListObjectVersionsPagesWithContext(ctx, &s3.ListObjectVersionsInput{Bucket: aws.String(name)}, func(page *s3.ListObjectVersionsOutput, _ bool) bool {
+		for _, v := range page.Versions {
+			ids = append(ids, &s3.ObjectIdentifier{Key: v.Key, VersionId: v.VersionId})
+		}
+		for _, m := range page.DeleteMarkers {
+			ids = append(ids, &s3.ObjectIdentifier{Key: m.Key, VersionId: m.VersionId})
+		}
+		return true
+	})
+	if isNotFound(err) {
+		return fmt.Errorf("failed listing objects of bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed listing objects of bucket %s: %w", name, err)
+	}
+	if err := deleteObjects(ctx, svc, name, ids); err != nil {
+		return err
+	}
+	_, err = svc.DeleteBucketWithContext(ctx, &s3.DeleteBucketInput{Bucket: aws.String(name)})
+	if isNotFound(err) {
+		return fmt.Errorf("failed deleting bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed deleting bucket %s: %w", name, err)
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	c := errCode(err)
+	// HeadBucket responses have no body, so the SDK derives the code from the status
+	return c == s3.ErrCodeNoSuchBucket || c == "NotFound"
+}
+
+func errCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
@@ -0,0 +1,452 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/irbekrm/csi-s3/internal/s3test"
+)
+
+func newClient(t *testing.T, s *s3test.Server) Client {
+	t.Helper()
+	c, err := New(Options{Endpoint: s.URL(), Region: s.Region(), PathStyle: true, AccessKey: "some-key", SecretKey: "some-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_client_Exists(t *testing.T) {
+	s := s3test.New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s)
+
+	tests := map[string]struct {
+		bucket  string
+		fault   *s3test.Fault
+		want    bool
+		wantErr bool
+	}{
+		"existing bucket": {
+			bucket: "some-bucket",
+			want:   true,
+		},
+		"missing bucket": {
+			bucket: "missing-bucket",
+			want:   false,
+		},
+		"S3 error": {
+			bucket:  "some-bucket",
+			fault:   &s3test.Fault{Operation: "HeadBucket", Status: 403, Code: "AccessDenied"},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s.ClearFaults()
+			if tt.fault != nil {
+				s.Inject(*tt.fault)
+			}
+			got, err := c.Exists(context.Background(), tt.bucket)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("client.Exists() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("client.Exists() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_New_userAgent(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.UserAgent()
+	}))
+	defer srv.Close()
+	c, err := New(Options{Endpoint: srv.URL, PathStyle: true, AccessKey: "some-key", SecretKey: "some-secret", UserAgent: "pod/some-namespace/some-pod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Exists(context.Background(), "some-bucket"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(got, " pod/some-namespace/some-pod") {
+		t.Errorf("user agent = %q, want the pod suffix", got)
+	}
+}
+
+func Test_client_Tags(t *testing.T) {
+	s := s3test.New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	got, err := c.Tags(ctx, "some-bucket")
+	if err != nil || len(got) != 0 {
+		t.Fatalf("client.Tags() of an untagged bucket = %v, %v, want no tags", got, err)
+	}
+	if err := c.SetTags(ctx, "some-bucket", map[string]string{"a": "1", "b": "2"}); err != nil {
+		t.Fatalf("client.SetTags() error = %v", err)
+	}
+	if err := c.SetTags(ctx, "some-bucket", map[string]string{"b": "3"}); err != nil {
+		t.Fatalf("client.SetTags() error = %v", err)
+	}
+	want := map[string]string{"a": "1", "b": "3"}
+	if got, err := c.Tags(ctx, "some-bucket"); err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("client.Tags() = %v, %v, want %v", got, err, want)
+	}
+	if err := c.SetTags(ctx, "missing-bucket", want); !errors.Is(err, ErrNotFound) {
+		t.Errorf("client.SetTags() of a missing bucket error = %v, want ErrNotFound", err)
+	}
+}
+
+func Test_client_Usage(t *testing.T) {
+	s := s3test.New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	// more objects than fit in a page of results
+	for i := 0; i < 1005; i++ {
+		if err := s.PutObject("some-bucket", fmt.Sprintf("dir/%04d", i), []byte("12")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newClient(t, s)
+
+	got, err := c.Usage(context.Background(), "some-bucket")
+	if err != nil {
+		t.Fatalf("client.Usage() error = %v", err)
+	}
+	if got != 2010 {
+		t.Errorf("client.Usage() = %d, want 2010", got)
+	}
+	if _, err := c.Usage(context.Background(), "missing-bucket"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("client.Usage() of a missing bucket error = %v, want ErrNotFound", err)
+	}
+}
+
+func Test_client_Empty(t *testing.T) {
+	s := s3test.New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	if got, err := c.Empty(ctx, "some-bucket"); err != nil || !got {
+		t.Errorf("client.Empty() of a bucket without objects = %v, %v, want true", got, err)
+	}
+	// objects without data are counted too
+	if err := s.PutObject("some-bucket", "dir/", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Empty(ctx, "some-bucket"); err != nil || got {
+		t.Errorf("client.Empty() of a bucket with objects = %v, %v, want false", got, err)
+	}
+	if _, err := c.Empty(ctx, "missing-bucket"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("client.Empty() of a missing bucket error = %v, want ErrNotFound", err)
+	}
+}
+
+func Test_client_Create_Delete(t *testing.T) {
+	s := s3test.New(s3test.WithRegion("eu-west-2"))
+	defer s.Close()
+	c, err := New(Options{Endpoint: s.URL(), Region: "eu-west-2", PathStyle: true, AccessKey: "some-key", SecretKey: "some-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if err := c.Create(ctx, "some-bucket", CreateOptions{}); err != nil {
+		t.Fatalf("client.Create() error = %v", err)
+	}
+	if err := c.Create(ctx, "some-bucket", CreateOptions{}); !errors.Is(err, ErrAlreadyOwned) {
+		t.Errorf("client.Create() of an existing bucket error = %v, want ErrAlreadyOwned", err)
+	}
+	if err := c.PutObject(ctx, "some-bucket", "dir/some-object", []byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "some-bucket"); err != nil {
+		t.Fatalf("client.Delete() of a bucket with objects error = %v", err)
+	}
+	if got := s.Buckets(); len(got) != 0 {
+		t.Errorf("buckets after client.Delete() = %v, want none", got)
+	}
+	if err := c.Delete(ctx, "some-bucket"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("client.Delete() of a missing bucket error = %v, want ErrNotFound", err)
+	}
+}
+
+// Test_client_regions checks that requests for buckets in other regions than the client's are signed for the
+// bucket's region, which s3test requires as S3 does
+func Test_client_regions(t *testing.T) {
+	s := s3test.New(s3test.WithRegion("eu-west-2"))
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	south, err := New(Options{Endpoint: s.URL(), Region: "ap-south-1", PathStyle: true, AccessKey: "some-key", SecretKey: "some-secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if err := south.Create(ctx, "south-bucket", CreateOptions{}); err != nil {
+		t.Fatalf("client.Create() in ap-south-1 error = %v", err)
+	}
+	if err := south.PutObject(ctx, "south-bucket", "some-object", []byte("some data")); err != nil {
+		t.Fatalf("client.PutObject() error = %v", err)
+	}
+
+	// a client without a region signs requests for us-east-1, in which there are no buckets
+	for name, c := range map[string]Client{"eu-west-2": newClient(t, s), "no region": mustNew(t, Options{Endpoint: s.URL(), PathStyle: true, AccessKey: "some-key", SecretKey: "some-secret"})} {
+		t.Run(name, func(t *testing.T) {
+			if ok, err := c.Exists(ctx, "south-bucket"); err != nil || !ok {
+				t.Errorf("client.Exists() = %v, %v, want true", ok, err)
+			}
+			if err := c.SetTags(ctx, "south-bucket", map[string]string{"some": "tag"}); err != nil {
+				t.Errorf("client.SetTags() error = %v", err)
+			}
+			if got, err := c.Tags(ctx, "south-bucket"); err != nil || got["some"] != "tag" {
+				t.Errorf("client.Tags() = %v, %v, want the set tag", got, err)
+			}
+			if err := c.Configure(ctx, "south-bucket", Settings{Versioning: true}); err != nil {
+				t.Errorf("client.Configure() error = %v", err)
+			}
+			if got, err := c.GetObject(ctx, "south-bucket", "some-object"); err != nil || string(got) != "some data" {
+				t.Errorf("client.GetObject() = %q, %v, want some data", got, err)
+			}
+			if size, err := c.CopyObjects(ctx, "south-bucket", "", "some-bucket", name+"/", CopyOptions{}); err != nil || size != 9 {
+				t.Errorf("client.CopyObjects() across regions = %v, %v, want 9", size, err)
+			}
+			if size, err := c.CopyObjects(ctx, "some-bucket", name+"/", "south-bucket", name+"/", CopyOptions{}); err != nil || size != 9 {
+				t.Errorf("client.CopyObjects() across regions = %v, %v, want 9", size, err)
+			}
+			if got, err := c.ListPrefixes(ctx, "south-bucket", ""); err != nil || !reflect.DeepEqual(got, []string{name + "/"}) {
+				t.Errorf("client.ListPrefixes() = %v, %v", got, err)
+			}
+			if err := c.DeleteObjects(ctx, "south-bucket", name+"/"); err != nil {
+				t.Errorf("client.DeleteObjects() error = %v", err)
+			}
+		})
+	}
+	if err := newClient(t, s).Delete(ctx, "south-bucket"); err != nil {
+		t.Fatalf("client.Delete() error = %v", err)
+	}
+	if got := s.Buckets(); !reflect.DeepEqual(got, []string{"some-bucket"}) {
+		t.Errorf("buckets after client.Delete() = %v, want some-bucket", got)
+	}
+}
+
+func mustNew(t *testing.T, o Options) Client {
+	t.Helper()
+	c, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func Test_client_Configure(t *testing.T) {
+	tests := map[string]struct {
+		objectLock bool
+		settings   Settings
+		// want are substrings of the bucket's configuration sub-resources
+		want    map[string]string
+		wantErr bool
+	}{
+		"no settings": {
+			want: map[string]string{},
+		},
+		"all settings": {
+			objectLock: true,
+			settings: Settings{
+				Versioning:        true,
+				Encryption:        EncryptionKMS,
+				KMSKeyID:          "some-key-id",
+				ExpirationDays:    30,
+				ObjectLockMode:    "GOVERNANCE",
+				ObjectLockDays:    7,
+				BlockPublicAccess: true,
+			},
+			want: map[string]string{
+				"encryption":        "<KMSMasterKeyID>some-key-id</KMSMasterKeyID>",
+				"lifecycle":         "<Days>30</Days>",
+				"object-lock":       "<Mode>GOVERNANCE</Mode>",
+				"publicAccessBlock": "<BlockPublicAcls>true</BlockPublicAcls>",
+			},
+		},
+		"object lock on a bucket created without it": {
+			settings: Settings{ObjectLockMode: "GOVERNANCE", ObjectLockDays: 7},
+			wantErr:  true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := s3test.New()
+			defer s.Close()
+			c := newClient(t, s)
+			ctx := context.Background()
+			if err := c.Create(ctx, "some-bucket", CreateOptions{ObjectLock: tt.objectLock}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := c.Configure(ctx, "some-bucket", tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("client.Configure() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, sub := range []string{"encryption", "lifecycle", "object-lock", "publicAccessBlock"} {
+				got, ok := s.BucketConfiguration("some-bucket", sub)
+				want, wantOK := tt.want[sub]
+				if ok != wantOK || !strings.Contains(got, want) {
+					t.Errorf("%s configuration = %q, want it to contain %q", sub, got, want)
+				}
+			}
+		})
+	}
+
+	s := s3test.New()
+	defer s.Close()
+	if err := newClient(t, s).Configure(context.Background(), "missing-bucket", Settings{Versioning: true}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("client.Configure() of a missing bucket error = %v, want ErrNotFound", err)
+	}
+}
+
+func Test_client_CopyObjects(t *testing.T) {
+	defer func(limit int64) { copyObjectLimit = limit }(copyObjectLimit)
+	copyObjectLimit = 10
+
+	tests := map[string]struct {
+		// copied are objects that a previous, interrupted copy has written to the destination
+		copied map[string]string
+		fault  *s3test.Fault
+		// wantCopies is the number of CopyObject and UploadPartCopy requests
+		wantCopies int
+		wantErr    bool
+	}{
+		"objects are copied, large ones in parts": {
+			wantCopies: 2 + 3,
+		},
+		"objects that have been copied before are skipped": {
+			copied:     map[string]string{"copy/small-1": "small-1"},
+			wantCopies: 1 + 3,
+		},
+		"objects that differ from the source are copied again": {
+			copied:     map[string]string{"copy/small-1": "changed size", "copy/small-2": "small"},
+			wantCopies: 2 + 3,
+		},
+		"failed copy": {
+			fault:   &s3test.Fault{Operation: "UploadPartCopy", Code: "AccessDenied", Status: 403},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			s := s3test.New()
+			defer s.Close()
+			s.CreateBucket("some-bucket")
+			s.CreateBucket("other-bucket")
+			objects := map[string]string{"small-1": "small-1", "small-2": "small-2", "large": "larger than the limit"}
+			for k, v := range objects {
+				if err := s.PutObject("some-bucket", k, []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for k, v := range tt.copied {
+				if err := s.PutObject("other-bucket", k, []byte(v)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.fault != nil {
+				s.Inject(*tt.fault)
+			}
+			var progress []CopyProgress
+			opts := CopyOptions{Parallelism: 2, PartSize: 8, Progress: func(p CopyProgress) { progress = append(progress, p) }}
+
+			size, err := newClient(t, s).CopyObjects(context.Background(), "some-bucket", "", "other-bucket", "copy/", opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("client.CopyObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				if _, ok := s.Object("other-bucket", "copy/large"); ok {
+					t.Errorf("client.CopyObjects() left behind a partially copied object")
+				}
+				return
+			}
+			if want := int64(len("small-1") + len("small-2") + len("larger than the limit")); size != want {
+				t.Errorf("client.CopyObjects() = %d, want %d", size, want)
+			}
+			for k, v := range objects {
+				if got, _ := s.Object("other-bucket", "copy/"+k); string(got) != v {
+					t.Errorf("copied object %s = %q, want %q", k, got, v)
+				}
+			}
+			var copies int
+			for _, r := range s.Requests() {
+				if r.Operation == "CopyObject" || r.Operation == "UploadPartCopy" {
+					copies++
+				}
+			}
+			if copies != tt.wantCopies {
+				t.Errorf("client.CopyObjects() made %d copy requests, want %d", copies, tt.wantCopies)
+			}
+			if len(progress) != len(objects) || progress[len(progress)-1] != (CopyProgress{Objects: len(objects), Bytes: size}) {
+				t.Errorf("client.CopyObjects() reported progress %v, want one report per object", progress)
+			}
+		})
+	}
+}
+
+func Test_client_objects(t *testing.T) {
+	s := s3test.New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	s.CreateBucket("other-bucket")
+	for _, k := range []string{"a", "dir/b", "dir/sub/c", "other/d"} {
+		if err := s.PutObject("some-bucket", k, []byte(k)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := newClient(t, s)
+	ctx := context.Background()
+
+	size, err := c.CopyObjects(ctx, "some-bucket", "dir/", "other-bucket", "copy/", CopyOptions{})
+	if err != nil {
+		t.Fatalf("client.CopyObjects() error = %v", err)
+	}
+	if size != int64(len("dir/b")+len("dir/sub/c")) {
+		t.Errorf("client.CopyObjects() = %d, want the size of the copied objects", size)
+	}
+	if got, ok := s.Object("other-bucket", "copy/sub/c"); !ok || string(got) != "dir/sub/c" {
+		t.Errorf("copied object copy/sub/c = %q, %v", got, ok)
+	}
+	if _, ok := s.Object("other-bucket", "copy/a"); ok {
+		t.Errorf("client.CopyObjects() copied an object outside of the prefix")
+	}
+
+	prefixes, err := c.ListPrefixes(ctx, "some-bucket", "")
+	if want := []string{"dir/", "other/"}; err != nil || !reflect.DeepEqual(prefixes, want) {
+		t.Errorf("client.ListPrefixes() = %v, %v, want %v", prefixes, err, want)
+	}
+
+	if got, err := c.GetObject(ctx, "some-bucket", "dir/b"); err != nil || string(got) != "dir/b" {
+		t.Errorf("client.GetObject() = %q, %v", got, err)
+	}
+	if _, err := c.GetObject(ctx, "some-bucket", "missing"); !errors.Is(err, ErrObjectNotFound) {
+		t.Errorf("client.GetObject() of a missing object error = %v, want ErrObjectNotFound", err)
+	}
+
+	if err := c.DeleteObjects(ctx, "some-bucket", "dir/"); err != nil {
+		t.Fatalf("client.DeleteObjects() error = %v", err)
+	}
+	if _, ok := s.Object("some-bucket", "dir/sub/c"); ok {
+		t.Errorf("client.DeleteObjects() did not delete objects under the prefix")
+	}
+	if _, ok := s.Object("some-bucket", "other/d"); !ok {
+		t.Errorf("client.DeleteObjects() deleted an object outside of the prefix")
+	}
+}
@@ -0,0 +1,334 @@
+package bucket
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// maxDeleteObjects is the maximum number of objects that can be deleted in one DeleteObjects request
+	maxDeleteObjects = 1000
+	// maxParts is the maximum number of parts of a multipart upload
+	maxParts = 10000
+	// defaultPartSize is the size of the parts in which large objects are copied if CopyOptions.PartSize is not set
+	defaultPartSize = 512 << 20
+	// abortTimeout bounds aborting a failed multipart copy, which is done even if the copy's context is cancelled
+	abortTimeout = 30 * time.Second
+)
+
+// copyObjectLimit is the size of the largest object that can be copied with a single CopyObject request.
+// Larger objects are copied in parts
+var copyObjectLimit int64 = 5 << 30
+
+// CopyOptions configure CopyObjects
+type CopyOptions struct {
+	// Parallelism is the maximum number of objects copied at a time. Defaults to 1
+	Parallelism int
+	// PartSize is the size of the parts in which objects larger than 5GiB are copied. Defaults to 512MiB,
+	// it is increased if the object would not fit in 10000 parts
+	PartSize int64
+	// Progress, if set, is called after each copied object. Calls are not concurrent
+	Progress func(CopyProgress)
+}
+
+// CopyProgress is the progress of CopyObjects
+type CopyProgress struct {
+	// Objects is the number of objects copied so far, including ones that had been copied before
+	Objects int
+	// Bytes is the total size of those objects
+	Bytes int64
+}
+
+// CopyObjects copies objects under srcPrefix in src to dst, replacing srcPrefix with dstPrefix in their keys.
+// Objects are copied server-side, up to opts.Parallelism at a time. Objects in dst with the same size that are either
+// identical or newer than the source object are not copied again, so an interrupted copy can be resumed by calling
+// CopyObjects again. Returns the total size of the source objects
+func (c client) CopyObjects(ctx context.Context, src, srcPrefix, dst, dstPrefix string, opts CopyOptions) (int64, error) {
+	srcSvc, err := c.s3For(ctx, src)
+	if err != nil {
+		return 0, err
+	}
+	dstSvc, err := c.s3For(ctx, dst)
+	if err != nil {
+		return 0, err
+	}
+	copied := make(map[string]*s3.Object)
+	err = dstSvc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(dst), Prefix: aws.String(dstPrefix)}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			copied[aws.StringValue(o.Key)] = o
+		}
+		return true
+	})
+	if isNotFound(err) {
+		return 0, fmt.Errorf("failed listing objects of bucket %s: %w", dst, ErrNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed listing objects of bucket %s: %w", dst, err)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		progress CopyProgress
+		copyErr  error
+	)
+	objects := make(chan *s3.Object)
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for o := range objects {
+				key := aws.StringValue(o.Key)
+				dstKey := dstPrefix + strings.TrimPrefix(key, srcPrefix)
+				var err error
+				if !isCopy(copied[dstKey], o) {
+					err = c.copyObject(ctx, srcSvc, dstSvc, src, key, dst, dstKey, aws.Int64Value(o.Size), opts.PartSize)
+				}
+				mu.Lock()
+				switch {
+				case err != nil && copyErr == nil:
+					copyErr = fmt.Errorf("failed copying %s/%s to bucket %s: %w", src, key, dst, err)
+					// stop listing and copying the remaining objects
+					cancel()
+				case err == nil:
+					progress.Objects++
+					progress.Bytes += aws.Int64Value(o.Size)
+					if opts.Progress != nil {
+						opts.Progress(progress)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	err = srcSvc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(src), Prefix: aws.String(srcPrefix)}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			select {
+			case objects <- o:
+			case <-ctx.Done():
+				return false
+			}
+		}
+		return true
+	})
+	close(objects)
+	wg.Wait()
+	if copyErr != nil {
+		return 0, copyErr
+	}
+	if isNotFound(err) {
+		return 0, fmt.Errorf("failed listing objects of bucket %s: %w", src, ErrNotFound)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed listing objects of bucket %s: %w", src, err)
+	}
+	return progress.Bytes, nil
+}
+
+// copyObject copies an object of the given size server-side, in parts if it is too large for CopyObject
+// srcSvc and dstSvc are the clients of the source's and the destination's regions, to which the copy is sent
+func (c client) copyObject(ctx context.Context, srcSvc, dstSvc *s3.S3, src, key, dst, dstKey string, size, partSize int64) error {
+	if size <= copyObjectLimit {
+		_, err := dstSvc.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:     aws.String(dst),
+			Key:        aws.String(dstKey),
+			CopySource: aws.String(copySource(src, key)),
+		})
+		return err
+	}
+	// unlike CopyObject, a multipart upload does not carry over the source's content type and metadata
+	head, err := srcSvc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{Bucket: aws.String(src), Key: aws.String(key)})
+	if err != nil {
+		return err
+	}
+	if partSize <= 0 {
+		partSize = defaultPartSize
+	}
+	if min := (size + maxParts - 1) / maxParts; partSize < min {
+		partSize = min
+	}
+	upload, err := dstSvc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(dst),
+		Key:         aws.String(dstKey),
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	})
+	if err != nil {
+		return err
+	}
+	var parts []*s3.CompletedPart
+	for n, first := int64(1), int64(0); first < size; n, first = n+1, first+partSize {
+		last := first + partSize - 1
+		if last >= size {
+			last = size - 1
+		}
+		out, err := dstSvc.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          aws.String(dst),
+			Key:             aws.String(dstKey),
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(n),
+			CopySource:      aws.String(copySource(src, key)),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+			// fails the copy if the object changes in the meantime, instead of mixing parts of different versions
+			CopySourceIfMatch: head.ETag,
+		})
+		if err != nil {
+			abortUpload(dstSvc, dst, dstKey, upload.UploadId)
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(n), ETag: out.CopyPartResult.ETag})
+	}
+	_, err = dstSvc.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(dst),
+		Key:             aws.String(dstKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		abortUpload(dstSvc, dst, dstKey, upload.UploadId)
+	}
+	return err
+}
+
+// abortUpload aborts a multipart upload so that its parts are not stored. Errors are ignored
+func abortUpload(svc *s3.S3, name, key string, uploadID *string) {
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{Bucket: aws.String(name), Key: aws.String(key), UploadId: uploadID})
+}
+
+// isCopy returns true if dst is a copy of src that was made by an earlier CopyObjects: it has the same size and either
+// the same ETag (CopyObject keeps it) or was written after src (objects copied in parts get a new ETag)
+func isCopy(dst, src *s3.Object) bool {
+	if dst == nil || aws.Int64Value(dst.Size) != aws.Int64Value(src.Size) {
+		return false
+	}
+	return aws.StringValue(dst.ETag) == aws.StringValue(src.ETag) || !aws.TimeValue(dst.LastModified).Before(aws.TimeValue(src.LastModified))
+}
+
+// DeleteObjects deletes the current versions of objects under prefix
+func (c client) DeleteObjects(ctx context.Context, name, prefix string) error {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return err
+	}
+	var ids []*s3.ObjectIdentifier
+	err = svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(name), Prefix: aws.String(prefix)}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, o := range page.Contents {
+			ids = append(ids, &s3.ObjectIdentifier{Key: o.Key})
+		}
+		return true
+	})
+	if isNotFound(err) {
+		return fmt.Errorf("failed listing objects of bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed listing objects of bucket %s: %w", name, err)
+	}
+	return deleteObjects(ctx, svc, name, ids)
+}
+
+// PutObject writes data to the object at key
+func (c client) PutObject(ctx context.Context, name, key string, data []byte) error {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return err
+	}
+	_, err = svc.PutObjectWithContext(ctx, &s3.PutObjectInput{Bucket: aws.String(name), Key: aws.String(key), Body: bytes.NewReader(data)})
+	if isNotFound(err) {
+		return fmt.Errorf("failed writing %s/%s: %w", name, key, ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("failed writing %s/%s: %w", name, key, err)
+	}
+	return nil
+}
+
+// GetObject reads the object at key
+func (c client) GetObject(ctx context.Context, name, key string) ([]byte, error) {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	out, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{Bucket: aws.String(name), Key: aws.String(key)})
+	if errCode(err) == s3.ErrCodeNoSuchKey {
+		return nil, fmt.Errorf("failed reading %s/%s: %w", name, key, ErrObjectNotFound)
+	}
+	if isNotFound(err) {
+		return nil, fmt.Errorf("failed reading %s/%s: %w", name, key, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s/%s: %w", name, key, err)
+	}
+	defer out.Body.Close()
+	data, err := ioutil.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading %s/%s: %w", name, key, err)
+	}
+	return data, nil
+}
+
+// ListPrefixes returns the common prefixes, ending in /, directly under prefix
+func (c client) ListPrefixes(ctx context.Context, name, prefix string) ([]string, error) {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var prefixes []string
+	err = svc.ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{Bucket: aws.String(name), Prefix: aws.String(prefix), Delimiter: aws.String("/")}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+		for _, p := range page.CommonPrefixes {
+			prefixes = append(prefixes, aws.StringValue(p.Prefix))
+		}
+		return true
+	})
+	if isNotFound(err) {
+		return nil, fmt.Errorf("failed listing objects of bucket %s: %w", name, ErrNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed listing objects of bucket %s: %w", name, err)
+	}
+	return prefixes, nil
+}
+
+// deleteObjects deletes objects in batches of maxDeleteObjects
+func deleteObjects(ctx context.Context, svc *s3.S3, name string, ids []*s3.ObjectIdentifier) error {
+	for len(ids) > 0 {
+		n := len(ids)
+		if n > maxDeleteObjects {
+			n = maxDeleteObjects
+		}
+		out, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(name),
+			Delete: &s3.Delete{Objects: ids[:n], Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed deleting objects of bucket %s: %w", name, err)
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return fmt.Errorf("failed deleting %s/%s: %s", name, aws.StringValue(e.Key), aws.StringValue(e.Message))
+		}
+		ids = ids[n:]
+	}
+	return nil
+}
+
+// copySource returns the URL encoded source of a CopyObject request
+func copySource(bucket, key string) string {
+	return (&url.URL{Path: bucket + "/" + key}).EscapedPath()
+}
@@ -0,0 +1,96 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// regions holds the regions of buckets and the S3 clients that sign requests for them.
+// It is safe for concurrent use
+type regions struct {
+	sess      *session.Session
+	userAgent string
+
+	mu       sync.Mutex
+	byBucket map[string]string
+	clients  map[string]*s3.S3
+}
+
+// newRegions returns regions in which svc is the client of region
+func newRegions(sess *session.Session, userAgent, region string, svc *s3.S3) *regions {
+	return &regions{
+		sess:      sess,
+		userAgent: userAgent,
+		byBucket:  make(map[string]string),
+		clients:   map[string]*s3.S3{region: svc},
+	}
+}
+
+// set records the region of a bucket
+func (r *regions) set(name, region string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.byBucket[name] = region
+}
+
+func (r *regions) get(name string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	region, ok := r.byBucket[name]
+	return region, ok
+}
+
+// client returns the S3 client of region, creating it if needed
+func (r *regions) client(region string) *s3.S3 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if svc, ok := r.clients[region]; ok {
+		return svc
+	}
+	svc := newS3(r.sess, region, r.userAgent)
+	r.clients[region] = svc
+	return svc
+}
+
+func newS3(sess *session.Session, region, userAgent string) *s3.S3 {
+	svc := s3.New(sess, &aws.Config{Region: aws.String(region)})
+	if userAgent != "" {
+		svc.Handlers.Build.PushBack(request.MakeAddToUserAgentFreeFormHandler(userAgent))
+	}
+	return svc
+}
+
+// s3For returns the S3 client that signs requests for the region of the bucket. The SDK does not follow S3's
+// redirects to a bucket's region, so requests signed for another region fail. The region is looked up with
+// HeadBucket, whose response has it even if the request was signed for another region. Endpoints that do not return
+// it are assumed to serve all buckets in the client's region. Returns ErrNotFound if the bucket does not exist
+func (c client) s3For(ctx context.Context, name string) (*s3.S3, error) {
+	region, ok := c.regions.get(name)
+	if !ok {
+		var err error
+		// requests are signed, as anonymous requests may be rejected without the region by S3 compatible endpoints
+		region, err = s3manager.GetBucketRegionWithClient(ctx, c.s3, name, func(r *request.Request) {
+			r.Config.Credentials = c.s3.Config.Credentials
+		})
+		switch {
+		case isNotFound(err):
+			return nil, fmt.Errorf("failed finding the region of bucket %s: %w", name, ErrNotFound)
+		case err != nil:
+			// the request for the bucket fails the same way if the error was not caused by the region
+			region = c.region
+		default:
+			if region == "" {
+				region = c.region
+			}
+			c.regions.set(name, region)
+		}
+	}
+	return c.regions.client(region), nil
+}
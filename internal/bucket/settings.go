@@ -0,0 +1,121 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// EncryptionS3 encrypts objects with keys managed by S3 (SSE-S3)
+	EncryptionS3 = s3.ServerSideEncryptionAes256
+	// EncryptionKMS encrypts objects with a KMS key (SSE-KMS)
+	EncryptionKMS = s3.ServerSideEncryptionAwsKms
+
+	// expirationRuleID is the ID of the lifecycle rule that expires objects
+	expirationRuleID = "csi-s3-expiration"
+)
+
+// Settings are applied to a bucket by Configure. Zero values leave the bucket's defaults as they are
+type Settings struct {
+	// Versioning enables versioning
+	Versioning bool
+	// Encryption is the default server-side encryption of new objects, one of EncryptionS3, EncryptionKMS
+	Encryption string
+	// KMSKeyID is the key used with EncryptionKMS. S3 uses the account's default key if empty
+	KMSKeyID string
+	// ExpirationDays is the number of days after which objects expire
+	ExpirationDays int64
+	// ObjectLockMode is the default retention mode of new objects, one of GOVERNANCE, COMPLIANCE.
+	// The bucket must have been created with object lock
+	ObjectLockMode string
+	// ObjectLockDays is the default retention period of new objects
+	ObjectLockDays int64
+	// BlockPublicAccess blocks public ACLs and bucket policies
+	BlockPublicAccess bool
+}
+
+// Configure applies settings to the bucket. Each setting replaces the bucket's configuration of that kind
+func (c client) Configure(ctx context.Context, name string, s Settings) error {
+	svc, err := c.s3For(ctx, name)
+	if err != nil {
+		return err
+	}
+	if s.Versioning {
+		_, err := svc.PutBucketVersioningWithContext(ctx, &s3.PutBucketVersioningInput{
+			Bucket:                  aws.String(name),
+			VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+		})
+		if err != nil {
+			return configureError(name, "versioning", err)
+		}
+	}
+	if s.Encryption != "" {
+		byDefault := &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(s.Encryption)}
+		if s.KMSKeyID != "" {
+			byDefault.KMSMasterKeyID = aws.String(s.KMSKeyID)
+		}
+		_, err := svc.PutBucketEncryptionWithContext(ctx, &s3.PutBucketEncryptionInput{
+			Bucket: aws.String(name),
+			ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+				Rules: []*s3.ServerSideEncryptionRule{{ApplyServerSideEncryptionByDefault: byDefault}},
+			},
+		})
+		if err != nil {
+			return configureError(name, "encryption", err)
+		}
+	}
+	if s.ExpirationDays > 0 {
+		_, err := svc.PutBucketLifecycleConfigurationWithContext(ctx, &s3.PutBucketLifecycleConfigurationInput{
+			Bucket: aws.String(name),
+			LifecycleConfiguration: &s3.BucketLifecycleConfiguration{Rules: []*s3.LifecycleRule{{
+				ID:         aws.String(expirationRuleID),
+				Status:     aws.String(s3.ExpirationStatusEnabled),
+				Filter:     &s3.LifecycleRuleFilter{Prefix: aws.String("")},
+				Expiration: &s3.LifecycleExpiration{Days: aws.Int64(s.ExpirationDays)},
+			}}},
+		})
+		if err != nil {
+			return configureError(name, "lifecycle", err)
+		}
+	}
+	if s.ObjectLockMode != "" {
+		_, err := svc.PutObjectLockConfigurationWithContext(ctx, &s3.PutObjectLockConfigurationInput{
+			Bucket: aws.String(name),
+			ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+				ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+				Rule: &s3.ObjectLockRule{DefaultRetention: &s3.DefaultRetention{
+					Mode: aws.String(s.ObjectLockMode),
+					Days: aws.Int64(s.ObjectLockDays),
+				}},
+			},
+		})
+		if err != nil {
+			return configureError(name, "object lock", err)
+		}
+	}
+	if s.BlockPublicAccess {
+		_, err := svc.PutPublicAccessBlockWithContext(ctx, &s3.PutPublicAccessBlockInput{
+			Bucket: aws.String(name),
+			PublicAccessBlockConfiguration: &s3.PublicAccessBlockConfiguration{
+				BlockPublicAcls:       aws.Bool(true),
+				IgnorePublicAcls:      aws.Bool(true),
+				BlockPublicPolicy:     aws.Bool(true),
+				RestrictPublicBuckets: aws.Bool(true),
+			},
+		})
+		if err != nil {
+			return configureError(name, "public access block", err)
+		}
+	}
+	return nil
+}
+
+func configureError(name, setting string, err error) error {
+	if isNotFound(err) {
+		return fmt.Errorf("failed setting %s of bucket %s: %w", setting, name, ErrNotFound)
+	}
+	return fmt.Errorf("failed setting %s of bucket %s: %w", setting, name, err)
+}
@@ -0,0 +1,168 @@
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Cache manages the cache directories of volumes under a root directory on the node
+// and keeps their total size within a limit by deleting the least recently used files.
+// It is safe for concurrent use
+type Cache struct {
+	root     string
+	maxBytes int64
+	// mu serializes eviction with creating and removing directories
+	mu sync.Mutex
+}
+
+// New returns a Cache under root. The size of the cache is not limited if maxBytes is 0
+func New(root string, maxBytes int64) *Cache {
+	return &Cache{root: root, maxBytes: maxBytes}
+}
+
+// Dir creates the cache directory of the volume published at targetPath and returns its path
+func (c *Cache) Dir(targetPath string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir := c.dir(targetPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", fmt.Errorf("failed creating cache directory for %s: %w", targetPath, err)
+	}
+	return dir, nil
+}
+
+// Remove deletes the cache directory of the volume published at targetPath
+func (c *Cache) Remove(targetPath string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.RemoveAll(c.dir(targetPath)); err != nil {
+		return fmt.Errorf("failed removing cache directory of %s: %w", targetPath, err)
+	}
+	return nil
+}
+
+// dir returns the cache directory of a target path. Target paths are hashed as they are nested paths
+func (c *Cache) dir(targetPath string) string {
+	sum := sha256.Sum256([]byte(targetPath))
+	return filepath.Join(c.root, hex.EncodeToString(sum[:16]))
+}
+
+// cachedFile is a file in the cache
+type cachedFile struct {
+	path     string
+	size     int64
+	lastUsed time.Time
+}
+
+// Evict deletes the least recently used files across all volumes' directories until their total size is within
+// the limit and returns the number of bytes freed. Files are laid out as s3fs does- an object cached at
+// <volume>/<bucket>/<key> has its stat file at <volume>/.<bucket>.stat/<key>, which is deleted with it
+func (c *Cache) Evict() (int64, error) {
+	if c.maxBytes == 0 {
+		return 0, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var files []cachedFile
+	var total int64
+	err := filepath.Walk(c.root, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) {
+			// deleted by the mounter while walking
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && strings.HasPrefix(info.Name(), ".") && path != c.root {
+			// stat files are deleted with their objects
+			return filepath.SkipDir
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		files = append(files, cachedFile{path: path, size: info.Size(), lastUsed: lastUsed(info)})
+		total += info.Size()
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed listing cached files: %w", err)
+	}
+	if total <= c.maxBytes {
+		return 0, nil
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].lastUsed.Before(files[j].lastUsed) })
+	var freed int64
+	for _, f := range files {
+		if total-freed <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return freed, fmt.Errorf("failed evicting %s: %w", f.path, err)
+		}
+		if stat := c.statFile(f.path); stat != "" {
+			if err := os.Remove(stat); err != nil && !os.IsNotExist(err) {
+				return freed, fmt.Errorf("failed evicting %s: %w", stat, err)
+			}
+		}
+		freed += f.size
+	}
+	return freed, nil
+}
+
+// statFile returns the path of the s3fs stat file of a cached object, empty if it is not in a bucket directory
+func (c *Cache) statFile(path string) string {
+	rel, err := filepath.Rel(c.root, path)
+	if err != nil {
+		return ""
+	}
+	// <volume>/<bucket>/<key>
+	parts := strings.SplitN(rel, string(filepath.Separator), 3)
+	if len(parts) != 3 {
+		return ""
+	}
+	return filepath.Join(c.root, parts[0], "."+parts[1]+".stat", parts[2])
+}
+
+// Run evicts files every interval until ctx is done
+func (c *Cache) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			freed, err := c.Evict()
+			if err != nil {
+				klog.ErrorS(err, "Failed to evict cached files", "dir", c.root)
+				continue
+			}
+			if freed > 0 {
+				klog.V(2).InfoS("Evicted cached files", "dir", c.root, "freedBytes", freed)
+			}
+		}
+	}
+}
+
+// lastUsed returns the later of a file's access and modification times. Access times may only be updated
+// once a day on filesystems mounted with relatime, so modification times order recently written files
+func lastUsed(info os.FileInfo) time.Time {
+	used := info.ModTime()
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		if atime := time.Unix(st.Atim.Sec, st.Atim.Nsec); atime.After(used) {
+			used = atime
+		}
+	}
+	return used
+}
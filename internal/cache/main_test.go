@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCached writes size bytes to the cached object key of bucket, along with its stat file, last used at t
+func writeCached(t *testing.T, volumeDir, bucket, key string, size int, used time.Time) {
+	t.Helper()
+	for _, path := range []string{filepath.Join(volumeDir, bucket, key), filepath.Join(volumeDir, "."+bucket+".stat", key)} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, make([]byte, size), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func Test_Cache_Dir_Remove(t *testing.T) {
+	c := New(t.TempDir(), 0)
+	dir, err := c.Dir("/var/lib/kubelet/pods/some-uid/volumes/kubernetes.io~csi/some-pv/mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := c.Dir("/var/lib/kubelet/pods/other-uid/volumes/kubernetes.io~csi/some-pv/mount")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dir == other || !exists(dir) || !exists(other) {
+		t.Fatalf("Cache.Dir() = %s, %s, want distinct existing directories", dir, other)
+	}
+	if again, _ := c.Dir("/var/lib/kubelet/pods/some-uid/volumes/kubernetes.io~csi/some-pv/mount"); again != dir {
+		t.Errorf("Cache.Dir() = %s for the same target path, want %s", again, dir)
+	}
+	if err := c.Remove("/var/lib/kubelet/pods/some-uid/volumes/kubernetes.io~csi/some-pv/mount"); err != nil {
+		t.Fatal(err)
+	}
+	if exists(dir) || !exists(other) {
+		t.Errorf("Cache.Remove() did not remove only the target path's directory")
+	}
+}
+
+func Test_Cache_Evict(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name      string
+		maxBytes  int64
+		wantFreed int64
+		// wantEvicted are the keys of the files that must have been deleted, all others must be kept
+		wantEvicted []string
+	}{
+		{
+			name:     "unlimited",
+			maxBytes: 0,
+		},
+		{
+			name:     "within the limit",
+			maxBytes: 60,
+		},
+		{
+			name:        "least recently used files are evicted across volumes",
+			maxBytes:    35,
+			wantFreed:   30,
+			wantEvicted: []string{"oldest", "older"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := New(t.TempDir(), tt.maxBytes)
+			some, err := c.Dir("/some/path")
+			if err != nil {
+				t.Fatal(err)
+			}
+			other, err := c.Dir("/other/path")
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := map[string]string{
+				"oldest": some, "older": other, "newer": some, "newest": other,
+			}
+			writeCached(t, some, "some-bucket", "oldest", 20, now.Add(-3*time.Hour))
+			writeCached(t, other, "other-bucket", "older", 10, now.Add(-2*time.Hour))
+			writeCached(t, some, "some-bucket", "newer", 10, now.Add(-time.Hour))
+			writeCached(t, other, "other-bucket", "newest", 20, now)
+
+			freed, err := c.Evict()
+			if err != nil {
+				t.Fatalf("Cache.Evict() error = %v", err)
+			}
+			if freed != tt.wantFreed {
+				t.Errorf("Cache.Evict() = %d, want %d", freed, tt.wantFreed)
+			}
+			evicted := make(map[string]bool)
+			for _, k := range tt.wantEvicted {
+				evicted[k] = true
+			}
+			for key, dir := range files {
+				bucket := "some-bucket"
+				if dir == other {
+					bucket = "other-bucket"
+				}
+				data, stat := filepath.Join(dir, bucket, key), filepath.Join(dir, "."+bucket+".stat", key)
+				if exists(data) == evicted[key] || exists(stat) == evicted[key] {
+					t.Errorf("Cache.Evict() evicted %s: %v, want %v", key, !exists(data), evicted[key])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"flag"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Flags are command line flags that override values from the config file.
+// Only flags that have been explicitly set on the command line override the config
+type Flags struct {
+	fs      *flag.FlagSet
+	setters map[string]func(*Config)
+}
+
+// RegisterFlags registers the driver's flags on fs.
+// Defaults shown in usage are those of Default
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := &Flags{fs: fs, setters: make(map[string]func(*Config))}
+	d := Default()
+
+	f.string("csi-address", d.CSIAddress, "Endpoint on which the gRPC server will serve Identity, Node, Controller services. One of unix:///path/to.sock, tcp://host:port or a UDS path", func(c *Config, v string) { c.CSIAddress = v })
+	f.string("driver-version", d.DriverVersion, "driver release version", func(c *Config, v string) { c.DriverVersion = v })
+	f.string("log-format", d.Logging.Format, "Format of log lines. One of text, json", func(c *Config, v string) { c.Logging.Format = v })
+	f.string("metrics-address", d.Metrics.Address, "Address (i.e :8080) on which to serve Prometheus metrics at /metrics. Metrics are not served if empty", func(c *Config, v string) { c.Metrics.Address = v })
+	f.string("mounter", d.Mounter.Name, "Mount backend. Currently only s3fs is supported", func(c *Config, v string) { c.Mounter.Name = v })
+	f.string("mounterBinaryPath", d.MounterBinaryPath(), "Path to the selected mount backend binary", func(c *Config, v string) {
+		binaries := make(map[string]string, len(c.Mounter.Binaries)+1)
+		for k, b := range c.Mounter.Binaries {
+			binaries[k] = b
+		}
+		binaries[c.Mounter.Name] = v
+		c.Mounter.Binaries = binaries
+	})
+	f.string("nodeid", d.NodeID, "id of the kubernetes node on which this driver is currently running", func(c *Config, v string) { c.NodeID = v })
+	f.string("node-topology", "", "Comma separated key=value topology segments reported for this node, i.e topology.s3.csi.irbe.dev/zone=eu-west-1a", func(c *Config, v string) { c.Topology = parseTopology(v) })
+	f.string("plugin-type", d.Plugin.Type, "CSI services to serve. One of node, controller, monolith", func(c *Config, v string) { c.Plugin.Type = v })
+	f.duration("shutdown-timeout", d.Shutdown.Timeout.Duration, "How long to wait for in-flight RPCs to finish after receiving SIGTERM or SIGINT before cancelling them", func(c *Config, v time.Duration) { c.Shutdown.Timeout.Duration = v })
+	f.string("tls-cert-file", d.TLS.CertFile, "PEM encoded certificate for serving the gRPC API over TLS. TLS is disabled if empty", func(c *Config, v string) { c.TLS.CertFile = v })
+	f.string("tls-key-file", d.TLS.KeyFile, "PEM encoded private key of --tls-cert-file", func(c *Config, v string) { c.TLS.KeyFile = v })
+	f.string("tls-client-ca-file", d.TLS.ClientCAFile, "PEM encoded CA bundle. If set, clients must present a certificate signed by one of these CAs", func(c *Config, v string) { c.TLS.ClientCAFile = v })
+	f.string("tracing-exporter", d.Tracing.Exporter, "Where to export trace spans to. One of none, otlp", func(c *Config, v string) { c.Tracing.Exporter = v })
+	f.string("tracing-endpoint", d.Tracing.Endpoint, "host:port of the OTLP collector. Defaults to OTEL_EXPORTER_OTLP_ENDPOINT env var or localhost:4317", func(c *Config, v string) { c.Tracing.Endpoint = v })
+	f.bool("tracing-insecure", d.Tracing.Insecure, "Connect to the OTLP collector without TLS", func(c *Config, v bool) { c.Tracing.Insecure = v })
+	f.bool("unmount-on-shutdown", d.Shutdown.UnmountVolumes, "Unmount all volumes mounted by the selected mount backend when shutting down. By default mounts are left intact so that running pods keep their volumes", func(c *Config, v bool) { c.Shutdown.UnmountVolumes = v })
+	return f
+}
+
+// Apply overrides values in c with flags that were set on the command line.
+// klog's -v flag overrides logging.verbosity
+func (f *Flags) Apply(c *Config) {
+	f.fs.Visit(func(fl *flag.Flag) {
+		if set, ok := f.setters[fl.Name]; ok {
+			set(c)
+			return
+		}
+		if fl.Name == "v" {
+			if v, err := strconv.Atoi(fl.Value.String()); err == nil {
+				c.Logging.Verbosity = v
+			}
+		}
+	})
+}
+
+func (f *Flags) string(name, value, usage string, set func(*Config, string)) {
+	p := f.fs.String(name, value, usage)
+	f.setters[name] = func(c *Config) { set(c, *p) }
+}
+
+func (f *Flags) bool(name string, value bool, usage string, set func(*Config, bool)) {
+	p := f.fs.Bool(name, value, usage)
+	f.setters[name] = func(c *Config) { set(c, *p) }
+}
+
+func (f *Flags) duration(name string, value time.Duration, usage string, set func(*Config, time.Duration)) {
+	p := f.fs.Duration(name, value, usage)
+	f.setters[name] = func(c *Config) { set(c, *p) }
+}
+
+// parseTopology parses comma separated key=value pairs. A pair without = gets an empty value, which fails validation
+func parseTopology(s string) map[string]string {
+	t := make(map[string]string)
+	for _, kv := range strings.Split(s, ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		k, v := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			k, v = kv[:i], kv[i+1:]
+		}
+		t[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return t
+}
@@ -0,0 +1,422 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sync/atomic"
+	"time"
+
+	"github.com/irbekrm/csi-s3/internal/endpoint"
+	"github.com/irbekrm/csi-s3/internal/logging"
+	"github.com/irbekrm/csi-s3/internal/policy"
+	"github.com/irbekrm/csi-s3/internal/tracing"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// APIVersion is the only config file version currently understood
+	APIVersion = "s3.csi.irbe.dev/v1alpha1"
+	// Kind of the config file
+	Kind = "DriverConfig"
+
+	// PluginTypeNode serves Identity and Node services
+	PluginTypeNode = "node"
+	// PluginTypeController serves Identity and Controller services
+	PluginTypeController = "controller"
+	// PluginTypeMonolith serves Identity, Node and Controller services
+	PluginTypeMonolith = "monolith"
+
+	// CredentialsFromSecrets reads credentials from secrets passed with the CSI request
+	CredentialsFromSecrets = "secrets"
+	// CredentialsFromEnv reads credentials from the driver's own AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env vars
+	CredentialsFromEnv = "env"
+)
+
+// supportedMounters are the mount backends the driver knows how to run
+var supportedMounters = []string{"s3fs"}
+
+// Config is the driver's configuration file.
+// Fields marked as reloadable are applied on SIGHUP, changes to other fields require a restart
+type Config struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// CSIAddress is the endpoint on which the gRPC server listens, one of unix:///path, tcp://host:port or a UDS path
+	CSIAddress string    `json:"csiAddress"`
+	TLS        TLSConfig `json:"tls"`
+	// DriverVersion is reported in GetPluginInfo
+	DriverVersion string `json:"driverVersion"`
+	// NodeID is the id of the node on which the driver is running
+	NodeID string `json:"nodeID"`
+	// Topology are the segments, i.e topology.s3.csi.irbe.dev/zone: eu-west-1a, reported for this node in NodeGetInfo
+	Topology    map[string]string `json:"topology"`
+	Plugin      PluginConfig      `json:"plugin"`
+	Mounter     MounterConfig     `json:"mounter"`
+	S3          S3Config          `json:"s3"`
+	Quota       QuotaConfig       `json:"quota"`
+	Snapshots   SnapshotsConfig   `json:"snapshots"`
+	Copy        CopyConfig        `json:"copy"`
+	Credentials CredentialsConfig `json:"credentials"`
+	Policy      PolicyConfig      `json:"policy"`
+	Metrics     MetricsConfig     `json:"metrics"`
+	Tracing     TracingConfig     `json:"tracing"`
+	Logging     LoggingConfig     `json:"logging"`
+	Cache       CacheConfig       `json:"cache"`
+	Limits      LimitsConfig      `json:"limits"`
+	Shutdown    ShutdownConfig    `json:"shutdown"`
+}
+
+// PluginConfig selects which CSI services the driver serves
+type PluginConfig struct {
+	// Type is one of node, controller, monolith (both node and controller)
+	Type string `json:"type"`
+}
+
+// TLSConfig configures TLS for the gRPC server. TLS is disabled if CertFile is empty
+type TLSConfig struct {
+	// CertFile is the PEM encoded server certificate
+	CertFile string `json:"certFile"`
+	// KeyFile is the PEM encoded private key of the server certificate
+	KeyFile string `json:"keyFile"`
+	// ClientCAFile is the PEM encoded CA bundle used to verify client certificates. Client certificates are not required if empty
+	ClientCAFile string `json:"clientCAFile"`
+}
+
+// MounterConfig selects the mount backend
+type MounterConfig struct {
+	// Name of the mount backend to use
+	Name string `json:"name"`
+	// Binaries maps mount backend names to paths of their binaries
+	Binaries map[string]string `json:"binaries"`
+}
+
+// S3Config holds defaults for the S3 endpoint volumes are mounted from. Reloadable
+type S3Config struct {
+	// Endpoint is the URL of the S3 API. AWS S3 is used if empty
+	Endpoint string `json:"endpoint"`
+	// PathStyle addresses buckets as <endpoint>/<bucket> instead of <bucket>.<endpoint>. Most S3 compatible stores need this
+	PathStyle bool `json:"pathStyle"`
+	// Region is the region in which buckets are created without a topology and for which requests are signed until a
+	// bucket's region is known. Defaults to us-east-1
+	Region string `json:"region"`
+	// PodUserAgent appends the namespace and name of the pod that a volume is published for
+	// to the user agent of requests that the node makes to S3 for the volume
+	PodUserAgent bool `json:"podUserAgent"`
+}
+
+// QuotaConfig configures soft quotas. Reloadable
+type QuotaConfig struct {
+	// Enforce reports a volume as abnormal in NodeGetVolumeStats when its bucket is larger than its recorded capacity
+	Enforce bool `json:"enforce"`
+	// UsageTTL is how long a bucket's usage is reused for before its objects are listed again. Zero lists them on
+	// every NodeGetVolumeStats
+	UsageTTL Duration `json:"usageTTL"`
+}
+
+// SnapshotsConfig configures volume snapshots
+type SnapshotsConfig struct {
+	// Bucket in which snapshots are stored, each under its own prefix. Snapshots are disabled if empty
+	Bucket string `json:"bucket"`
+}
+
+// CopyConfig configures the server-side copies of objects made when cloning volumes, taking snapshots and restoring them. Reloadable
+type CopyConfig struct {
+	// Parallelism is the maximum number of objects that one volume or snapshot copies at a time
+	Parallelism int `json:"parallelism"`
+	// PartSizeMB is the size of the parts in which objects larger than 5GiB are copied
+	PartSizeMB int `json:"partSizeMB"`
+}
+
+// CredentialsConfig determines where credentials for mounting a volume come from. Reloadable
+type CredentialsConfig struct {
+	// Providers are tried in order until one of them has credentials. One of secrets, env
+	Providers []string `json:"providers"`
+}
+
+// PolicyConfig restricts which pods can use which buckets. Reloadable
+type PolicyConfig struct {
+	// BucketNamespaces maps buckets to the namespaces whose pods may publish them. Buckets that are not listed can be published by any pod
+	BucketNamespaces map[string][]string `json:"bucketNamespaces"`
+	// Policy holds rules that are evaluated for each NodePublishVolume and CreateVolume, after BucketNamespaces
+	policy.Policy
+}
+
+// MetricsConfig configures the Prometheus metrics endpoint
+type MetricsConfig struct {
+	// Address (i.e :9809) on which metrics are served. Metrics are not served if empty
+	Address string `json:"address"`
+}
+
+// TracingConfig configures exporting of trace spans
+type TracingConfig struct {
+	// Exporter is one of none, otlp
+	Exporter string `json:"exporter"`
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string `json:"endpoint"`
+	// Insecure disables TLS when connecting to the collector
+	Insecure bool `json:"insecure"`
+}
+
+// LoggingConfig configures log output
+type LoggingConfig struct {
+	// Format is one of text, json
+	Format string `json:"format"`
+	// Verbosity is klog's log level. Reloadable
+	Verbosity int `json:"verbosity"`
+}
+
+// CacheConfig configures the mounters' local disk cache
+type CacheConfig struct {
+	// Dir is the directory (on a node hostPath) under which each volume gets a directory in which the mounter caches objects.
+	// Caching is disabled if empty
+	Dir string `json:"dir"`
+	// MinFreeDiskMB is the disk space in MB that mounters leave free when caching
+	MinFreeDiskMB int `json:"minFreeDiskMB"`
+	// MaxSizeMB is the total size in MB of all volumes' cached objects, above which the least recently used are evicted. Unlimited if 0
+	MaxSizeMB int64 `json:"maxSizeMB"`
+	// EvictionInterval is how often the size of the cache is checked
+	EvictionInterval Duration `json:"evictionInterval"`
+}
+
+// LimitsConfig configures limits on the node
+type LimitsConfig struct {
+	// MaxVolumesPerNode is the maximum number of volumes that can be published on this node. Unlimited if 0
+	MaxVolumesPerNode int64 `json:"maxVolumesPerNode"`
+}
+
+// ShutdownConfig configures what happens when the driver is stopped. Reloadable
+type ShutdownConfig struct {
+	// Timeout is how long to wait for in-flight RPCs to finish before cancelling them
+	Timeout Duration `json:"timeout"`
+	// UnmountVolumes unmounts all volumes of the mounter before exiting
+	UnmountVolumes bool `json:"unmountVolumes"`
+}
+
+// Default returns the configuration used if no config file is given
+func Default() *Config {
+	return &Config{
+		APIVersion:    APIVersion,
+		Kind:          Kind,
+		CSIAddress:    "/csi/csi.sock",
+		DriverVersion: "test",
+		Plugin:        PluginConfig{Type: PluginTypeNode},
+		Mounter: MounterConfig{
+			Name:     "s3fs",
+			Binaries: map[string]string{"s3fs": "/usr/local/bin/s3fs"},
+		},
+		Quota:       QuotaConfig{UsageTTL: Duration{5 * time.Minute}},
+		Copy:        CopyConfig{Parallelism: 8, PartSizeMB: 512},
+		Credentials: CredentialsConfig{Providers: []string{CredentialsFromSecrets}},
+		Tracing:     TracingConfig{Exporter: tracing.ExporterNone},
+		Logging:     LoggingConfig{Format: logging.FormatText},
+		Cache:       CacheConfig{EvictionInterval: Duration{time.Minute}},
+		Shutdown:    ShutdownConfig{Timeout: Duration{30 * time.Second}},
+	}
+}
+
+// Load reads a YAML or JSON config file at path on top of the defaults.
+// Unknown fields are an error. The result is not validated, see Validate
+func Load(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading config file: %w", err)
+	}
+	c := Default()
+	if err := yaml.UnmarshalStrict(b, c); err != nil {
+		return nil, fmt.Errorf("failed parsing config file %s: %w", path, err)
+	}
+	return c, nil
+}
+
+// Validate checks that the config can be used to run the driver
+func (c *Config) Validate() error {
+	if c.APIVersion != APIVersion {
+		return fmt.Errorf("unsupported apiVersion %q, expected %q", c.APIVersion, APIVersion)
+	}
+	if c.Kind != Kind {
+		return fmt.Errorf("unsupported kind %q, expected %q", c.Kind, Kind)
+	}
+	if _, _, err := endpoint.Parse(c.CSIAddress); err != nil {
+		return fmt.Errorf("invalid csiAddress: %w", err)
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return fmt.Errorf("tls.certFile and tls.keyFile must be set together")
+	}
+	if c.TLS.ClientCAFile != "" && c.TLS.CertFile == "" {
+		return fmt.Errorf("tls.clientCAFile requires tls.certFile and tls.keyFile")
+	}
+	switch c.Plugin.Type {
+	case PluginTypeNode, PluginTypeController, PluginTypeMonolith:
+	default:
+		return fmt.Errorf("unknown plugin.type %q, expected one of %s, %s, %s", c.Plugin.Type, PluginTypeNode, PluginTypeController, PluginTypeMonolith)
+	}
+	for k, v := range c.Topology {
+		if k == "" || v == "" {
+			return fmt.Errorf("topology keys and values must not be empty, got %q: %q", k, v)
+		}
+	}
+	if !contains(supportedMounters, c.Mounter.Name) {
+		return fmt.Errorf("unknown mounter %q, supported mounters are %v", c.Mounter.Name, supportedMounters)
+	}
+	if c.MounterBinaryPath() == "" {
+		return fmt.Errorf("binary path for mounter %s must be set", c.Mounter.Name)
+	}
+	if c.S3.Endpoint != "" {
+		u, err := url.Parse(c.S3.Endpoint)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("s3.endpoint must be a URL such as https://s3.example.com, got %q", c.S3.Endpoint)
+		}
+	}
+	for b, namespaces := range c.Policy.BucketNamespaces {
+		for _, ns := range namespaces {
+			if ns == "" {
+				return fmt.Errorf("policy.bucketNamespaces of bucket %s must not contain empty namespaces", b)
+			}
+		}
+	}
+	if err := c.Policy.Policy.Validate(); err != nil {
+		return fmt.Errorf("invalid policy: %w", err)
+	}
+	if c.Copy.Parallelism < 1 {
+		return fmt.Errorf("copy.parallelism must be at least 1")
+	}
+	// S3 parts, other than the last one, are between 5MiB and 5GiB
+	if c.Copy.PartSizeMB < 5 || c.Copy.PartSizeMB > 5120 {
+		return fmt.Errorf("copy.partSizeMB must be between 5 and 5120, got %d", c.Copy.PartSizeMB)
+	}
+	if len(c.Credentials.Providers) == 0 {
+		return fmt.Errorf("at least one credentials provider must be set")
+	}
+	for _, p := range c.Credentials.Providers {
+		if p != CredentialsFromSecrets && p != CredentialsFromEnv {
+			return fmt.Errorf("unknown credentials provider %q, expected one of %s, %s", p, CredentialsFromSecrets, CredentialsFromEnv)
+		}
+	}
+	if e := c.Tracing.Exporter; e != tracing.ExporterNone && e != tracing.ExporterOTLP {
+		return fmt.Errorf("unknown tracing exporter %q, expected one of %s, %s", e, tracing.ExporterNone, tracing.ExporterOTLP)
+	}
+	if f := c.Logging.Format; f != logging.FormatText && f != logging.FormatJSON {
+		return fmt.Errorf("unknown log format %q, expected one of %s, %s", f, logging.FormatText, logging.FormatJSON)
+	}
+	if c.Logging.Verbosity < 0 {
+		return fmt.Errorf("logging.verbosity must not be negative")
+	}
+	if c.Cache.Dir != "" && !filepath.IsAbs(c.Cache.Dir) {
+		return fmt.Errorf("cache.dir must be an absolute path, got %q", c.Cache.Dir)
+	}
+	if c.Cache.MinFreeDiskMB < 0 {
+		return fmt.Errorf("cache.minFreeDiskMB must not be negative")
+	}
+	if c.Cache.MaxSizeMB < 0 {
+		return fmt.Errorf("cache.maxSizeMB must not be negative")
+	}
+	if c.Cache.EvictionInterval.Duration <= 0 {
+		return fmt.Errorf("cache.evictionInterval must be positive")
+	}
+	if c.Quota.UsageTTL.Duration < 0 {
+		return fmt.Errorf("quota.usageTTL must not be negative")
+	}
+	if c.Limits.MaxVolumesPerNode < 0 {
+		return fmt.Errorf("limits.maxVolumesPerNode must not be negative")
+	}
+	if c.Shutdown.Timeout.Duration <= 0 {
+		return fmt.Errorf("shutdown.timeout must be positive")
+	}
+	return nil
+}
+
+// ServesNode returns true if the driver serves the Node service
+func (c *Config) ServesNode() bool {
+	return c.Plugin.Type == PluginTypeNode || c.Plugin.Type == PluginTypeMonolith
+}
+
+// ServesController returns true if the driver serves the Controller service
+func (c *Config) ServesController() bool {
+	return c.Plugin.Type == PluginTypeController || c.Plugin.Type == PluginTypeMonolith
+}
+
+// MounterBinaryPath returns path to the selected mounter's binary
+func (c *Config) MounterBinaryPath() string {
+	return c.Mounter.Binaries[c.Mounter.Name]
+}
+
+// Reload returns a copy of c with the reloadable fields taken from next,
+// along with names of the other fields whose changes will only be applied after a restart
+func (c *Config) Reload(next *Config) (*Config, []string) {
+	r := *c
+	r.S3 = next.S3
+	r.Quota = next.Quota
+	r.Copy = next.Copy
+	r.Credentials = next.Credentials
+	r.Policy = next.Policy
+	r.Logging.Verbosity = next.Logging.Verbosity
+	r.Shutdown = next.Shutdown
+
+	var ignored []string
+	// everything that differs between next and the reloaded config has not been applied
+	rv, nv := reflect.ValueOf(r), reflect.ValueOf(*next)
+	for i := 0; i < rv.NumField(); i++ {
+		if !reflect.DeepEqual(rv.Field(i).Interface(), nv.Field(i).Interface()) {
+			ignored = append(ignored, rv.Type().Field(i).Tag.Get("json"))
+		}
+	}
+	return &r, ignored
+}
+
+// Holder holds the current config. It is safe for concurrent use
+type Holder struct {
+	v atomic.Value
+}
+
+// NewHolder returns a Holder with c as the current config
+func NewHolder(c *Config) *Holder {
+	h := &Holder{}
+	h.Store(c)
+	return h
+}
+
+// Load returns the current config. It must not be modified
+func (h *Holder) Load() *Config {
+	return h.v.Load().(*Config)
+}
+
+// Store replaces the current config
+func (h *Holder) Store(c *Config) {
+	h.v.Store(c)
+}
+
+// Duration is a time.Duration that is written as a string, i.e 30s, in config files
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as 30s: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// MarshalJSON writes the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
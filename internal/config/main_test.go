@@ -0,0 +1,320 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/irbekrm/csi-s3/internal/policy"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func Test_Load(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		want    func(*Config)
+		wantErr bool
+	}{
+		{
+			name: "yaml",
+			file: "config.yaml",
+			content: `
+apiVersion: s3.csi.irbe.dev/v1alpha1
+kind: DriverConfig
+nodeID: some-node
+mounter:
+  binaries:
+    s3fs: /usr/bin/s3fs
+s3:
+  endpoint: https://minio.example.com
+  pathStyle: true
+credentials:
+  providers: [env, secrets]
+shutdown:
+  timeout: 1m
+`,
+			want: func(c *Config) {
+				c.NodeID = "some-node"
+				c.Mounter.Binaries = map[string]string{"s3fs": "/usr/bin/s3fs"}
+				c.S3 = S3Config{Endpoint: "https://minio.example.com", PathStyle: true}
+				c.Credentials.Providers = []string{CredentialsFromEnv, CredentialsFromSecrets}
+				c.Shutdown.Timeout = Duration{time.Minute}
+			},
+		},
+		{
+			name:    "json",
+			file:    "config.json",
+			content: `{"apiVersion": "s3.csi.irbe.dev/v1alpha1", "kind": "DriverConfig", "limits": {"maxVolumesPerNode": 10}}`,
+			want: func(c *Config) {
+				c.Limits.MaxVolumesPerNode = 10
+			},
+		},
+		{
+			name: "policy",
+			file: "config.yaml",
+			content: `
+policy:
+  bucketNamespaces:
+    some-bucket: [some-namespace]
+  default: allow
+  rules:
+  - name: no-writes-to-archives
+    effect: deny
+    buckets: ["*-archive"]
+    accessModes: [read-write]
+`,
+			want: func(c *Config) {
+				c.Policy = PolicyConfig{
+					BucketNamespaces: map[string][]string{"some-bucket": {"some-namespace"}},
+					Policy: policy.Policy{
+						Default: policy.Allow,
+						Rules:   []policy.Rule{{Name: "no-writes-to-archives", Effect: policy.Deny, Buckets: []string{"*-archive"}, AccessModes: []string{policy.ReadWrite}}},
+					},
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			file:    "config.yaml",
+			content: "apiVersion: s3.csi.irbe.dev/v1alpha1\nkind: DriverConfig\nmounterr: s3fs\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid duration",
+			file:    "config.yaml",
+			content: "shutdown:\n  timeout: 30\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Load(writeFile(t, tt.file, tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			want := Default()
+			tt.want(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Load() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func Test_Config_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(*Config)
+		wantErr bool
+	}{
+		{
+			name:   "defaults",
+			modify: func(*Config) {},
+		},
+		{
+			name:    "unsupported version",
+			modify:  func(c *Config) { c.APIVersion = "s3.csi.irbe.dev/v2" },
+			wantErr: true,
+		},
+		{
+			name:   "tcp address",
+			modify: func(c *Config) { c.CSIAddress = "tcp://127.0.0.1:10000" },
+		},
+		{
+			name:    "unsupported address scheme",
+			modify:  func(c *Config) { c.CSIAddress = "http://127.0.0.1:10000" },
+			wantErr: true,
+		},
+		{
+			name: "mTLS",
+			modify: func(c *Config) {
+				c.TLS = TLSConfig{CertFile: "/tls/tls.crt", KeyFile: "/tls/tls.key", ClientCAFile: "/tls/ca.crt"}
+			},
+		},
+		{
+			name:    "tls cert without key",
+			modify:  func(c *Config) { c.TLS.CertFile = "/tls/tls.crt" },
+			wantErr: true,
+		},
+		{
+			name:    "client CA without server cert",
+			modify:  func(c *Config) { c.TLS.ClientCAFile = "/tls/ca.crt" },
+			wantErr: true,
+		},
+		{
+			name:   "monolith",
+			modify: func(c *Config) { c.Plugin.Type = PluginTypeMonolith },
+		},
+		{
+			name:   "controller",
+			modify: func(c *Config) { c.Plugin.Type = PluginTypeController },
+		},
+		{
+			name:    "unknown plugin type",
+			modify:  func(c *Config) { c.Plugin.Type = "all" },
+			wantErr: true,
+		},
+		{
+			name:    "topology without value",
+			modify:  func(c *Config) { c.Topology = map[string]string{"zone": ""} },
+			wantErr: true,
+		},
+		{
+			name:    "unknown mounter",
+			modify:  func(c *Config) { c.Mounter.Name = "goofys" },
+			wantErr: true,
+		},
+		{
+			name:    "no binary for the mounter",
+			modify:  func(c *Config) { c.Mounter.Binaries = nil },
+			wantErr: true,
+		},
+		{
+			name:    "endpoint without scheme",
+			modify:  func(c *Config) { c.S3.Endpoint = "minio.example.com" },
+			wantErr: true,
+		},
+		{
+			name:    "no credentials providers",
+			modify:  func(c *Config) { c.Credentials.Providers = nil },
+			wantErr: true,
+		},
+		{
+			name:    "zero copy parallelism",
+			modify:  func(c *Config) { c.Copy.Parallelism = 0 },
+			wantErr: true,
+		},
+		{
+			name:    "copy part size below the S3 minimum",
+			modify:  func(c *Config) { c.Copy.PartSizeMB = 1 },
+			wantErr: true,
+		},
+		{
+			name:    "empty namespace in bucket policy",
+			modify:  func(c *Config) { c.Policy.BucketNamespaces = map[string][]string{"some-bucket": {""}} },
+			wantErr: true,
+		},
+		{
+			name:    "invalid policy rule",
+			modify:  func(c *Config) { c.Policy.Rules = []policy.Rule{{Name: "some-rule", Effect: "permit"}} },
+			wantErr: true,
+		},
+		{
+			name:    "unknown credentials provider",
+			modify:  func(c *Config) { c.Credentials.Providers = []string{"vault"} },
+			wantErr: true,
+		},
+		{
+			name:    "unknown log format",
+			modify:  func(c *Config) { c.Logging.Format = "xml" },
+			wantErr: true,
+		},
+		{
+			name:    "negative quota usage ttl",
+			modify:  func(c *Config) { c.Quota.UsageTTL = Duration{-time.Second} },
+			wantErr: true,
+		},
+		{
+			name:    "negative cache size",
+			modify:  func(c *Config) { c.Cache.MaxSizeMB = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "relative cache dir",
+			modify:  func(c *Config) { c.Cache.Dir = "cache" },
+			wantErr: true,
+		},
+		{
+			name:    "zero shutdown timeout",
+			modify:  func(c *Config) { c.Shutdown.Timeout = Duration{} },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := Default()
+			tt.modify(c)
+			if err := c.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Config.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_Flags_Apply(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("v", 0, "klog verbosity")
+	flags := RegisterFlags(fs)
+	if err := fs.Parse([]string{"--mounterBinaryPath=/opt/s3fs", "--nodeid=some-node", "--node-topology=region=eu-west-1, zone=eu-west-1a", "--v=4"}); err != nil {
+		t.Fatal(err)
+	}
+	c := Default()
+	c.NodeID = "from-file"
+	c.CSIAddress = "/from/file.sock"
+	flags.Apply(c)
+
+	if c.MounterBinaryPath() != "/opt/s3fs" {
+		t.Errorf("mounter binary path = %s, want /opt/s3fs", c.MounterBinaryPath())
+	}
+	if c.NodeID != "some-node" {
+		t.Errorf("node id = %s, want some-node", c.NodeID)
+	}
+	if want := map[string]string{"region": "eu-west-1", "zone": "eu-west-1a"}; !reflect.DeepEqual(c.Topology, want) {
+		t.Errorf("topology = %v, want %v", c.Topology, want)
+	}
+	if c.Logging.Verbosity != 4 {
+		t.Errorf("verbosity = %d, want 4", c.Logging.Verbosity)
+	}
+	// flags that were not set must not override the file
+	if c.CSIAddress != "/from/file.sock" {
+		t.Errorf("csi address = %s, want the one from the file", c.CSIAddress)
+	}
+	// the defaults must not be modified
+	if Default().MounterBinaryPath() != "/usr/local/bin/s3fs" {
+		t.Errorf("default mounter binary path was modified")
+	}
+}
+
+func Test_Config_Reload(t *testing.T) {
+	current := Default()
+	next := Default()
+	next.S3.Endpoint = "https://minio.example.com"
+	next.Logging.Verbosity = 5
+	next.Shutdown.UnmountVolumes = true
+	next.Quota.Enforce = true
+	next.Copy.Parallelism = 16
+	next.Policy.BucketNamespaces = map[string][]string{"some-bucket": {"some-namespace"}}
+	next.CSIAddress = "/other.sock"
+	next.Metrics.Address = ":9999"
+
+	got, ignored := current.Reload(next)
+
+	if got.S3.Endpoint != next.S3.Endpoint || got.Logging.Verbosity != 5 || !got.Shutdown.UnmountVolumes || !got.Quota.Enforce || got.Copy.Parallelism != 16 || len(got.Policy.BucketNamespaces) != 1 {
+		t.Errorf("Config.Reload() did not apply reloadable fields: %+v", got)
+	}
+	if got.CSIAddress != current.CSIAddress || got.Metrics.Address != current.Metrics.Address {
+		t.Errorf("Config.Reload() applied fields that require a restart: %+v", got)
+	}
+	if want := []string{"csiAddress", "metrics"}; !reflect.DeepEqual(ignored, want) {
+		t.Errorf("Config.Reload() ignored = %v, want %v", ignored, want)
+	}
+	if current.S3.Endpoint != "" {
+		t.Errorf("Config.Reload() modified the current config")
+	}
+}
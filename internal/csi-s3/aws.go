@@ -1,8 +1,67 @@
 package csis3
 
+import (
+	"os"
+	"sync"
+
+	"github.com/irbekrm/csi-s3/internal/config"
+)
+
+const (
+	envVarAwsAccessKeyID     = "AWS_ACCESS_KEY_ID"
+	envVarAwsSecretAccessKey = "AWS_SECRET_ACCESS_KEY"
+	// secretSSECustomerKey is the secret holding the base64 encoded key of sse c
+	secretSSECustomerKey = "SSE_CUSTOMER_KEY"
+)
+
 // TODO: move this whole thing to iaas (?) package and see if creds can be put into a struct or something
-func awsCreds(s map[string]string) (string, string, bool) {
-	key, keyOk := s["AWS_ACCESS_KEY_ID"]
-	secret, secretOk := s["AWS_SECRET_ACCESS_KEY"]
-	return key, secret, keyOk && secretOk
+// awsCreds tries the given credentials providers in order and returns the first credentials found
+func awsCreds(providers []string, s map[string]string) (string, string, bool) {
+	for _, p := range providers {
+		var key, secret string
+		switch p {
+		case config.CredentialsFromSecrets:
+			key, secret = s[envVarAwsAccessKeyID], s[envVarAwsSecretAccessKey]
+		case config.CredentialsFromEnv:
+			key, secret = os.Getenv(envVarAwsAccessKeyID), os.Getenv(envVarAwsSecretAccessKey)
+		}
+		if key != "" && secret != "" {
+			return key, secret, true
+		}
+	}
+	return "", "", false
+}
+
+// publishedVolume is the bucket that a volume was published from, the credentials it was published with and the pod it was published for
+type publishedVolume struct {
+	bucket, key, secret string
+	pod                 podInfo
+}
+
+// credentialsCache holds published volumes by target path. It is safe for concurrent use
+type credentialsCache struct {
+	mu      sync.Mutex
+	volumes map[string]publishedVolume
+}
+
+func (c *credentialsCache) set(path string, v publishedVolume) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.volumes == nil {
+		c.volumes = make(map[string]publishedVolume)
+	}
+	c.volumes[path] = v
+}
+
+func (c *credentialsCache) get(path string) (publishedVolume, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.volumes[path]
+	return v, ok
+}
+
+func (c *credentialsCache) delete(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.volumes, path)
 }
@@ -0,0 +1,501 @@
+package csis3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/bucket"
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/lock"
+	"github.com/irbekrm/csi-s3/internal/policy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// capacityTag is the bucket tag in which the capacity of the volume is recorded.
+	// S3 has no notion of capacity, so it is only used for soft quotas
+	capacityTag = driverName + "/capacity-bytes"
+	// volumeNameTag marks buckets created by CreateVolume with the name of their volume. Only such buckets are deleted by DeleteVolume
+	volumeNameTag = driverName + "/volume-name"
+	// contentSourceTag records the snapshot (snapshot:<id>) or volume (volume:<id>) that a volume was created from
+	contentSourceTag = driverName + "/content-source"
+	// contentCopiedTag is set once all objects of the content source have been copied into the volume's bucket
+	contentCopiedTag = driverName + "/content-copied"
+	// regionTag records the region that a bucket was created in to satisfy the volume's accessibility requirements
+	regionTag = driverName + "/region"
+
+	// copyProgressInterval is how often the progress of a copy is logged
+	copyProgressInterval = 30 * time.Second
+	// rollbackTimeout bounds deleting a bucket that could not be set up
+	rollbackTimeout = 30 * time.Second
+)
+
+// validBucketName matches volume names that can be used as bucket names as they are
+var validBucketName = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,61}[a-z0-9]$`)
+
+// NewControllerServer returns a csi.ControllerServer implementation
+// cfg is read on each RPC, so changes to its reloadable fields apply to subsequent RPCs
+func NewControllerServer(cfg *config.Holder) csi.ControllerServer {
+	return &controllerServer{locks: lock.NewKeyed(), cfg: cfg, newBucketClient: bucket.New}
+}
+
+type controllerServer struct {
+	*csi.UnimplementedControllerServer
+	// locks ensures that only one operation at a time runs for a volume id
+	locks           *lock.Keyed
+	cfg             *config.Holder
+	newBucketClient func(bucket.Options) (bucket.Client, error)
+}
+
+// CreateVolume creates a bucket for the volume, configured by the parameters, optionally copying the objects of a snapshot
+// or another volume into it. The bucket's name is the volume id
+func (c *controllerServer) CreateVolume(ctx context.Context, in *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	if in.Name == "" {
+		return &csi.CreateVolumeResponse{}, status.Error(codes.InvalidArgument, "name must be set")
+	}
+	if err := validateCapabilities(in.VolumeCapabilities); err != nil {
+		return &csi.CreateVolumeResponse{}, err
+	}
+	var capacity int64
+	if in.CapacityRange != nil {
+		var err error
+		if capacity, err = requestedCapacity(in.CapacityRange); err != nil {
+			return &csi.CreateVolumeResponse{}, err
+		}
+	}
+	params, err := parseParameters(in.Parameters)
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, err
+	}
+	settings, tags := params.settings, params.tags
+	if !c.locks.TryAcquire(in.Name) {
+		return &csi.CreateVolumeResponse{}, status.Errorf(codes.Aborted, "an operation for volume %s is already in progress", in.Name)
+	}
+	defer c.locks.Release(in.Name)
+
+	cfg := c.cfg.Load()
+	bucketName := volumeBucketName(in.Name)
+	if bucketName == cfg.Snapshots.Bucket {
+		return &csi.CreateVolumeResponse{}, status.Errorf(codes.AlreadyExists, "bucket %s of volume %s is the snapshots bucket", bucketName, in.Name)
+	}
+	// the namespace of the PVC is only known if csi-provisioner runs with --extra-create-metadata
+	req := policy.Request{Namespace: tags[pvcNamespaceTag], Bucket: bucketName, AccessMode: accessMode(in.VolumeCapabilities...)}
+	if err := authorize(cfg.Policy.Policy, req); err != nil {
+		return &csi.CreateVolumeResponse{}, err
+	}
+	// the bucket is created in the region required by the volume's topology. The client signs requests for other
+	// buckets, such as the content source, for their own regions
+	region := requestedRegion(in.AccessibilityRequirements)
+	if region != "" {
+		regional := *cfg
+		regional.S3.Region = region
+		cfg = &regional
+		tags[regionTag] = region
+	}
+	client, err := bucketClient(c.newBucketClient, cfg, in.Secrets)
+	if err != nil {
+		return &csi.CreateVolumeResponse{}, err
+	}
+	tags[volumeNameTag] = in.Name
+	if capacity > 0 {
+		tags[capacityTag] = strconv.FormatInt(capacity, 10)
+	}
+	// the source is checked before creating the bucket, so that no bucket is left behind if it is invalid
+	var source *contentSource
+	if src := in.VolumeContentSource; src != nil {
+		if source, err = volumeContentSource(ctx, client, cfg, src, capacity); err != nil {
+			return &csi.CreateVolumeResponse{}, err
+		}
+		tags[contentSourceTag] = source.id
+	}
+	// whether the bucket exists is checked before creating it, as S3 does not fail creating a bucket that the caller
+	// already owns in us-east-1
+	copied := false
+	current, err := client.Tags(ctx, bucketName)
+	switch {
+	case err == nil:
+		// the volume has been created before- check that it is the same volume
+		if err := sameVolume(bucketName, current, tags); err != nil {
+			return &csi.CreateVolumeResponse{}, err
+		}
+		// settings are applied again in case an earlier call failed before applying them
+		if err := client.Configure(ctx, bucketName, settings); err != nil {
+			return &csi.CreateVolumeResponse{}, bucketError(err)
+		}
+		copied = current[contentCopiedTag] == "true"
+	case errors.Is(err, bucket.ErrNotFound):
+		err := client.Create(ctx, bucketName, bucket.CreateOptions{ObjectLock: settings.ObjectLockMode != ""})
+		if errors.Is(err, bucket.ErrAlreadyOwned) {
+			return &csi.CreateVolumeResponse{}, status.Errorf(codes.Aborted, "bucket %s was created concurrently", bucketName)
+		}
+		if err != nil {
+			return &csi.CreateVolumeResponse{}, rpcError(codes.Internal, err)
+		}
+		if err := setUpBucket(ctx, client, bucketName, tags, settings); err != nil {
+			return &csi.CreateVolumeResponse{}, err
+		}
+		klog.FromContext(ctx).Info("Created bucket", "bucket", bucketName)
+	default:
+		return &csi.CreateVolumeResponse{}, bucketError(err)
+	}
+
+	// a copy that was interrupted, i.e by a restart of the controller, is resumed when the provisioner retries
+	if source != nil && !copied {
+		size, err := copyObjects(ctx, client, cfg, source.bucket, source.prefix, bucketName, "")
+		if err != nil {
+			return &csi.CreateVolumeResponse{}, bucketError(err)
+		}
+		if err := client.SetTags(ctx, bucketName, map[string]string{contentCopiedTag: "true"}); err != nil {
+			return &csi.CreateVolumeResponse{}, bucketError(err)
+		}
+		klog.FromContext(ctx).Info("Copied volume content", "contentSource", source.id, "bucket", bucketName, "sizeBytes", size)
+	}
+	vol := &csi.Volume{
+		VolumeId:      bucketName,
+		CapacityBytes: capacity,
+		VolumeContext: params.context,
+		ContentSource: in.VolumeContentSource,
+	}
+	// the volume is only constrained if the CO asked for a region, as nodes may not report one otherwise
+	if region != "" {
+		vol.AccessibleTopology = regionTopology(region)
+	}
+	return &csi.CreateVolumeResponse{Volume: vol}, nil
+}
+
+// sameVolume checks that a bucket's current tags were set for a volume with the requested tags.
+// Buckets without the volume name tag were not created by the driver, or not completely, and are never used for a volume
+func sameVolume(bucketName string, current, tags map[string]string) error {
+	name := tags[volumeNameTag]
+	if current[volumeNameTag] == "" {
+		return status.Errorf(codes.AlreadyExists, "bucket %s already exists and was not created by the driver. If a controller stopped before tagging it, delete the bucket to create volume %s", bucketName, name)
+	}
+	if current[volumeNameTag] != name {
+		return status.Errorf(codes.AlreadyExists, "bucket %s already exists and was not created for volume %s", bucketName, name)
+	}
+	if current[capacityTag] != tags[capacityTag] {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists with a different capacity", name)
+	}
+	if current[contentSourceTag] != tags[contentSourceTag] {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists with a different content source", name)
+	}
+	if current[regionTag] != tags[regionTag] {
+		return status.Errorf(codes.AlreadyExists, "volume %s already exists in a different region", name)
+	}
+	return nil
+}
+
+// setUpBucket tags and configures a bucket that was just created. If that fails, the bucket is deleted unless it
+// has objects, so that no bucket is left without the requested settings
+func setUpBucket(ctx context.Context, client bucket.Client, name string, tags map[string]string, settings bucket.Settings) error {
+	err := client.SetTags(ctx, name, tags)
+	if err == nil {
+		if err = client.Configure(ctx, name, settings); err == nil {
+			return nil
+		}
+	}
+	// the bucket is deleted even if the request was cancelled. It is only deleted while it has no objects, in case it
+	// was created by someone else between checking that it did not exist and creating it
+	deleteCtx, cancel := context.WithTimeout(context.Background(), rollbackTimeout)
+	defer cancel()
+	empty, emptyErr := client.Empty(deleteCtx, name)
+	switch {
+	case emptyErr != nil:
+		klog.FromContext(ctx).Error(emptyErr, "Failed checking that bucket is empty after failing to set it up", "bucket", name)
+	case !empty:
+		klog.FromContext(ctx).Info("Not deleting bucket with objects after failing to set it up", "bucket", name)
+	default:
+		if deleteErr := client.Delete(deleteCtx, name); deleteErr != nil && !errors.Is(deleteErr, bucket.ErrNotFound) {
+			klog.FromContext(ctx).Error(deleteErr, "Failed deleting bucket after failing to set it up", "bucket", name)
+		}
+	}
+	return bucketError(err)
+}
+
+// contentSource is where the initial objects of a volume are copied from
+type contentSource struct {
+	bucket string
+	prefix string
+	// id is recorded in the volume's contentSourceTag
+	id string
+}
+
+// volumeContentSource returns the objects that src refers to, checking that they exist.
+// A source volume or snapshot must not be larger than capacity, unless capacity is not set
+func volumeContentSource(ctx context.Context, client bucket.Client, cfg *config.Config, src *csi.VolumeContentSource, capacity int64) (*contentSource, error) {
+	switch {
+	case src.GetSnapshot() != nil:
+		if cfg.Snapshots.Bucket == "" {
+			return nil, status.Error(codes.InvalidArgument, "snapshots are disabled as snapshots.bucket is not set")
+		}
+		id := src.GetSnapshot().SnapshotId
+		if err := validateSnapshotID("source snapshot id", id); err != nil {
+			return nil, err
+		}
+		info, err := getSnapshotInfo(ctx, client, cfg.Snapshots.Bucket, id)
+		if err != nil {
+			return nil, snapshotError(err, id)
+		}
+		if capacity > 0 && info.SizeBytes > capacity {
+			return nil, status.Errorf(codes.OutOfRange, "source snapshot %s has size %d, larger than the requested %d", id, info.SizeBytes, capacity)
+		}
+		return &contentSource{bucket: cfg.Snapshots.Bucket, prefix: snapshotDataPrefix(id), id: "snapshot:" + id}, nil
+	case src.GetVolume() != nil:
+		id := src.GetVolume().VolumeId
+		if id == "" {
+			return nil, status.Error(codes.InvalidArgument, "source volume id must be set")
+		}
+		if id == cfg.Snapshots.Bucket {
+			return nil, status.Error(codes.InvalidArgument, "the snapshots bucket cannot be cloned")
+		}
+		tags, err := client.Tags(ctx, id)
+		if err != nil {
+			return nil, bucketError(err)
+		}
+		if source, err := strconv.ParseInt(tags[capacityTag], 10, 64); err == nil && capacity > 0 && source > capacity {
+			return nil, status.Errorf(codes.OutOfRange, "source volume %s has capacity %d, larger than the requested %d", id, source, capacity)
+		}
+		return &contentSource{bucket: id, id: "volume:" + id}, nil
+	default:
+		return nil, status.Error(codes.InvalidArgument, "volume content source must be a snapshot or a volume")
+	}
+}
+
+// copyObjects copies objects server-side with the configured parallelism, logging the progress of long copies
+func copyObjects(ctx context.Context, client bucket.Client, cfg *config.Config, src, srcPrefix, dst, dstPrefix string) (int64, error) {
+	logger := klog.FromContext(ctx).WithValues("source", src+"/"+srcPrefix, "destination", dst+"/"+dstPrefix)
+	logged := time.Now()
+	return client.CopyObjects(ctx, src, srcPrefix, dst, dstPrefix, bucket.CopyOptions{
+		Parallelism: cfg.Copy.Parallelism,
+		PartSize:    int64(cfg.Copy.PartSizeMB) << 20,
+		Progress: func(p bucket.CopyProgress) {
+			if time.Since(logged) < copyProgressInterval {
+				return
+			}
+			logged = time.Now()
+			logger.Info("Copying objects", "objects", p.Objects, "bytes", p.Bytes)
+		},
+	})
+}
+
+// DeleteVolume deletes the volume's bucket and everything in it. Buckets that were not created by CreateVolume are not deleted
+func (c *controllerServer) DeleteVolume(ctx context.Context, in *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	if in.VolumeId == "" {
+		return &csi.DeleteVolumeResponse{}, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	if !c.locks.TryAcquire(in.VolumeId) {
+		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.Aborted, "an operation for volume %s is already in progress", in.VolumeId)
+	}
+	defer c.locks.Release(in.VolumeId)
+
+	client, err := bucketClient(c.newBucketClient, c.cfg.Load(), in.Secrets)
+	if err != nil {
+		return &csi.DeleteVolumeResponse{}, err
+	}
+	bucketName := in.VolumeId
+	tags, err := client.Tags(ctx, bucketName)
+	// the volume has already been deleted
+	if errors.Is(err, bucket.ErrNotFound) {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err != nil {
+		return &csi.DeleteVolumeResponse{}, rpcError(codes.Internal, err)
+	}
+	if _, ok := tags[volumeNameTag]; !ok {
+		return &csi.DeleteVolumeResponse{}, status.Errorf(codes.FailedPrecondition, "bucket %s was not created by the driver and has to be deleted manually", bucketName)
+	}
+	if err := client.Delete(ctx, bucketName); err != nil && !errors.Is(err, bucket.ErrNotFound) {
+		return &csi.DeleteVolumeResponse{}, rpcError(codes.Internal, err)
+	}
+	klog.FromContext(ctx).Info("Deleted bucket", "bucket", bucketName)
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerExpandVolume records the new capacity of the volume on its bucket. Buckets are not size limited,
+// so nothing is resized- the capacity can be enforced as a soft quota by the Node service
+func (c *controllerServer) ControllerExpandVolume(ctx context.Context, in *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if in.VolumeId == "" {
+		return &csi.ControllerExpandVolumeResponse{}, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	capacity, err := requestedCapacity(in.CapacityRange)
+	if err != nil {
+		return &csi.ControllerExpandVolumeResponse{}, err
+	}
+	if !c.locks.TryAcquire(in.VolumeId) {
+		return &csi.ControllerExpandVolumeResponse{}, status.Errorf(codes.Aborted, "an operation for volume %s is already in progress", in.VolumeId)
+	}
+	defer c.locks.Release(in.VolumeId)
+
+	cfg := c.cfg.Load()
+	client, err := bucketClient(c.newBucketClient, cfg, in.Secrets)
+	if err != nil {
+		return &csi.ControllerExpandVolumeResponse{}, err
+	}
+	bucketName := in.VolumeId
+	tags, err := client.Tags(ctx, bucketName)
+	if err != nil {
+		return &csi.ControllerExpandVolumeResponse{}, bucketError(err)
+	}
+	// volumes are never shrunk, so a retried or outdated request succeeds with the current capacity
+	if current, err := strconv.ParseInt(tags[capacityTag], 10, 64); err == nil && current >= capacity {
+		return &csi.ControllerExpandVolumeResponse{CapacityBytes: current}, nil
+	}
+	if err := client.SetTags(ctx, bucketName, map[string]string{capacityTag: strconv.FormatInt(capacity, 10)}); err != nil {
+		return &csi.ControllerExpandVolumeResponse{}, bucketError(err)
+	}
+	klog.FromContext(ctx).Info("Recorded volume capacity", "capacityBytes", capacity)
+	return &csi.ControllerExpandVolumeResponse{CapacityBytes: capacity, NodeExpansionRequired: false}, nil
+}
+
+// ValidateVolumeCapabilities confirms the capabilities if the volume's bucket exists and they are all mounts
+func (c *controllerServer) ValidateVolumeCapabilities(ctx context.Context, in *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if in.VolumeId == "" {
+		return &csi.ValidateVolumeCapabilitiesResponse{}, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	if len(in.VolumeCapabilities) == 0 {
+		return &csi.ValidateVolumeCapabilitiesResponse{}, status.Error(codes.InvalidArgument, "volume capabilities must be set")
+	}
+	client, err := bucketClient(c.newBucketClient, c.cfg.Load(), in.Secrets)
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{}, err
+	}
+	exists, err := client.Exists(ctx, in.VolumeId)
+	if err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{}, rpcError(codes.Internal, err)
+	}
+	if !exists {
+		return &csi.ValidateVolumeCapabilitiesResponse{}, status.Errorf(codes.NotFound, "bucket %s not found", in.VolumeId)
+	}
+	if err := validateCapabilities(in.VolumeCapabilities); err != nil {
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: status.Convert(err).Message()}, nil
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+		VolumeContext:      in.VolumeContext,
+		VolumeCapabilities: in.VolumeCapabilities,
+		Parameters:         in.Parameters,
+	}}, nil
+}
+
+// ControllerGetCapabilities returns info about which *optional* controller capabilities this driver implements
+func (c *controllerServer) ControllerGetCapabilities(ctx context.Context, in *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	capabilities := []*csi.ControllerServiceCapability{
+		controllerCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+		controllerCapability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME),
+		controllerCapability(csi.ControllerServiceCapability_RPC_CLONE_VOLUME),
+	}
+	if c.cfg.Load().Snapshots.Bucket != "" {
+		capabilities = append(capabilities,
+			controllerCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT),
+			controllerCapability(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS),
+		)
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: capabilities}, nil
+}
+
+func controllerCapability(t csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{Type: &csi.ControllerServiceCapability_Rpc{Rpc: &csi.ControllerServiceCapability_RPC{Type: t}}}
+}
+
+// validateCapabilities checks that capabilities are set and are all mounts
+func validateCapabilities(capabilities []*csi.VolumeCapability) error {
+	if len(capabilities) == 0 {
+		return status.Error(codes.InvalidArgument, "volume capabilities must be set")
+	}
+	for _, vc := range capabilities {
+		if vc.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "block volumes are not supported")
+		}
+		if vc.GetMount() == nil {
+			return status.Error(codes.InvalidArgument, "volume capability access type must be set")
+		}
+	}
+	return nil
+}
+
+// volumeBucketName returns the name of the bucket that CreateVolume creates for a volume.
+// Names that are valid bucket names, such as pvc-<uid> of Kubernetes, are used as they are. Others are lowercased,
+// stripped of invalid characters, truncated and suffixed with a hash of the name so that they stay unique
+func volumeBucketName(name string) string {
+	if validBucketName.MatchString(name) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := hex.EncodeToString(sum[:8])
+	b := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '-' {
+			return r
+		}
+		return -1
+	}, strings.ToLower(name))
+	if max := 63 - len(suffix) - 1; len(b) > max {
+		b = b[:max]
+	}
+	b = strings.Trim(b, "-")
+	if b == "" {
+		b = "csi-s3"
+	}
+	return b + "-" + suffix
+}
+
+// requestedCapacity returns the capacity to record for r: the required bytes if set, otherwise the limit
+func requestedCapacity(r *csi.CapacityRange) (int64, error) {
+	if r == nil {
+		return 0, status.Error(codes.InvalidArgument, "capacity range must be set")
+	}
+	if r.RequiredBytes < 0 || r.LimitBytes < 0 {
+		return 0, status.Error(codes.InvalidArgument, "capacity must not be negative")
+	}
+	if r.LimitBytes > 0 && r.RequiredBytes > r.LimitBytes {
+		return 0, status.Errorf(codes.OutOfRange, "required bytes %d exceed limit bytes %d", r.RequiredBytes, r.LimitBytes)
+	}
+	if r.RequiredBytes > 0 {
+		return r.RequiredBytes, nil
+	}
+	if r.LimitBytes > 0 {
+		return r.LimitBytes, nil
+	}
+	return 0, status.Error(codes.InvalidArgument, "one of required bytes, limit bytes must be set")
+}
+
+// bucketClient returns a client for the configured S3 API that authenticates with credentials from secrets or the configured providers
+func bucketClient(newClient func(bucket.Options) (bucket.Client, error), cfg *config.Config, secrets map[string]string) (bucket.Client, error) {
+	key, secret, ok := awsCreds(cfg.Credentials.Providers, secrets)
+	if !ok {
+		return nil, status.Error(codes.InvalidArgument, "iaas creds not provided")
+	}
+	return newBucketClient(newClient, cfg, key, secret, "")
+}
+
+// newBucketClient returns a client for the configured S3 API that authenticates with key and secret.
+// userAgent is appended to the user agent of its requests if not empty
+func newBucketClient(newClient func(bucket.Options) (bucket.Client, error), cfg *config.Config, key, secret, userAgent string) (bucket.Client, error) {
+	client, err := newClient(bucket.Options{
+		Endpoint:  cfg.S3.Endpoint,
+		Region:    cfg.S3.Region,
+		PathStyle: cfg.S3.PathStyle,
+		AccessKey: key,
+		SecretKey: secret,
+		UserAgent: userAgent,
+	})
+	if err != nil {
+		return nil, rpcError(codes.Internal, err)
+	}
+	return client, nil
+}
+
+// bucketError converts an error from a bucket client into a gRPC status error
+func bucketError(err error) error {
+	if errors.Is(err, bucket.ErrNotFound) {
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return rpcError(codes.Internal, err)
+}
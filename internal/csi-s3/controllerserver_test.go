@@ -0,0 +1,672 @@
+package csis3
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/mock/gomock"
+	"github.com/irbekrm/csi-s3/internal/bucket"
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/lock"
+	"github.com/irbekrm/csi-s3/mocks"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var someSecrets = map[string]string{"AWS_ACCESS_KEY_ID": "some key", "AWS_SECRET_ACCESS_KEY": "some secret"}
+
+// bucketClientFor returns a bucket client constructor that returns c if called with the credentials in someSecrets
+func bucketClientFor(t *testing.T, c bucket.Client) func(bucket.Options) (bucket.Client, error) {
+	return func(o bucket.Options) (bucket.Client, error) {
+		if o.AccessKey != "some key" || o.SecretKey != "some secret" {
+			t.Errorf("bucket client created with unexpected credentials %q, %q", o.AccessKey, o.SecretKey)
+		}
+		return c, nil
+	}
+}
+
+func Test_controllerServer_ControllerExpandVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      *csi.ControllerExpandVolumeRequest
+		setup   func(*mocks.MockClient)
+		want    *csi.ControllerExpandVolumeResponse
+		RPCCode codes.Code
+	}{
+		{
+			name:    "fails without volume id",
+			in:      &csi.ControllerExpandVolumeRequest{CapacityRange: &csi.CapacityRange{RequiredBytes: 10}, Secrets: someSecrets},
+			want:    &csi.ControllerExpandVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name:    "fails without capacity range",
+			in:      &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", Secrets: someSecrets},
+			want:    &csi.ControllerExpandVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name:    "fails if required bytes exceed the limit",
+			in:      &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{RequiredBytes: 10, LimitBytes: 5}, Secrets: someSecrets},
+			want:    &csi.ControllerExpandVolumeResponse{},
+			RPCCode: codes.OutOfRange,
+		},
+		{
+			name:    "fails without credentials",
+			in:      &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{RequiredBytes: 10}},
+			want:    &csi.ControllerExpandVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name: "fails if the bucket does not exist",
+			in:   &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{RequiredBytes: 10}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Tags(gomock.Any(), "some bucket").
+					Return(nil, fmt.Errorf("failed getting tags of bucket some bucket: %w", bucket.ErrNotFound))
+			},
+			want:    &csi.ControllerExpandVolumeResponse{},
+			RPCCode: codes.NotFound,
+		},
+		{
+			name: "fails recording the capacity",
+			in:   &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{RequiredBytes: 10}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Tags(gomock.Any(), "some bucket").
+					Return(map[string]string{}, nil)
+				c.
+					EXPECT().
+					SetTags(gomock.Any(), "some bucket", map[string]string{capacityTag: "10"}).
+					Return(errors.New("some error"))
+			},
+			want:    &csi.ControllerExpandVolumeResponse{},
+			RPCCode: codes.Internal,
+		},
+		{
+			name: "records the required bytes",
+			in:   &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{RequiredBytes: 10, LimitBytes: 20}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Tags(gomock.Any(), "some bucket").
+					Return(map[string]string{capacityTag: "5"}, nil)
+				c.
+					EXPECT().
+					SetTags(gomock.Any(), "some bucket", map[string]string{capacityTag: "10"}).
+					Return(nil)
+			},
+			want:    &csi.ControllerExpandVolumeResponse{CapacityBytes: 10},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "records the limit if no bytes are required",
+			in:   &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{LimitBytes: 20}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Tags(gomock.Any(), "some bucket").
+					Return(map[string]string{}, nil)
+				c.
+					EXPECT().
+					SetTags(gomock.Any(), "some bucket", map[string]string{capacityTag: "20"}).
+					Return(nil)
+			},
+			want:    &csi.ControllerExpandVolumeResponse{CapacityBytes: 20},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "does not shrink the volume",
+			in:   &csi.ControllerExpandVolumeRequest{VolumeId: "some bucket", CapacityRange: &csi.CapacityRange{RequiredBytes: 10}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Tags(gomock.Any(), "some bucket").
+					Return(map[string]string{capacityTag: "15"}, nil)
+			},
+			want:    &csi.ControllerExpandVolumeResponse{CapacityBytes: 15},
+			RPCCode: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := mocks.NewMockClient(ctrl)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			c := &controllerServer{locks: lock.NewKeyed(), cfg: config.NewHolder(config.Default()), newBucketClient: bucketClientFor(t, client)}
+
+			got, err := c.ControllerExpandVolume(context.TODO(), tt.in)
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Fatalf("controllerServer.ControllerExpandVolume() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("controllerServer.ControllerExpandVolume() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_controllerServer_ValidateVolumeCapabilities(t *testing.T) {
+	tests := []struct {
+		name          string
+		in            *csi.ValidateVolumeCapabilitiesRequest
+		setup         func(*mocks.MockClient)
+		wantConfirmed bool
+		RPCCode       codes.Code
+	}{
+		{
+			name:    "fails without capabilities",
+			in:      &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "some bucket", Secrets: someSecrets},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name: "fails if the bucket does not exist",
+			in:   &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "some bucket", VolumeCapabilities: []*csi.VolumeCapability{mountCapability}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Exists(gomock.Any(), "some bucket").
+					Return(false, nil)
+			},
+			RPCCode: codes.NotFound,
+		},
+		{
+			name: "does not confirm block volumes",
+			in: &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "some bucket", Secrets: someSecrets, VolumeCapabilities: []*csi.VolumeCapability{
+				{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+			}},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Exists(gomock.Any(), "some bucket").
+					Return(true, nil)
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "confirms mounts",
+			in:   &csi.ValidateVolumeCapabilitiesRequest{VolumeId: "some bucket", VolumeCapabilities: []*csi.VolumeCapability{mountCapability}, Secrets: someSecrets},
+			setup: func(c *mocks.MockClient) {
+				c.
+					EXPECT().
+					Exists(gomock.Any(), "some bucket").
+					Return(true, nil)
+			},
+			wantConfirmed: true,
+			RPCCode:       codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := mocks.NewMockClient(ctrl)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			c := &controllerServer{locks: lock.NewKeyed(), cfg: config.NewHolder(config.Default()), newBucketClient: bucketClientFor(t, client)}
+
+			got, err := c.ValidateVolumeCapabilities(context.TODO(), tt.in)
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Fatalf("controllerServer.ValidateVolumeCapabilities() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+			if confirmed := got.GetConfirmed() != nil; confirmed != tt.wantConfirmed {
+				t.Errorf("controllerServer.ValidateVolumeCapabilities() confirmed = %v, want %v", confirmed, tt.wantConfirmed)
+			}
+		})
+	}
+}
+
+func Test_controllerServer_CreateVolume(t *testing.T) {
+	in := &csi.CreateVolumeRequest{
+		Name:               "pvc-some-uid",
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 10},
+		VolumeCapabilities: []*csi.VolumeCapability{mountCapability},
+		Secrets:            someSecrets,
+	}
+	clone := &csi.CreateVolumeRequest{
+		Name:                "pvc-some-uid",
+		CapacityRange:       &csi.CapacityRange{RequiredBytes: 10},
+		VolumeCapabilities:  []*csi.VolumeCapability{mountCapability},
+		Secrets:             someSecrets,
+		VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "pvc-source-uid"}}},
+	}
+	tests := []struct {
+		name    string
+		in      *csi.CreateVolumeRequest
+		setup   func(*mocks.MockClient)
+		want    *csi.CreateVolumeResponse
+		RPCCode codes.Code
+	}{
+		{
+			name:    "fails for a block volume",
+			in:      &csi.CreateVolumeRequest{Name: "pvc-some-uid", Secrets: someSecrets, VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}}},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name: "creates and tags the bucket",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{}).Return(nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10"}).Return(nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-some-uid", CapacityBytes: 10}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "succeeds if the volume already exists",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10"}, nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-some-uid", CapacityBytes: 10}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "creates the bucket in the region of the preferred topology",
+			in: &csi.CreateVolumeRequest{
+				Name:               "pvc-some-uid",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability},
+				Secrets:            someSecrets,
+				AccessibilityRequirements: &csi.TopologyRequirement{
+					Requisite: []*csi.Topology{{Segments: map[string]string{"topology.s3.csi.irbe.dev/region": "eu-west-1"}}, {Segments: map[string]string{"topology.s3.csi.irbe.dev/region": "eu-west-2"}}},
+					Preferred: []*csi.Topology{{Segments: map[string]string{"topology.s3.csi.irbe.dev/region": "eu-west-2"}}},
+				},
+			},
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{}).Return(nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{volumeNameTag: "pvc-some-uid", regionTag: "eu-west-2"}).Return(nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(nil)
+			},
+			want: &csi.CreateVolumeResponse{Volume: &csi.Volume{
+				VolumeId:           "pvc-some-uid",
+				AccessibleTopology: []*csi.Topology{{Segments: map[string]string{"topology.s3.csi.irbe.dev/region": "eu-west-2"}}},
+			}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "fails if the volume already exists in another region",
+			in: &csi.CreateVolumeRequest{
+				Name:                      "pvc-some-uid",
+				VolumeCapabilities:        []*csi.VolumeCapability{mountCapability},
+				Secrets:                   someSecrets,
+				AccessibilityRequirements: &csi.TopologyRequirement{Requisite: []*csi.Topology{{Segments: map[string]string{"topology.s3.csi.irbe.dev/region": "eu-west-1"}}}},
+			},
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-some-uid", regionTag: "eu-west-2"}, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.AlreadyExists,
+		},
+		{
+			name: "configures and tags the bucket from parameters",
+			in: &csi.CreateVolumeRequest{
+				Name:               "pvc-some-uid",
+				VolumeCapabilities: []*csi.VolumeCapability{mountCapability},
+				Secrets:            someSecrets,
+				Parameters: map[string]string{
+					"versioning":                       "true",
+					"objectLockMode":                   "GOVERNANCE",
+					"objectLockDays":                   "7",
+					"tags":                             "team=storage",
+					"csi.storage.k8s.io/pvc/name":      "some-pvc",
+					"csi.storage.k8s.io/pvc/namespace": "some-namespace",
+				},
+			},
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{ObjectLock: true}).Return(nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{volumeNameTag: "pvc-some-uid", "team": "storage", pvcNameTag: "some-pvc", pvcNamespaceTag: "some-namespace"}).Return(nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{Versioning: true, ObjectLockMode: "GOVERNANCE", ObjectLockDays: 7}).Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-some-uid"}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "deletes the bucket if it cannot be configured",
+			in:   &csi.CreateVolumeRequest{Name: "pvc-some-uid", VolumeCapabilities: []*csi.VolumeCapability{mountCapability}, Secrets: someSecrets, Parameters: map[string]string{"encryption": "SSE-KMS"}},
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{}).Return(nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{volumeNameTag: "pvc-some-uid"}).Return(nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{Encryption: bucket.EncryptionKMS}).Return(errors.New("AccessDenied"))
+				c.EXPECT().Empty(gomock.Any(), "pvc-some-uid").Return(true, nil)
+				c.EXPECT().Delete(gomock.Any(), "pvc-some-uid").Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.Internal,
+		},
+		{
+			// the bucket was created by someone else after checking that it did not exist, which Create
+			// does not report in us-east-1
+			name: "does not delete a bucket with objects if it cannot be set up",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{}).Return(nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10"}).Return(errors.New("AccessDenied"))
+				c.EXPECT().Empty(gomock.Any(), "pvc-some-uid").Return(false, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.Internal,
+		},
+		{
+			name: "does not delete an existing volume's bucket if it cannot be configured",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10"}, nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(errors.New("AccessDenied"))
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.Internal,
+		},
+		{
+			name:    "fails for an unknown parameter",
+			in:      &csi.CreateVolumeRequest{Name: "pvc-some-uid", VolumeCapabilities: []*csi.VolumeCapability{mountCapability}, Secrets: someSecrets, Parameters: map[string]string{"versionning": "true"}},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name: "fails if the bucket exists, but was not created for the volume",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-other-uid"}, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.AlreadyExists,
+		},
+		{
+			name: "fails if the bucket exists without tags",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{}, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.AlreadyExists,
+		},
+		{
+			name: "fails if the bucket exists with tags that were not set by the driver",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{"team": "storage"}, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.AlreadyExists,
+		},
+		{
+			name: "fails if the bucket is created concurrently",
+			in:   in,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{}).Return(bucket.ErrAlreadyOwned)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.Aborted,
+		},
+		{
+			name:    "fails if the bucket is the snapshots bucket",
+			in:      &csi.CreateVolumeRequest{Name: "snapshots", VolumeCapabilities: []*csi.VolumeCapability{mountCapability}, Secrets: someSecrets},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.AlreadyExists,
+		},
+		{
+			name: "fails creating from a missing snapshot without creating the bucket",
+			in: &csi.CreateVolumeRequest{
+				Name:                "pvc-some-uid",
+				VolumeCapabilities:  []*csi.VolumeCapability{mountCapability},
+				Secrets:             someSecrets,
+				VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "some-snapshot"}}},
+			},
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().GetObject(gomock.Any(), "snapshots", "some-snapshot/snapshot.json").Return(nil, bucket.ErrObjectNotFound)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.NotFound,
+		},
+		{
+			name: "fails creating from a snapshot larger than the requested capacity",
+			in: &csi.CreateVolumeRequest{
+				Name:                "pvc-some-uid",
+				CapacityRange:       &csi.CapacityRange{RequiredBytes: 10},
+				VolumeCapabilities:  []*csi.VolumeCapability{mountCapability},
+				Secrets:             someSecrets,
+				VolumeContentSource: &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "some-snapshot"}}},
+			},
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().GetObject(gomock.Any(), "snapshots", "some-snapshot/snapshot.json").Return([]byte(`{"sourceVolumeID":"pvc-source-uid","sizeBytes":20}`), nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.OutOfRange,
+		},
+		{
+			name: "clones a volume",
+			in:   clone,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-source-uid").Return(map[string]string{volumeNameTag: "pvc-source-uid", capacityTag: "10"}, nil)
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(nil, bucket.ErrNotFound)
+				c.EXPECT().Create(gomock.Any(), "pvc-some-uid", bucket.CreateOptions{}).Return(nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10", contentSourceTag: "volume:pvc-source-uid"}).Return(nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(nil)
+				c.EXPECT().CopyObjects(gomock.Any(), "pvc-source-uid", "", "pvc-some-uid", "", gomock.Any()).Return(int64(5), nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{contentCopiedTag: "true"}).Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-some-uid", CapacityBytes: 10, ContentSource: clone.VolumeContentSource}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "resumes an interrupted clone",
+			in:   clone,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-source-uid").Return(map[string]string{}, nil)
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10", contentSourceTag: "volume:pvc-source-uid"}, nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(nil)
+				c.EXPECT().CopyObjects(gomock.Any(), "pvc-source-uid", "", "pvc-some-uid", "", gomock.Any()).Return(int64(5), nil)
+				c.EXPECT().SetTags(gomock.Any(), "pvc-some-uid", map[string]string{contentCopiedTag: "true"}).Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-some-uid", CapacityBytes: 10, ContentSource: clone.VolumeContentSource}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "does not copy again once the clone is complete",
+			in:   clone,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-source-uid").Return(map[string]string{}, nil)
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10", contentSourceTag: "volume:pvc-source-uid", contentCopiedTag: "true"}, nil)
+				c.EXPECT().Configure(gomock.Any(), "pvc-some-uid", bucket.Settings{}).Return(nil)
+			},
+			want:    &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "pvc-some-uid", CapacityBytes: 10, ContentSource: clone.VolumeContentSource}},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "fails if the volume exists with a different content source",
+			in:   clone,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-source-uid").Return(map[string]string{}, nil)
+				c.EXPECT().Tags(gomock.Any(), "pvc-some-uid").Return(map[string]string{volumeNameTag: "pvc-some-uid", capacityTag: "10"}, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.AlreadyExists,
+		},
+		{
+			name: "fails cloning a missing volume without creating the bucket",
+			in:   clone,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-source-uid").Return(nil, bucket.ErrNotFound)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.NotFound,
+		},
+		{
+			name: "fails cloning a volume larger than the requested capacity",
+			in:   clone,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "pvc-source-uid").Return(map[string]string{capacityTag: "20"}, nil)
+			},
+			want:    &csi.CreateVolumeResponse{},
+			RPCCode: codes.OutOfRange,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := mocks.NewMockClient(ctrl)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			cfg := config.Default()
+			cfg.Snapshots.Bucket = "snapshots"
+			c := &controllerServer{locks: lock.NewKeyed(), cfg: config.NewHolder(cfg), newBucketClient: bucketClientFor(t, client)}
+
+			got, err := c.CreateVolume(context.TODO(), tt.in)
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Fatalf("controllerServer.CreateVolume() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("controllerServer.CreateVolume() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_controllerServer_DeleteVolume(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(*mocks.MockClient)
+		RPCCode codes.Code
+	}{
+		{
+			name: "deletes a bucket created for the volume",
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some-bucket").Return(map[string]string{volumeNameTag: "some-volume"}, nil)
+				c.EXPECT().Delete(gomock.Any(), "some-bucket").Return(nil)
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "succeeds if the bucket does not exist",
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some-bucket").Return(nil, bucket.ErrNotFound)
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name: "does not delete a bucket that was not created by the driver",
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some-bucket").Return(map[string]string{}, nil)
+			},
+			RPCCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := mocks.NewMockClient(ctrl)
+			tt.setup(client)
+			c := &controllerServer{locks: lock.NewKeyed(), cfg: config.NewHolder(config.Default()), newBucketClient: bucketClientFor(t, client)}
+
+			_, err := c.DeleteVolume(context.TODO(), &csi.DeleteVolumeRequest{VolumeId: "some-bucket", Secrets: someSecrets})
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Errorf("controllerServer.DeleteVolume() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+		})
+	}
+}
+
+func Test_controllerServer_DeleteSnapshot(t *testing.T) {
+	tests := []struct {
+		name       string
+		snapshotID string
+		setup      func(*mocks.MockClient)
+		RPCCode    codes.Code
+	}{
+		{
+			name:       "deletes the snapshot's info and objects",
+			snapshotID: "some-snapshot",
+			setup: func(c *mocks.MockClient) {
+				gomock.InOrder(
+					c.EXPECT().DeleteObjects(gomock.Any(), "snapshots", "some-snapshot/snapshot.json").Return(nil),
+					c.EXPECT().DeleteObjects(gomock.Any(), "snapshots", "some-snapshot/").Return(nil),
+				)
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name:    "fails without snapshot id",
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name:       "fails with a snapshot id of nested directories",
+			snapshotID: "some-snapshot/data",
+			RPCCode:    codes.InvalidArgument,
+		},
+		{
+			name:       "fails with a snapshot id outside the snapshot's directory",
+			snapshotID: "snap/..",
+			RPCCode:    codes.InvalidArgument,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := mocks.NewMockClient(ctrl)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			cfg := config.Default()
+			cfg.Snapshots.Bucket = "snapshots"
+			c := &controllerServer{locks: lock.NewKeyed(), cfg: config.NewHolder(cfg), newBucketClient: bucketClientFor(t, client)}
+
+			_, err := c.DeleteSnapshot(context.TODO(), &csi.DeleteSnapshotRequest{SnapshotId: tt.snapshotID, Secrets: someSecrets})
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Errorf("controllerServer.DeleteSnapshot() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+		})
+	}
+}
+
+func Test_volumeBucketName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "pvc-0a3b5f4e-6c4b-4c4e-9f0e-2b0e4b5e8a1d", want: "pvc-0a3b5f4e-6c4b-4c4e-9f0e-2b0e4b5e8a1d"},
+		{name: "Some_Volume", want: "somevolume-" + hashSuffix("Some_Volume")},
+		{name: "__", want: "csi-s3-" + hashSuffix("__")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := volumeBucketName(tt.name); got != tt.want {
+				t.Errorf("volumeBucketName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	long := volumeBucketName(strings.Repeat("A", 100))
+	if len(long) > 63 || !validBucketName.MatchString(long) {
+		t.Errorf("volumeBucketName() of a long name = %v, want a valid bucket name", long)
+	}
+}
+
+func hashSuffix(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
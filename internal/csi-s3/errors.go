@@ -0,0 +1,22 @@
+package csis3
+
+import (
+	"context"
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// rpcError converts err into a gRPC status error with the given code.
+// Errors caused by the RPC's context being done are returned with DeadlineExceeded or Canceled
+// codes instead, so that the caller knows the operation can be retried
+func rpcError(code codes.Code, err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		code = codes.DeadlineExceeded
+	case errors.Is(err, context.Canceled):
+		code = codes.Canceled
+	}
+	return status.Error(code, err.Error())
+}
@@ -7,8 +7,6 @@ import (
 	"github.com/golang/protobuf/ptypes/wrappers"
 	"github.com/irbekrm/csi-s3/internal/mount"
 	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-	"k8s.io/klog"
 )
 
 const (
@@ -17,18 +15,19 @@ const (
 )
 
 // NewIdentityServer returns a csi.IdentityServer implementation
-func NewIdentityServer(driverVersion string, mounter mount.Mounter) csi.IdentityServer {
-	return &identityServer{driverVersion, mounter}
+// controller must be true if the driver also serves the Controller service
+func NewIdentityServer(driverVersion string, mounter mount.Mounter, controller bool) csi.IdentityServer {
+	return &identityServer{driverVersion, mounter, controller}
 }
 
 type identityServer struct {
 	driverVersion string
 	mounter       mount.Mounter
+	controller    bool
 }
 
 // GetPluginInfo returns information about this CSI plugin
 func (s *identityServer) GetPluginInfo(ctx context.Context, r *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
-	klog.V(4).Infof("IdentityServer.GetPluginInfo called with %+v", r)
 	m := map[string]string{"url": driverRepo}
 	return &csi.GetPluginInfoResponse{
 		Name:          driverName,
@@ -39,16 +38,23 @@ func (s *identityServer) GetPluginInfo(ctx context.Context, r *csi.GetPluginInfo
 
 // GetPluginCapabilities advertizes what non-default plugin capabilities this plugin has
 func (s *identityServer) GetPluginCapabilities(ctx context.Context, r *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
-	klog.V(4).Infof("IdentityServer.GetPluginCapabilities called with %+v", r)
-	return &csi.GetPluginCapabilitiesResponse{}, nil
+	if !s.controller {
+		return &csi.GetPluginCapabilitiesResponse{}, nil
+	}
+	return &csi.GetPluginCapabilitiesResponse{Capabilities: []*csi.PluginCapability{
+		{Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_CONTROLLER_SERVICE}}},
+		// expanding only records the new capacity, so it can be done while the volume is in use
+		{Type: &csi.PluginCapability_VolumeExpansion_{VolumeExpansion: &csi.PluginCapability_VolumeExpansion{Type: csi.PluginCapability_VolumeExpansion_ONLINE}}},
+		// buckets are created in the region that the volume's topology requires
+		{Type: &csi.PluginCapability_Service_{Service: &csi.PluginCapability_Service{Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS}}},
+	}}, nil
 }
 
 // Probe checks whether the plugin is functioning
 func (s *identityServer) Probe(ctx context.Context, r *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	klog.V(4).Infof("IdentityServer.Probe called with %+v", r)
-	ready, err := s.mounter.IsReady()
+	ready, err := s.mounter.IsReady(ctx)
 	if err != nil {
-		err = status.Error(codes.FailedPrecondition, err.Error())
+		err = rpcError(codes.FailedPrecondition, err)
 	}
 	return &csi.ProbeResponse{Ready: &wrappers.BoolValue{Value: ready}}, err
 }
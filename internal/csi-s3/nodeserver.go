@@ -2,19 +2,43 @@ package csis3
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/bucket"
+	"github.com/irbekrm/csi-s3/internal/cache"
+	"github.com/irbekrm/csi-s3/internal/config"
 	"github.com/irbekrm/csi-s3/internal/filesystem"
+	"github.com/irbekrm/csi-s3/internal/lock"
+	"github.com/irbekrm/csi-s3/internal/metrics"
 	"github.com/irbekrm/csi-s3/internal/mount"
-	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/irbekrm/csi-s3/internal/policy"
+	"github.com/irbekrm/csi-s3/internal/tracing"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"k8s.io/klog"
+	"k8s.io/klog/v2"
+)
+
+// Volume context of ephemeral inline volumes
+const (
+	// contextEphemeral is set to true by the kubelet for inline volumes if the CSIDriver has podInfoOnMount
+	contextEphemeral = "csi.storage.k8s.io/ephemeral"
+	// attrBucket is the bucket of an inline volume, whose volume id is generated by the kubelet
+	attrBucket = "bucket"
+	// attrPrefix is the key prefix within the bucket that an inline volume mounts
+	attrPrefix = "prefix"
+	// attrMounter is the mounter that an inline volume expects, the node's mounter if not set
+	attrMounter = "mounter"
 )
 
 // NewNodeServer returns a csi.NodeServer implementation
-func NewNodeServer(mounter mount.Mounter, fs filesystem.FS, nodeId string) csi.NodeServer {
-	return &nodeServer{mounter: mounter, fs: fs, nodeId: nodeId}
+// cfg is read on each RPC, so changes to its reloadable fields apply to subsequent RPCs.
+// Volumes are cached in cc, which is nil if caching is disabled
+func NewNodeServer(mounter mount.Mounter, fs filesystem.FS, nodeId string, metrics *metrics.Metrics, cfg *config.Holder, cc *cache.Cache) csi.NodeServer {
+	return &nodeServer{mounter: mounter, fs: fs, nodeId: nodeId, locks: lock.NewKeyed(), metrics: metrics, cfg: cfg, cache: cc, newBucketClient: bucket.New}
 }
 
 type nodeServer struct {
@@ -22,17 +46,64 @@ type nodeServer struct {
 	mounter mount.Mounter
 	fs      filesystem.FS
 	nodeId  string
+	// locks ensures that only one operation at a time runs for a volume id or target path
+	locks   *lock.Keyed
+	metrics *metrics.Metrics
+	cfg     *config.Holder
+	// creds are the buckets and credentials that volumes were published with, by target path.
+	// NodeGetVolumeStats has no secrets, so these are used to check soft quotas
+	creds credentialsCache
+	// usage holds the usage of buckets with soft quotas, so that they are not listed on every stats poll
+	usage usageCache
+	// cache holds the directories in which volumes are cached, nil if caching is disabled
+	cache           *cache.Cache
+	newBucketClient func(bucket.Options) (bucket.Client, error)
 }
 
 // NodePublishVolume mounts the volume at the specified path (in the container). Safe to be called multiple times
 func (n *nodeServer) NodePublishVolume(ctx context.Context, in *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	klog.V(4).Infof("NodeServer.NodePublishVolume called with %+v", protosanitizer.StripSecrets(in))
+	if err := validatePublish(in); err != nil {
+		return &csi.NodePublishVolumeResponse{}, err
+	}
+	bucket, prefix, err := n.publishSource(in)
+	if err != nil {
+		return &csi.NodePublishVolumeResponse{}, err
+	}
+	pod := podInfoFrom(in.VolumeContext)
+	if pod.known() {
+		ctx = klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx), pod.keysAndValues()...))
+	}
+	policyCfg := n.cfg.Load().Policy
+	if err := allowPublish(policyCfg, bucket, pod); err != nil {
+		return &csi.NodePublishVolumeResponse{}, err
+	}
+	mode := accessMode(in.VolumeCapability)
+	if in.Readonly {
+		mode = policy.ReadOnly
+	}
+	req := policy.Request{Namespace: pod.namespace, ServiceAccount: pod.serviceAccount, Bucket: bucket, Prefix: prefix, AccessMode: mode}
+	if err := authorize(policyCfg.Policy, req); err != nil {
+		return &csi.NodePublishVolumeResponse{}, err
+	}
+	if !n.locks.TryAcquire(in.VolumeId, in.TargetPath) {
+		return &csi.NodePublishVolumeResponse{}, status.Errorf(codes.Aborted, "an operation for volume %s or target path %s is already in progress", in.VolumeId, in.TargetPath)
+	}
+	defer n.locks.Release(in.VolumeId, in.TargetPath)
 	// TODO: first verify that the bucket (volume_id) exists
 	// check if a mount already exists at the targetPath
 	targetPath := in.TargetPath
-	m, err := n.fs.FindMount(targetPath)
+	m, err := n.fs.FindMount(ctx, targetPath)
+	if errors.Is(err, filesystem.ErrStaleMount) {
+		// the mounter process has died- clean up its mount and mount again
+		klog.FromContext(ctx).Info("Found a stale mount at target path, mounting again")
+		if err := n.fs.EnsureMountRemoved(ctx, targetPath); err != nil {
+			return &csi.NodePublishVolumeResponse{}, rpcError(codes.Internal, err)
+		}
+		n.metrics.MounterRestarted(n.mounter.Type())
+		m, err = nil, nil
+	}
 	if err != nil {
-		return &csi.NodePublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+		return &csi.NodePublishVolumeResponse{}, rpcError(codes.Internal, err)
 	}
 
 	// if a mount already exists at targetPath, check that it's the right one
@@ -43,49 +114,245 @@ func (n *nodeServer) NodePublishVolume(ctx context.Context, in *csi.NodePublishV
 		if !ok {
 			return &csi.NodePublishVolumeResponse{}, status.Error(codes.AlreadyExists, "")
 		} else {
-			return &csi.NodePublishVolumeResponse{}, status.Error(codes.OK, "")
+			if key, secret, ok := awsCreds(n.cfg.Load().Credentials.Providers, in.Secrets); ok {
+				n.creds.set(targetPath, publishedVolume{bucket: bucket, key: key, secret: secret, pod: pod})
+			}
+			return &csi.NodePublishVolumeResponse{}, nil
 		}
 	}
 
 	// mount does not yet exist, proceed
-	if err := n.fs.EnsureDirExists(targetPath); err != nil {
-		return &csi.NodePublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	if err := n.fs.EnsureDirExists(ctx, targetPath); err != nil {
+		return &csi.NodePublishVolumeResponse{}, rpcError(codes.Internal, err)
 	}
-	bucket := in.VolumeId
 	// retrieve AWS creds from csi.NodePublishVolumeRequest.Secrets
-	key, secret, ok := awsCreds(in.Secrets)
+	_, span := tracing.Start(ctx, "resolveCredentials")
+	cfg := n.cfg.Load()
+	key, secret, ok := awsCreds(cfg.Credentials.Providers, in.Secrets)
 	if !ok {
-		return nil, status.Error(codes.InvalidArgument, "iaas creds not provided")
+		err := status.Error(codes.InvalidArgument, "iaas creds not provided")
+		tracing.End(span, err)
+		n.metrics.CredentialFailed()
+		return nil, err
+	}
+	tracing.End(span, nil)
+	vol := mount.Volume{
+		Bucket:      bucket,
+		Prefix:      prefix,
+		Endpoint:    cfg.S3.Endpoint,
+		PathStyle:   cfg.S3.PathStyle,
+		AccessKey:   key,
+		SecretKey:   secret,
+		Readonly:    readonly,
+		SSE:         in.VolumeContext[paramSSE],
+		SSEKMSKeyID: in.VolumeContext[paramSSEKMSKeyID],
+	}
+	if vol.SSE == mount.SSEC {
+		vol.SSECustomerKey = in.Secrets[secretSSECustomerKey]
 	}
-	if err := n.mounter.Mount(targetPath, bucket, key, secret, false); err != nil {
-		return &csi.NodePublishVolumeResponse{}, status.Error(codes.Internal, err.Error())
+	cached := n.cache != nil
+	if v, ok := in.VolumeContext[paramCache]; ok && cached {
+		if cached, err = boolParameter(paramCache, v); err != nil {
+			return &csi.NodePublishVolumeResponse{}, err
+		}
+	}
+	if err := n.mounter.Validate(vol); err != nil {
+		return &csi.NodePublishVolumeResponse{}, status.Errorf(codes.InvalidArgument, "%s cannot mount the volume: %v", n.mounter.Type(), err)
+	}
+	if cached {
+		if vol.CacheDir, err = n.cache.Dir(targetPath); err != nil {
+			return &csi.NodePublishVolumeResponse{}, rpcError(codes.Internal, err)
+		}
 	}
-	return &csi.NodePublishVolumeResponse{}, status.Error(codes.OK, "")
+	err = n.mounter.Mount(ctx, targetPath, vol)
+	n.metrics.Mounted(n.mounter.Type(), pod.namespace, err)
+	if err != nil {
+		if cached {
+			if err := n.cache.Remove(targetPath); err != nil {
+				klog.FromContext(ctx).Error(err, "Failed to remove cache directory of a volume that could not be mounted")
+			}
+		}
+		return &csi.NodePublishVolumeResponse{}, rpcError(codes.Internal, err)
+	}
+	n.creds.set(targetPath, publishedVolume{bucket: bucket, key: key, secret: secret, pod: pod})
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// publishSource returns the bucket and prefix to mount. That is the volume id's bucket for persistent volumes
+// and the bucket and prefix from the volume attributes for ephemeral inline volumes. Leading and trailing slashes are
+// trimmed from the prefix, as the mounters do, so that the policy is evaluated for the prefix that is mounted
+func (n *nodeServer) publishSource(in *csi.NodePublishVolumeRequest) (string, string, error) {
+	attrs := in.VolumeContext
+	if attrs[contextEphemeral] != "true" {
+		return in.VolumeId, "", nil
+	}
+	if attrs[attrBucket] == "" {
+		return "", "", status.Errorf(codes.InvalidArgument, "volume attribute %s must be set for inline volumes", attrBucket)
+	}
+	if m := attrs[attrMounter]; m != "" && m != n.cfg.Load().Mounter.Name {
+		return "", "", status.Errorf(codes.InvalidArgument, "volume attribute %s is %s, but this node mounts with %s", attrMounter, m, n.cfg.Load().Mounter.Name)
+	}
+	return attrs[attrBucket], strings.Trim(attrs[attrPrefix], "/"), nil
 }
 
 // NodeUnpublishVolume idempotently unmounts the volume from the given target path
 func (n *nodeServer) NodeUnpublishVolume(ctx context.Context, in *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
-	klog.V(4).Infof("NodeServer.NodeUnpublishVolume called with %+v", protosanitizer.StripSecrets(in))
+	if in.VolumeId == "" {
+		return &csi.NodeUnpublishVolumeResponse{}, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	if in.TargetPath == "" {
+		return &csi.NodeUnpublishVolumeResponse{}, status.Error(codes.InvalidArgument, "target path must be set")
+	}
+	if !n.locks.TryAcquire(in.VolumeId, in.TargetPath) {
+		return &csi.NodeUnpublishVolumeResponse{}, status.Errorf(codes.Aborted, "an operation for volume %s or target path %s is already in progress", in.VolumeId, in.TargetPath)
+	}
+	defer n.locks.Release(in.VolumeId, in.TargetPath)
 	// TODO: first verify that the bucket (volume_id) exists
 	targetPath := in.TargetPath
 	resp := &csi.NodeUnpublishVolumeResponse{}
-	if err := n.fs.EnsureMountRemoved(targetPath); err != nil {
-		return resp, status.Error(codes.Internal, err.Error())
+	// the pod is only known if the volume was published since the driver started
+	v, _ := n.creds.get(targetPath)
+	if v.pod.known() {
+		ctx = klog.NewContext(ctx, klog.LoggerWithValues(klog.FromContext(ctx), v.pod.keysAndValues()...))
+	}
+	err := n.fs.EnsureMountRemoved(ctx, targetPath)
+	n.metrics.Unmounted(n.mounter.Type(), v.pod.namespace, err)
+	if err != nil {
+		return resp, rpcError(codes.Internal, err)
 	}
-	return resp, status.Error(codes.OK, "")
+	// the volume's cached objects must not outlive it on the node
+	if n.cache != nil {
+		if err := n.cache.Remove(targetPath); err != nil {
+			return resp, rpcError(codes.Internal, err)
+		}
+	}
+	n.creds.delete(targetPath)
+	return resp, nil
+}
+
+// NodeGetVolumeStats reports whether the volume's mount is healthy.
+// If soft quotas are enforced, it also reports the bucket's usage and marks the volume abnormal if it exceeds the recorded capacity
+func (n *nodeServer) NodeGetVolumeStats(ctx context.Context, in *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	if in.VolumeId == "" {
+		return &csi.NodeGetVolumeStatsResponse{}, status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	if in.VolumePath == "" {
+		return &csi.NodeGetVolumeStatsResponse{}, status.Error(codes.InvalidArgument, "volume path must be set")
+	}
+	volumePath := in.VolumePath
+	m, err := n.fs.FindMount(ctx, volumePath)
+	if errors.Is(err, filesystem.ErrStaleMount) {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "the mounter process serving the volume has died",
+		}}, nil
+	}
+	if err != nil {
+		return &csi.NodeGetVolumeStatsResponse{}, rpcError(codes.Internal, err)
+	}
+	if m == nil {
+		return &csi.NodeGetVolumeStatsResponse{}, status.Errorf(codes.NotFound, "volume %s is not published at %s", in.VolumeId, volumePath)
+	}
+	cfg := n.cfg.Load()
+	if !cfg.Quota.Enforce {
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{Message: "volume is mounted"}}, nil
+	}
+	return n.quotaStats(ctx, cfg, volumePath)
+}
+
+// quotaStats compares usage of the volume's bucket with the capacity recorded on it
+func (n *nodeServer) quotaStats(ctx context.Context, cfg *config.Config, volumePath string) (*csi.NodeGetVolumeStatsResponse, error) {
+	v, ok := n.creds.get(volumePath)
+	if !ok {
+		// the driver has restarted since the volume was published. The volume id is not taken to be the bucket,
+		// as the ids of inline volumes are generated by the CO
+		return &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{
+			Message: "volume is mounted, quota is not checked as the volume's bucket and credentials are not known since the driver restarted",
+		}}, nil
+	}
+	var userAgent string
+	if cfg.S3.PodUserAgent && v.pod.known() {
+		userAgent = v.pod.userAgent()
+	}
+	client, err := newBucketClient(n.newBucketClient, cfg, v.key, v.secret, userAgent)
+	if err != nil {
+		return &csi.NodeGetVolumeStatsResponse{}, err
+	}
+	bucketName := v.bucket
+	tags, err := client.Tags(ctx, bucketName)
+	if err != nil {
+		return &csi.NodeGetVolumeStatsResponse{}, bucketError(err)
+	}
+	used, ok := n.usage.get(bucketName, cfg.Quota.UsageTTL.Duration)
+	if !ok {
+		if used, err = client.Usage(ctx, bucketName); err != nil {
+			return &csi.NodeGetVolumeStatsResponse{}, bucketError(err)
+		}
+		n.usage.set(bucketName, used, cfg.Quota.UsageTTL.Duration)
+	}
+	usage := &csi.VolumeUsage{Unit: csi.VolumeUsage_BYTES, Used: used}
+	resp := &csi.NodeGetVolumeStatsResponse{
+		Usage:           []*csi.VolumeUsage{usage},
+		VolumeCondition: &csi.VolumeCondition{Message: "volume is mounted"},
+	}
+	capacity, err := strconv.ParseInt(tags[capacityTag], 10, 64)
+	if err != nil {
+		// no capacity has been recorded, so there is no quota
+		return resp, nil
+	}
+	usage.Total = capacity
+	if used > capacity {
+		resp.VolumeCondition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  fmt.Sprintf("bucket uses %d bytes, which exceeds the volume's capacity of %d bytes", used, capacity),
+		}
+		return resp, nil
+	}
+	usage.Available = capacity - used
+	return resp, nil
 }
 
 // NodeGetInfo returns node info that this driver is aware of
 func (n *nodeServer) NodeGetInfo(ctx context.Context, in *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	klog.V(4).Infof("NodeServer.NodeGetInfo called with %+v", in)
 	if n.nodeId == "" {
 		return &csi.NodeGetInfoResponse{}, status.Error(codes.Internal, "node id not found")
 	}
-	return &csi.NodeGetInfoResponse{NodeId: n.nodeId}, status.Error(codes.OK, "")
+	cfg := n.cfg.Load()
+	resp := &csi.NodeGetInfoResponse{
+		NodeId:            n.nodeId,
+		MaxVolumesPerNode: cfg.Limits.MaxVolumesPerNode,
+	}
+	if len(cfg.Topology) > 0 {
+		resp.AccessibleTopology = &csi.Topology{Segments: cfg.Topology}
+	}
+	return resp, nil
 }
 
 // NodeGetCapabilities returns info about which *optional* node capabilities this driver implements
 func (n *nodeServer) NodeGetCapabilities(ctx context.Context, in *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
-	klog.V(4).Infof("NodeServer.NodeGetCapabilities called with %+v", in)
-	return &csi.NodeGetCapabilitiesResponse{}, status.Error(codes.OK, "")
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: []*csi.NodeServiceCapability{
+		nodeCapability(csi.NodeServiceCapability_RPC_GET_VOLUME_STATS),
+		nodeCapability(csi.NodeServiceCapability_RPC_VOLUME_CONDITION),
+	}}, nil
+}
+
+func nodeCapability(t csi.NodeServiceCapability_RPC_Type) *csi.NodeServiceCapability {
+	return &csi.NodeServiceCapability{Type: &csi.NodeServiceCapability_Rpc{Rpc: &csi.NodeServiceCapability_RPC{Type: t}}}
+}
+
+// validatePublish checks that a NodePublishVolume request has the fields required by the CSI spec
+func validatePublish(in *csi.NodePublishVolumeRequest) error {
+	if in.VolumeId == "" {
+		return status.Error(codes.InvalidArgument, "volume id must be set")
+	}
+	if in.TargetPath == "" {
+		return status.Error(codes.InvalidArgument, "target path must be set")
+	}
+	if in.VolumeCapability == nil {
+		return status.Error(codes.InvalidArgument, "volume capability must be set")
+	}
+	if in.VolumeCapability.GetBlock() != nil {
+		return status.Error(codes.InvalidArgument, "block volumes are not supported")
+	}
+	return nil
 }
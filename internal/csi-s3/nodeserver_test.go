@@ -3,13 +3,22 @@ package csis3
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/mock/gomock"
+	"github.com/irbekrm/csi-s3/internal/cache"
+	"github.com/irbekrm/csi-s3/internal/config"
 	"github.com/irbekrm/csi-s3/internal/filesystem"
+	"github.com/irbekrm/csi-s3/internal/lock"
+	"github.com/irbekrm/csi-s3/internal/metrics"
 	"github.com/irbekrm/csi-s3/internal/mount"
+	"github.com/irbekrm/csi-s3/internal/policy"
 	"github.com/irbekrm/csi-s3/mocks"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
@@ -26,14 +35,48 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 		RPCCode     codes.Code
 		wantErr     bool
 	}{
+		{
+			name:    "fails without volume id",
+			in:      &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeCapability: mountCapability},
+			setup:   func(*gomock.Controller, string, bool) (mount.Mounter, filesystem.FS) { return nil, nil },
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
+		{
+			name:    "fails without target path",
+			in:      &csi.NodePublishVolumeRequest{VolumeId: "some bucket", VolumeCapability: mountCapability},
+			setup:   func(*gomock.Controller, string, bool) (mount.Mounter, filesystem.FS) { return nil, nil },
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
+		{
+			name:    "fails without volume capability",
+			in:      &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path"},
+			setup:   func(*gomock.Controller, string, bool) (mount.Mounter, filesystem.FS) { return nil, nil },
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
+		{
+			name: "fails for a block volume",
+			in: &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			}},
+			setup:   func(*gomock.Controller, string, bool) (mount.Mounter, filesystem.FS) { return nil, nil },
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
 		{
 			name: "fails looking for mount at targetpath",
-			in:   &csi.NodePublishVolumeRequest{TargetPath: "some path"},
+			in:   &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability},
 			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
 				fs := mocks.NewMockFS(ctrl)
 				fs.
 					EXPECT().
-					FindMount("some path").
+					FindMount(gomock.Any(), "some path").
 					Return(nil, errors.New("some error"))
 				return nil, fs
 			},
@@ -41,9 +84,24 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 			RPCCode: codes.Internal,
 			wantErr: true,
 		},
+		{
+			name: "times out looking for mount at targetpath",
+			in:   &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability},
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, context.DeadlineExceeded)
+				return nil, fs
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.DeadlineExceeded,
+			wantErr: true,
+		},
 		{
 			name:        "finds a non-matching mount at target path",
-			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path"},
+			in:          &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability},
 			mounterType: "some type",
 			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
 				matcher := mocks.NewMockMatcher(ctrl)
@@ -59,7 +117,7 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 				fs := mocks.NewMockFS(ctrl)
 				fs.
 					EXPECT().
-					FindMount("some path").
+					FindMount(gomock.Any(), "some path").
 					Return(matcher, nil)
 				return mounter, fs
 			},
@@ -69,7 +127,7 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 		},
 		{
 			name:        "nothing to do, finds a matching mount at target path",
-			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path"},
+			in:          &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability},
 			mounterType: "some type",
 			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
 				matcher := mocks.NewMockMatcher(ctrl)
@@ -85,7 +143,7 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 				fs := mocks.NewMockFS(ctrl)
 				fs.
 					EXPECT().
-					FindMount("some path").
+					FindMount(gomock.Any(), "some path").
 					Return(matcher, nil)
 				return mounter, fs
 			},
@@ -94,17 +152,17 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 		},
 		{
 			name:        "fails to create directory at target path",
-			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path"},
+			in:          &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability},
 			mounterType: "some type",
 			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
 				fs := mocks.NewMockFS(ctrl)
 				fs.
 					EXPECT().
-					FindMount("some path").
+					FindMount(gomock.Any(), "some path").
 					Return(nil, nil)
 				fs.
 					EXPECT().
-					EnsureDirExists("some path").
+					EnsureDirExists(gomock.Any(), "some path").
 					Return(errors.New("some error"))
 				return nil, fs
 			},
@@ -112,6 +170,180 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 			RPCCode: codes.Internal,
 			wantErr: true,
 		},
+		{
+			name:        "finds a stale mount at target path, fails to remove it",
+			in:          &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, filesystem.ErrStaleMount)
+				fs.
+					EXPECT().
+					EnsureMountRemoved(gomock.Any(), "some path").
+					Return(errors.New("some error"))
+				return nil, fs
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.Internal,
+			wantErr: true,
+		},
+		{
+			name:        "finds a stale mount at target path, mounts again",
+			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "some bucket", VolumeCapability: mountCapability, Secrets: map[string]string{"AWS_ACCESS_KEY_ID": "some key", "AWS_SECRET_ACCESS_KEY": "some secret"}},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, fmt.Errorf("found a mount at some path: %w", filesystem.ErrStaleMount))
+				fs.
+					EXPECT().
+					EnsureMountRemoved(gomock.Any(), "some path").
+					Return(nil)
+				fs.
+					EXPECT().
+					EnsureDirExists(gomock.Any(), "some path").
+					Return(nil)
+				mounter := mocks.NewMockMounter(ctrl)
+				mounter.
+					EXPECT().
+					Type().
+					Return(mounterType).
+					Times(2)
+				mounter.
+					EXPECT().
+					Validate(mount.Volume{Bucket: "some bucket", AccessKey: "some key", SecretKey: "some secret"}).
+					Return(nil)
+				mounter.
+					EXPECT().
+					Mount(gomock.Any(), "some path", mount.Volume{Bucket: "some bucket", AccessKey: "some key", SecretKey: "some secret"}).
+					Return(nil)
+				return mounter, fs
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.OK,
+		},
+		{
+			name:        "inline volume without a bucket",
+			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "csi-some-hash", VolumeCapability: mountCapability, VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true"}},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				return mocks.NewMockMounter(ctrl), mocks.NewMockFS(ctrl)
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
+		{
+			name:        "inline volume for another mounter",
+			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "csi-some-hash", VolumeCapability: mountCapability, VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true", "bucket": "some bucket", "mounter": "goofys"}},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				return mocks.NewMockMounter(ctrl), mocks.NewMockFS(ctrl)
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
+		{
+			name:        "success, inline volume mounts the bucket and prefix from its attributes",
+			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "csi-some-hash", VolumeCapability: mountCapability, VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true", "bucket": "some bucket", "prefix": "/some/prefix/", "mounter": "s3fs"}, Secrets: map[string]string{"AWS_ACCESS_KEY_ID": "some key", "AWS_SECRET_ACCESS_KEY": "some secret"}},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, nil)
+				fs.
+					EXPECT().
+					EnsureDirExists(gomock.Any(), "some path").
+					Return(nil)
+				mounter := mocks.NewMockMounter(ctrl)
+				mounter.
+					EXPECT().
+					Type().
+					Return(mounterType)
+				vol := mount.Volume{Bucket: "some bucket", Prefix: "some/prefix", AccessKey: "some key", SecretKey: "some secret"}
+				mounter.
+					EXPECT().
+					Validate(vol).
+					Return(nil)
+				mounter.
+					EXPECT().
+					Mount(gomock.Any(), "some path", vol).
+					Return(nil)
+				return mounter, fs
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.OK,
+		},
+		{
+			name:        "mounter cannot do the requested encryption",
+			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "some bucket", VolumeCapability: mountCapability, VolumeContext: map[string]string{"sse": "c"}, Secrets: map[string]string{"AWS_ACCESS_KEY_ID": "some key", "AWS_SECRET_ACCESS_KEY": "some secret", "SSE_CUSTOMER_KEY": "some customer key"}},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, nil)
+				fs.
+					EXPECT().
+					EnsureDirExists(gomock.Any(), "some path").
+					Return(nil)
+				mounter := mocks.NewMockMounter(ctrl)
+				mounter.
+					EXPECT().
+					Type().
+					Return(mounterType)
+				mounter.
+					EXPECT().
+					Validate(mount.Volume{Bucket: "some bucket", AccessKey: "some key", SecretKey: "some secret", SSE: "c", SSECustomerKey: "some customer key"}).
+					Return(errors.New("sse c customer key must be 32 bytes"))
+				return mounter, fs
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.InvalidArgument,
+			wantErr: true,
+		},
+		{
+			name:        "mount is cancelled",
+			in:          &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "some bucket", VolumeCapability: mountCapability, Secrets: map[string]string{"AWS_ACCESS_KEY_ID": "some key", "AWS_SECRET_ACCESS_KEY": "some secret"}},
+			mounterType: "some type",
+			setup: func(ctrl *gomock.Controller, mounterType string, readonly bool) (mount.Mounter, filesystem.FS) {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, nil)
+				fs.
+					EXPECT().
+					EnsureDirExists(gomock.Any(), "some path").
+					Return(nil)
+				mounter := mocks.NewMockMounter(ctrl)
+				mounter.
+					EXPECT().
+					Type().
+					Return(mounterType)
+				mounter.
+					EXPECT().
+					Validate(mount.Volume{Bucket: "some bucket", AccessKey: "some key", SecretKey: "some secret"}).
+					Return(nil)
+				mounter.
+					EXPECT().
+					Mount(gomock.Any(), "some path", mount.Volume{Bucket: "some bucket", AccessKey: "some key", SecretKey: "some secret"}).
+					Return(fmt.Errorf("mounting some bucket at some path did not complete: %w", context.Canceled))
+				return mounter, fs
+			},
+			want:    &csi.NodePublishVolumeResponse{},
+			RPCCode: codes.Canceled,
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -123,6 +355,9 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 			n := &nodeServer{
 				mounter: mnt,
 				fs:      fs,
+				locks:   lock.NewKeyed(),
+				metrics: testMetrics(),
+				cfg:     config.NewHolder(config.Default()),
 			}
 			ctx := context.TODO()
 
@@ -147,14 +382,124 @@ func Test_nodeServer_NodePublishVolume(t *testing.T) {
 	}
 }
 
-func Test_nodeServer_NodeGetInfo(t *testing.T) {
+func Test_nodeServer_NodePublishVolume_policy(t *testing.T) {
+	cfg := config.Default()
+	cfg.Policy.Rules = []policy.Rule{
+		{Name: "no-secrets", Effect: policy.Deny, Prefixes: []string{"secret"}},
+		{Name: "everything-else", Effect: policy.Allow},
+	}
+	tests := []struct {
+		name   string
+		prefix string
+	}{
+		{name: "prefix", prefix: "secret"},
+		{name: "leading slash", prefix: "/secret"},
+		{name: "trailing slash", prefix: "secret/"},
+		{name: "leading and trailing slashes", prefix: "//secret//"},
+		{name: "nested prefix", prefix: "secret/nested"},
+		{name: "nested prefix with slashes", prefix: "/secret/nested/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			n := &nodeServer{
+				mounter: mocks.NewMockMounter(ctrl),
+				fs:      mocks.NewMockFS(ctrl),
+				locks:   lock.NewKeyed(),
+				metrics: testMetrics(),
+				cfg:     config.NewHolder(cfg),
+			}
+			in := &csi.NodePublishVolumeRequest{TargetPath: "some path", VolumeId: "csi-some-hash", VolumeCapability: mountCapability, VolumeContext: map[string]string{"csi.storage.k8s.io/ephemeral": "true", "bucket": "some-bucket", "prefix": tt.prefix}}
+
+			_, err := n.NodePublishVolume(context.TODO(), in)
+			if status.Code(err) != codes.PermissionDenied {
+				t.Errorf("nodeServer.NodePublishVolume() of prefix %q error = %v, want PermissionDenied", tt.prefix, err)
+			}
+		})
+	}
+}
+
+func Test_nodeServer_NodeUnpublishVolume(t *testing.T) {
 	tests := []struct {
 		name    string
-		nodeId  string
-		in      *csi.NodeGetInfoRequest
-		want    *csi.NodeGetInfoResponse
+		in      *csi.NodeUnpublishVolumeRequest
+		setup   func(*gomock.Controller) filesystem.FS
 		RPCCode codes.Code
-		wantErr bool
+	}{
+		{
+			name:    "fails without volume id",
+			in:      &csi.NodeUnpublishVolumeRequest{TargetPath: "some path"},
+			setup:   func(*gomock.Controller) filesystem.FS { return nil },
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name:    "fails without target path",
+			in:      &csi.NodeUnpublishVolumeRequest{VolumeId: "some volume"},
+			setup:   func(*gomock.Controller) filesystem.FS { return nil },
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name: "fails removing the mount",
+			in:   &csi.NodeUnpublishVolumeRequest{VolumeId: "some volume", TargetPath: "some path"},
+			setup: func(ctrl *gomock.Controller) filesystem.FS {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					EnsureMountRemoved(gomock.Any(), "some path").
+					Return(errors.New("some error"))
+				return fs
+			},
+			RPCCode: codes.Internal,
+		},
+		{
+			name: "removes the mount",
+			in:   &csi.NodeUnpublishVolumeRequest{VolumeId: "some volume", TargetPath: "some path"},
+			setup: func(ctrl *gomock.Controller) filesystem.FS {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					EnsureMountRemoved(gomock.Any(), "some path").
+					Return(nil)
+				return fs
+			},
+			RPCCode: codes.OK,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			mounter := mocks.NewMockMounter(ctrl)
+			mounter.
+				EXPECT().
+				Type().
+				Return("some type").
+				AnyTimes()
+			n := &nodeServer{
+				mounter: mounter,
+				fs:      tt.setup(ctrl),
+				locks:   lock.NewKeyed(),
+				metrics: testMetrics(),
+				cfg:     config.NewHolder(config.Default()),
+			}
+			_, err := n.NodeUnpublishVolume(context.TODO(), tt.in)
+			if got := status.Code(err); got != tt.RPCCode {
+				t.Errorf("nodeServer.NodeUnpublishVolume() code = %v, want %v (error: %v)", got, tt.RPCCode, err)
+			}
+		})
+	}
+}
+
+func Test_nodeServer_NodeGetInfo(t *testing.T) {
+	tests := []struct {
+		name     string
+		nodeId   string
+		topology map[string]string
+		in       *csi.NodeGetInfoRequest
+		want     *csi.NodeGetInfoResponse
+		RPCCode  codes.Code
+		wantErr  bool
 	}{
 		{
 			name:    "success",
@@ -162,6 +507,16 @@ func Test_nodeServer_NodeGetInfo(t *testing.T) {
 			want:    &csi.NodeGetInfoResponse{NodeId: "some id"},
 			RPCCode: codes.OK,
 		},
+		{
+			name:     "success, with topology",
+			nodeId:   "some id",
+			topology: map[string]string{"topology.s3.csi.irbe.dev/zone": "some zone"},
+			want: &csi.NodeGetInfoResponse{
+				NodeId:             "some id",
+				AccessibleTopology: &csi.Topology{Segments: map[string]string{"topology.s3.csi.irbe.dev/zone": "some zone"}},
+			},
+			RPCCode: codes.OK,
+		},
 		{
 			name:    "failure, node id not found",
 			want:    &csi.NodeGetInfoResponse{},
@@ -172,8 +527,11 @@ func Test_nodeServer_NodeGetInfo(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			ctx := context.TODO()
+			cfg := config.Default()
+			cfg.Topology = tt.topology
 			n := &nodeServer{
 				nodeId: tt.nodeId,
+				cfg:    config.NewHolder(cfg),
 			}
 			got, err := n.NodeGetInfo(ctx, tt.in)
 			if (err != nil) != tt.wantErr {
@@ -186,3 +544,353 @@ func Test_nodeServer_NodeGetInfo(t *testing.T) {
 		})
 	}
 }
+
+func Test_nodeServer_NodeGetVolumeStats(t *testing.T) {
+	in := &csi.NodeGetVolumeStatsRequest{VolumeId: "some bucket", VolumePath: "some path"}
+	mounted := func(ctrl *gomock.Controller) filesystem.FS {
+		fs := mocks.NewMockFS(ctrl)
+		fs.
+			EXPECT().
+			FindMount(gomock.Any(), "some path").
+			Return(mocks.NewMockMatcher(ctrl), nil)
+		return fs
+	}
+	tests := []struct {
+		name string
+		in   *csi.NodeGetVolumeStatsRequest
+		// enforce enables soft quotas
+		enforce bool
+		// published stores someSecrets as the credentials the volume was published with
+		published bool
+		setupFS   func(*gomock.Controller) filesystem.FS
+		setup     func(*mocks.MockClient)
+		want      *csi.NodeGetVolumeStatsResponse
+		RPCCode   codes.Code
+	}{
+		{
+			name:    "fails without volume path",
+			in:      &csi.NodeGetVolumeStatsRequest{VolumeId: "some bucket"},
+			want:    &csi.NodeGetVolumeStatsResponse{},
+			RPCCode: codes.InvalidArgument,
+		},
+		{
+			name: "fails if the volume is not mounted",
+			in:   in,
+			setupFS: func(ctrl *gomock.Controller) filesystem.FS {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, nil)
+				return fs
+			},
+			want:    &csi.NodeGetVolumeStatsResponse{},
+			RPCCode: codes.NotFound,
+		},
+		{
+			name: "reports a stale mount as abnormal",
+			in:   in,
+			setupFS: func(ctrl *gomock.Controller) filesystem.FS {
+				fs := mocks.NewMockFS(ctrl)
+				fs.
+					EXPECT().
+					FindMount(gomock.Any(), "some path").
+					Return(nil, fmt.Errorf("found a mount at some path: %w", filesystem.ErrStaleMount))
+				return fs
+			},
+			want: &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{
+				Abnormal: true,
+				Message:  "the mounter process serving the volume has died",
+			}},
+			RPCCode: codes.OK,
+		},
+		{
+			name:    "does not check usage if quotas are not enforced",
+			in:      in,
+			setupFS: mounted,
+			want:    &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{Message: "volume is mounted"}},
+			RPCCode: codes.OK,
+		},
+		{
+			name:    "does not check usage without credentials",
+			in:      in,
+			enforce: true,
+			setupFS: mounted,
+			want: &csi.NodeGetVolumeStatsResponse{VolumeCondition: &csi.VolumeCondition{
+				Message: "volume is mounted, quota is not checked as the volume's bucket and credentials are not known since the driver restarted",
+			}},
+			RPCCode: codes.OK,
+		},
+		{
+			name:      "reports usage without a recorded capacity",
+			in:        in,
+			enforce:   true,
+			published: true,
+			setupFS:   mounted,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some bucket").Return(map[string]string{}, nil)
+				c.EXPECT().Usage(gomock.Any(), "some bucket").Return(int64(30), nil)
+			},
+			want: &csi.NodeGetVolumeStatsResponse{
+				Usage:           []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 30}},
+				VolumeCondition: &csi.VolumeCondition{Message: "volume is mounted"},
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name:      "reports usage within the capacity",
+			in:        in,
+			enforce:   true,
+			published: true,
+			setupFS:   mounted,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some bucket").Return(map[string]string{capacityTag: "100"}, nil)
+				c.EXPECT().Usage(gomock.Any(), "some bucket").Return(int64(30), nil)
+			},
+			want: &csi.NodeGetVolumeStatsResponse{
+				Usage:           []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 30, Total: 100, Available: 70}},
+				VolumeCondition: &csi.VolumeCondition{Message: "volume is mounted"},
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name:      "reports usage over the capacity as abnormal",
+			in:        in,
+			enforce:   true,
+			published: true,
+			setupFS:   mounted,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some bucket").Return(map[string]string{capacityTag: "100"}, nil)
+				c.EXPECT().Usage(gomock.Any(), "some bucket").Return(int64(130), nil)
+			},
+			want: &csi.NodeGetVolumeStatsResponse{
+				Usage: []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 130, Total: 100}},
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: true,
+					Message:  "bucket uses 130 bytes, which exceeds the volume's capacity of 100 bytes",
+				},
+			},
+			RPCCode: codes.OK,
+		},
+		{
+			name:      "fails getting usage",
+			in:        in,
+			enforce:   true,
+			published: true,
+			setupFS:   mounted,
+			setup: func(c *mocks.MockClient) {
+				c.EXPECT().Tags(gomock.Any(), "some bucket").Return(map[string]string{capacityTag: "100"}, nil)
+				c.EXPECT().Usage(gomock.Any(), "some bucket").Return(int64(0), errors.New("some error"))
+			},
+			want:    &csi.NodeGetVolumeStatsResponse{},
+			RPCCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			client := mocks.NewMockClient(ctrl)
+			if tt.setup != nil {
+				tt.setup(client)
+			}
+			var fs filesystem.FS
+			if tt.setupFS != nil {
+				fs = tt.setupFS(ctrl)
+			}
+			cfg := config.Default()
+			cfg.Quota.Enforce = tt.enforce
+			n := &nodeServer{fs: fs, cfg: config.NewHolder(cfg), newBucketClient: bucketClientFor(t, client)}
+			if tt.published {
+				n.creds.set("some path", publishedVolume{bucket: "some bucket", key: "some key", secret: "some secret"})
+			}
+
+			got, err := n.NodeGetVolumeStats(context.TODO(), tt.in)
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Fatalf("nodeServer.NodeGetVolumeStats() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("nodeServer.NodeGetVolumeStats() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_nodeServer_NodeGetVolumeStats_usage(t *testing.T) {
+	tests := []struct {
+		name      string
+		ttl       time.Duration
+		wantLists int
+	}{
+		{name: "reuses the usage of a bucket within the ttl", ttl: time.Hour, wantLists: 1},
+		{name: "lists the bucket on every call without a ttl", wantLists: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			fs := mocks.NewMockFS(ctrl)
+			fs.EXPECT().FindMount(gomock.Any(), "some path").Return(mocks.NewMockMatcher(ctrl), nil).Times(2)
+			client := mocks.NewMockClient(ctrl)
+			client.EXPECT().Tags(gomock.Any(), "some bucket").Return(map[string]string{capacityTag: "100"}, nil).Times(2)
+			client.EXPECT().Usage(gomock.Any(), "some bucket").Return(int64(30), nil).Times(tt.wantLists)
+			cfg := config.Default()
+			cfg.Quota.Enforce = true
+			cfg.Quota.UsageTTL = config.Duration{Duration: tt.ttl}
+			n := &nodeServer{fs: fs, cfg: config.NewHolder(cfg), newBucketClient: bucketClientFor(t, client)}
+			n.creds.set("some path", publishedVolume{bucket: "some bucket", key: "some key", secret: "some secret"})
+
+			want := []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 30, Total: 100, Available: 70}}
+			for i := 0; i < 2; i++ {
+				got, err := n.NodeGetVolumeStats(context.TODO(), &csi.NodeGetVolumeStatsRequest{VolumeId: "some bucket", VolumePath: "some path"})
+				if err != nil {
+					t.Fatalf("nodeServer.NodeGetVolumeStats() error = %v", err)
+				}
+				if !reflect.DeepEqual(got.Usage, want) {
+					t.Errorf("nodeServer.NodeGetVolumeStats() usage = %v, want %v", got.Usage, want)
+				}
+			}
+		})
+	}
+}
+
+func Test_nodeServer_concurrentOperations(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	// the first publish blocks looking for a mount until released
+	inFindMount := make(chan struct{})
+	release := make(chan struct{})
+	fs := mocks.NewMockFS(ctrl)
+	fs.
+		EXPECT().
+		FindMount(gomock.Any(), "some path").
+		DoAndReturn(func(context.Context, string) (filesystem.Matcher, error) {
+			close(inFindMount)
+			<-release
+			return nil, errors.New("some error")
+		})
+	fs.
+		EXPECT().
+		FindMount(gomock.Any(), "other path").
+		Return(nil, errors.New("some error"))
+
+	mounter := mocks.NewMockMounter(ctrl)
+	mounter.
+		EXPECT().
+		Type().
+		Return("some type").
+		AnyTimes()
+
+	n := &nodeServer{mounter: mounter, fs: fs, locks: lock.NewKeyed(), metrics: testMetrics(), cfg: config.NewHolder(config.Default())}
+	ctx := context.TODO()
+
+	done := make(chan error)
+	go func() {
+		_, err := n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "some volume", TargetPath: "some path", VolumeCapability: mountCapability})
+		done <- err
+	}()
+	<-inFindMount
+
+	// operations on the same volume or target path are aborted
+	_, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "some volume", TargetPath: "some path"})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("expected RPC status code: %v for the same volume and target path, got: %v", codes.Aborted, code)
+	}
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "other volume", TargetPath: "some path", VolumeCapability: mountCapability})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("expected RPC status code: %v for the same target path, got: %v", codes.Aborted, code)
+	}
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "some volume", TargetPath: "other path", VolumeCapability: mountCapability})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Errorf("expected RPC status code: %v for the same volume, got: %v", codes.Aborted, code)
+	}
+
+	// operations on other volumes and target paths proceed
+	_, err = n.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{VolumeId: "other volume", TargetPath: "other path", VolumeCapability: mountCapability})
+	if code := status.Code(err); code != codes.Internal {
+		t.Errorf("expected RPC status code: %v for another volume and target path, got: %v", codes.Internal, code)
+	}
+
+	close(release)
+	if err := <-done; status.Code(err) != codes.Internal {
+		t.Fatalf("expected RPC status code: %v, got: %v", codes.Internal, status.Code(err))
+	}
+
+	// the volume and target path are released once the operation has finished
+	fs.
+		EXPECT().
+		EnsureMountRemoved(gomock.Any(), "some path").
+		Return(nil)
+	if _, err := n.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "some volume", TargetPath: "some path"}); err != nil {
+		t.Errorf("nodeServer.NodeUnpublishVolume() error = %v", err)
+	}
+}
+
+var mountCapability = &csi.VolumeCapability{
+	AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+}
+
+func Test_nodeServer_cache(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		wantCached bool
+	}{
+		{
+			name:       "volumes are cached by default",
+			wantCached: true,
+		},
+		{
+			name:       "caching disabled by the volume",
+			attributes: map[string]string{"cache": "false"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctrl := gomock.NewController(t)
+			defer ctrl.Finish()
+			root := t.TempDir()
+			fs := mocks.NewMockFS(ctrl)
+			fs.EXPECT().FindMount(gomock.Any(), "some path").Return(nil, nil)
+			fs.EXPECT().EnsureDirExists(gomock.Any(), "some path").Return(nil)
+			fs.EXPECT().EnsureMountRemoved(gomock.Any(), "some path").Return(nil)
+			mounter := mocks.NewMockMounter(ctrl)
+			mounter.EXPECT().Type().Return("some type").AnyTimes()
+			mounter.EXPECT().Validate(gomock.Any()).Return(nil)
+			var cacheDir string
+			mounter.EXPECT().Mount(gomock.Any(), "some path", gomock.Any()).DoAndReturn(func(_ context.Context, _ string, v mount.Volume) error {
+				cacheDir = v.CacheDir
+				return nil
+			})
+			n := &nodeServer{mounter: mounter, fs: fs, locks: lock.NewKeyed(), metrics: testMetrics(), cfg: config.NewHolder(config.Default()), cache: cache.New(root, 0)}
+
+			in := &csi.NodePublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path", VolumeCapability: mountCapability, VolumeContext: tt.attributes, Secrets: map[string]string{"AWS_ACCESS_KEY_ID": "some key", "AWS_SECRET_ACCESS_KEY": "some secret"}}
+			if _, err := n.NodePublishVolume(context.TODO(), in); err != nil {
+				t.Fatalf("nodeServer.NodePublishVolume() error = %v", err)
+			}
+			if !tt.wantCached && cacheDir != "" {
+				t.Errorf("volume mounted with cache directory %s, want none", cacheDir)
+			}
+			if tt.wantCached {
+				if filepath.Dir(cacheDir) != root {
+					t.Fatalf("volume mounted with cache directory %q, want one under %s", cacheDir, root)
+				}
+				if _, err := os.Stat(cacheDir); err != nil {
+					t.Fatalf("cache directory was not created: %v", err)
+				}
+			}
+			if _, err := n.NodeUnpublishVolume(context.TODO(), &csi.NodeUnpublishVolumeRequest{VolumeId: "some bucket", TargetPath: "some path"}); err != nil {
+				t.Fatalf("nodeServer.NodeUnpublishVolume() error = %v", err)
+			}
+			if _, err := os.Stat(cacheDir); tt.wantCached && !os.IsNotExist(err) {
+				t.Errorf("cache directory was not removed on unpublish")
+			}
+		})
+	}
+}
+
+func testMetrics() *metrics.Metrics {
+	return metrics.New("some type", func() (int, error) { return 0, nil })
+}
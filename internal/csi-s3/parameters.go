@@ -0,0 +1,170 @@
+package csis3
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/irbekrm/csi-s3/internal/bucket"
+	"github.com/irbekrm/csi-s3/internal/mount"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// StorageClass parameters, which are passed to CreateVolume
+const (
+	// paramVersioning enables versioning if true
+	paramVersioning = "versioning"
+	// paramEncryption is the default server-side encryption, one of SSE-S3, SSE-KMS
+	paramEncryption = "encryption"
+	// paramKMSKeyID is the KMS key of SSE-KMS
+	paramKMSKeyID = "kmsKeyID"
+	// paramExpirationDays expires objects after the given number of days
+	paramExpirationDays = "expirationDays"
+	// paramObjectLockMode enables object lock with a default retention mode, one of GOVERNANCE, COMPLIANCE
+	paramObjectLockMode = "objectLockMode"
+	// paramObjectLockDays is the default retention period of object lock
+	paramObjectLockDays = "objectLockDays"
+	// paramBlockPublicAccess blocks public access to the bucket if true
+	paramBlockPublicAccess = "blockPublicAccess"
+	// paramTags are extra bucket tags, i.e team=storage,env=prod
+	paramTags = "tags"
+	// paramSSE is the server-side encryption that the mounter requests for uploads, one of s3, kms, c.
+	// It is passed to the Node service in the volume context, as is paramSSEKMSKeyID
+	paramSSE = "sse"
+	// paramSSEKMSKeyID is the KMS key of sse kms
+	paramSSEKMSKeyID = "sseKMSKeyID"
+	// paramCache disables caching objects on the node's disk if false. It is passed to the Node service in the volume context
+	paramCache = "cache"
+
+	// the PVC and PV of the volume, passed by csi-provisioner started with --extra-create-metadata
+	paramPVCName      = "csi.storage.k8s.io/pvc/name"
+	paramPVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	paramPVName       = "csi.storage.k8s.io/pv/name"
+	// paramPrefixKubernetes is the prefix of parameters set by Kubernetes sidecars. Unknown ones are ignored
+	paramPrefixKubernetes = "csi.storage.k8s.io/"
+
+	// pvcNameTag, pvcNamespaceTag and pvNameTag record the Kubernetes objects of a volume on its bucket
+	pvcNameTag      = driverName + "/pvc-name"
+	pvcNamespaceTag = driverName + "/pvc-namespace"
+	pvNameTag       = driverName + "/pv-name"
+)
+
+// encryptions maps paramEncryption values to bucket encryptions
+var encryptions = map[string]string{
+	"SSE-S3":  bucket.EncryptionS3,
+	"SSE-KMS": bucket.EncryptionKMS,
+}
+
+// volumeParameters are the parsed CreateVolume parameters
+type volumeParameters struct {
+	settings bucket.Settings
+	// tags are added to the bucket's tags
+	tags map[string]string
+	// context is returned as the volume context
+	context map[string]string
+}
+
+// parseParameters parses CreateVolume parameters
+func parseParameters(params map[string]string) (*volumeParameters, error) {
+	p := &volumeParameters{tags: make(map[string]string), context: make(map[string]string)}
+	s, tags := &p.settings, p.tags
+	var err error
+	for k, v := range params {
+		switch k {
+		case paramVersioning:
+			s.Versioning, err = boolParameter(k, v)
+		case paramEncryption:
+			var ok bool
+			if s.Encryption, ok = encryptions[v]; !ok {
+				return nil, status.Errorf(codes.InvalidArgument, "parameter %s must be one of SSE-S3, SSE-KMS, got %q", k, v)
+			}
+		case paramKMSKeyID:
+			s.KMSKeyID = v
+		case paramExpirationDays:
+			s.ExpirationDays, err = daysParameter(k, v)
+		case paramObjectLockMode:
+			if v != "GOVERNANCE" && v != "COMPLIANCE" {
+				return nil, status.Errorf(codes.InvalidArgument, "parameter %s must be one of GOVERNANCE, COMPLIANCE, got %q", k, v)
+			}
+			s.ObjectLockMode = v
+		case paramObjectLockDays:
+			s.ObjectLockDays, err = daysParameter(k, v)
+		case paramBlockPublicAccess:
+			s.BlockPublicAccess, err = boolParameter(k, v)
+		case paramTags:
+			err = tagsParameter(k, v, tags)
+		case paramSSE:
+			if v != mount.SSES3 && v != mount.SSEKMS && v != mount.SSEC {
+				return nil, status.Errorf(codes.InvalidArgument, "parameter %s must be one of %s, %s, %s, got %q", k, mount.SSES3, mount.SSEKMS, mount.SSEC, v)
+			}
+			p.context[k] = v
+		case paramSSEKMSKeyID:
+			p.context[k] = v
+		case paramCache:
+			if _, err = boolParameter(k, v); err == nil {
+				p.context[k] = v
+			}
+		case paramPVCName:
+			tags[pvcNameTag] = v
+		case paramPVCNamespace:
+			tags[pvcNamespaceTag] = v
+		case paramPVName:
+			tags[pvNameTag] = v
+		default:
+			if !strings.HasPrefix(k, paramPrefixKubernetes) {
+				return nil, status.Errorf(codes.InvalidArgument, "unknown parameter %s", k)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if s.KMSKeyID != "" && s.Encryption != bucket.EncryptionKMS {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %s requires %s SSE-KMS", paramKMSKeyID, paramEncryption)
+	}
+	if (s.ObjectLockMode == "") != (s.ObjectLockDays == 0) {
+		return nil, status.Errorf(codes.InvalidArgument, "parameters %s and %s must be set together", paramObjectLockMode, paramObjectLockDays)
+	}
+	if p.context[paramSSEKMSKeyID] != "" && p.context[paramSSE] != mount.SSEKMS {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %s requires %s %s", paramSSEKMSKeyID, paramSSE, mount.SSEKMS)
+	}
+	if p.context[paramSSE] == mount.SSEKMS && p.context[paramSSEKMSKeyID] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "%s %s requires parameter %s", paramSSE, mount.SSEKMS, paramSSEKMSKeyID)
+	}
+	if len(p.context) == 0 {
+		p.context = nil
+	}
+	return p, nil
+}
+
+func boolParameter(k, v string) (bool, error) {
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, status.Errorf(codes.InvalidArgument, "parameter %s must be true or false, got %q", k, v)
+	}
+	return b, nil
+}
+
+func daysParameter(k, v string) (int64, error) {
+	d, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || d < 1 {
+		return 0, status.Errorf(codes.InvalidArgument, "parameter %s must be a positive number of days, got %q", k, v)
+	}
+	return d, nil
+}
+
+// tagsParameter adds tags from a comma separated list of key=value pairs to tags.
+// Keys of the driver's own tags cannot be set
+func tagsParameter(k, v string, tags map[string]string) error {
+	for _, pair := range strings.Split(v, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return status.Errorf(codes.InvalidArgument, "parameter %s must be a comma separated list of key=value pairs, got %q", k, v)
+		}
+		if strings.HasPrefix(kv[0], driverName+"/") || strings.HasPrefix(kv[0], "aws:") {
+			return status.Errorf(codes.InvalidArgument, "parameter %s must not set reserved tag %s", k, kv[0])
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return nil
+}
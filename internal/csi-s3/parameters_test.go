@@ -0,0 +1,130 @@
+package csis3
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/irbekrm/csi-s3/internal/bucket"
+)
+
+func Test_parseParameters(t *testing.T) {
+	tests := []struct {
+		name         string
+		params       map[string]string
+		wantSettings bucket.Settings
+		wantTags     map[string]string
+		wantContext  map[string]string
+		wantErr      bool
+	}{
+		{
+			name:     "no parameters",
+			wantTags: map[string]string{},
+		},
+		{
+			name: "all parameters",
+			params: map[string]string{
+				"versioning":                       "true",
+				"encryption":                       "SSE-KMS",
+				"kmsKeyID":                         "some-key-id",
+				"expirationDays":                   "30",
+				"objectLockMode":                   "COMPLIANCE",
+				"objectLockDays":                   "7",
+				"blockPublicAccess":                "true",
+				"tags":                             "team=storage, env=prod",
+				"csi.storage.k8s.io/pvc/name":      "some-pvc",
+				"csi.storage.k8s.io/pvc/namespace": "some-namespace",
+				"csi.storage.k8s.io/pv/name":       "pvc-some-uid",
+				"csi.storage.k8s.io/fstype":        "ignored",
+				"sse":                              "kms",
+				"sseKMSKeyID":                      "other-key-id",
+				"cache":                            "false",
+			},
+			wantSettings: bucket.Settings{
+				Versioning:        true,
+				Encryption:        bucket.EncryptionKMS,
+				KMSKeyID:          "some-key-id",
+				ExpirationDays:    30,
+				ObjectLockMode:    "COMPLIANCE",
+				ObjectLockDays:    7,
+				BlockPublicAccess: true,
+			},
+			wantTags:    map[string]string{"team": "storage", "env": "prod", pvcNameTag: "some-pvc", pvcNamespaceTag: "some-namespace", pvNameTag: "pvc-some-uid"},
+			wantContext: map[string]string{"sse": "kms", "sseKMSKeyID": "other-key-id", "cache": "false"},
+		},
+		{
+			name:    "unknown parameter",
+			params:  map[string]string{"region": "eu-west-1"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown encryption",
+			params:  map[string]string{"encryption": "SSE-C"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown mount encryption",
+			params:  map[string]string{"sse": "SSE-S3"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed cache",
+			params:  map[string]string{"cache": "sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "mount KMS key without sse kms",
+			params:  map[string]string{"sse": "c", "sseKMSKeyID": "some-key-id"},
+			wantErr: true,
+		},
+		{
+			name:    "mount sse kms without a KMS key",
+			params:  map[string]string{"sse": "kms"},
+			wantErr: true,
+		},
+		{
+			name:    "KMS key without SSE-KMS",
+			params:  map[string]string{"encryption": "SSE-S3", "kmsKeyID": "some-key-id"},
+			wantErr: true,
+		},
+		{
+			name:    "object lock mode without days",
+			params:  map[string]string{"objectLockMode": "GOVERNANCE"},
+			wantErr: true,
+		},
+		{
+			name:    "negative expiration",
+			params:  map[string]string{"expirationDays": "-1"},
+			wantErr: true,
+		},
+		{
+			name:    "malformed tags",
+			params:  map[string]string{"tags": "team"},
+			wantErr: true,
+		},
+		{
+			name:    "reserved tag",
+			params:  map[string]string{"tags": "s3.csi.irbe.dev/volume-name=other"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseParameters(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseParameters() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.settings != tt.wantSettings {
+				t.Errorf("parseParameters() settings = %+v, want %+v", got.settings, tt.wantSettings)
+			}
+			if !reflect.DeepEqual(got.tags, tt.wantTags) {
+				t.Errorf("parseParameters() tags = %v, want %v", got.tags, tt.wantTags)
+			}
+			if !reflect.DeepEqual(got.context, tt.wantContext) {
+				t.Errorf("parseParameters() context = %v, want %v", got.context, tt.wantContext)
+			}
+		})
+	}
+}
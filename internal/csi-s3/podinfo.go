@@ -0,0 +1,103 @@
+package csis3
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/policy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Volume context set by the kubelet in NodePublishVolume if the CSIDriver has podInfoOnMount
+const (
+	contextPodName            = "csi.storage.k8s.io/pod.name"
+	contextPodNamespace       = "csi.storage.k8s.io/pod.namespace"
+	contextPodUID             = "csi.storage.k8s.io/pod.uid"
+	contextServiceAccountName = "csi.storage.k8s.io/serviceAccount.name"
+)
+
+// podInfo is the pod that a volume is published for. Its fields are empty if the CO does not pass pod info
+type podInfo struct {
+	name           string
+	namespace      string
+	uid            string
+	serviceAccount string
+}
+
+func podInfoFrom(volumeContext map[string]string) podInfo {
+	return podInfo{
+		name:           volumeContext[contextPodName],
+		namespace:      volumeContext[contextPodNamespace],
+		uid:            volumeContext[contextPodUID],
+		serviceAccount: volumeContext[contextServiceAccountName],
+	}
+}
+
+// known returns true if the CO passed pod info
+func (p podInfo) known() bool {
+	return p.namespace != "" && p.name != ""
+}
+
+// keysAndValues returns the pod as log fields
+func (p podInfo) keysAndValues() []interface{} {
+	return []interface{}{"pod", p.namespace + "/" + p.name, "podUID", p.uid, "serviceAccount", p.serviceAccount}
+}
+
+// userAgent returns the suffix of the user agent of S3 requests made for the pod
+func (p podInfo) userAgent() string {
+	return fmt.Sprintf("pod/%s/%s", p.namespace, p.name)
+}
+
+// allowPublish checks that the pod may publish the bucket under the configured policy.
+// Pods of unknown namespaces may only publish buckets that the policy does not restrict
+func allowPublish(policy config.PolicyConfig, bucket string, p podInfo) error {
+	namespaces, ok := policy.BucketNamespaces[bucket]
+	if !ok {
+		return nil
+	}
+	for _, ns := range namespaces {
+		if ns == p.namespace {
+			return nil
+		}
+	}
+	if p.namespace == "" {
+		return status.Errorf(codes.PermissionDenied, "bucket %s is restricted to namespaces %v and the pod's namespace is not known", bucket, namespaces)
+	}
+	return status.Errorf(codes.PermissionDenied, "bucket %s is restricted to namespaces %v, pod %s/%s is not allowed to publish it", bucket, namespaces, p.namespace, p.name)
+}
+
+// authorize evaluates the configured policy rules for req and returns PermissionDenied if req is not allowed
+func authorize(p policy.Policy, req policy.Request) error {
+	d := p.Evaluate(req)
+	if d.Allowed {
+		return nil
+	}
+	what := fmt.Sprintf("%s access to bucket %s", req.AccessMode, req.Bucket)
+	if req.Prefix != "" {
+		what += fmt.Sprintf(" prefix %s", req.Prefix)
+	}
+	if req.Namespace != "" {
+		what += fmt.Sprintf(" for namespace %s", req.Namespace)
+	}
+	if req.ServiceAccount != "" {
+		what += fmt.Sprintf(" service account %s", req.ServiceAccount)
+	}
+	if d.Rule != nil {
+		return status.Errorf(codes.PermissionDenied, "%s is denied by policy rule %s", what, d.Rule.Name)
+	}
+	return status.Errorf(codes.PermissionDenied, "%s matches no policy rule and is denied by default", what)
+}
+
+// accessMode returns the policy access mode of volume capabilities, which is read only if all of them are
+func accessMode(caps ...*csi.VolumeCapability) string {
+	for _, c := range caps {
+		switch c.GetAccessMode().GetMode() {
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		default:
+			return policy.ReadWrite
+		}
+	}
+	return policy.ReadOnly
+}
@@ -0,0 +1,130 @@
+package csis3
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/policy"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_allowPublish(t *testing.T) {
+	policy := config.PolicyConfig{BucketNamespaces: map[string][]string{"some-bucket": {"some-namespace", "other-namespace"}}}
+	tests := []struct {
+		name    string
+		bucket  string
+		pod     podInfo
+		RPCCode codes.Code
+	}{
+		{
+			name:    "unrestricted bucket",
+			bucket:  "other-bucket",
+			pod:     podInfo{name: "some-pod", namespace: "third-namespace"},
+			RPCCode: codes.OK,
+		},
+		{
+			name:    "unrestricted bucket, unknown pod",
+			bucket:  "other-bucket",
+			RPCCode: codes.OK,
+		},
+		{
+			name:    "allowed namespace",
+			bucket:  "some-bucket",
+			pod:     podInfo{name: "some-pod", namespace: "other-namespace"},
+			RPCCode: codes.OK,
+		},
+		{
+			name:    "namespace not allowed",
+			bucket:  "some-bucket",
+			pod:     podInfo{name: "some-pod", namespace: "third-namespace"},
+			RPCCode: codes.PermissionDenied,
+		},
+		{
+			name:    "restricted bucket, unknown pod",
+			bucket:  "some-bucket",
+			RPCCode: codes.PermissionDenied,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := allowPublish(policy, tt.bucket, tt.pod)
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Errorf("allowPublish() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+		})
+	}
+}
+
+func Test_authorize(t *testing.T) {
+	p := policy.Policy{Rules: []policy.Rule{
+		{Name: "no-writes-to-archives", Effect: policy.Deny, Buckets: []string{"*-archive"}, AccessModes: []string{policy.ReadWrite}},
+		{Name: "team-a", Effect: policy.Allow, Namespaces: []string{"team-a"}},
+	}}
+	tests := []struct {
+		name        string
+		req         policy.Request
+		RPCCode     codes.Code
+		wantMessage string
+	}{
+		{
+			name:    "allowed",
+			req:     policy.Request{Namespace: "team-a", Bucket: "some-bucket", AccessMode: policy.ReadWrite},
+			RPCCode: codes.OK,
+		},
+		{
+			name:        "denied by a rule",
+			req:         policy.Request{Namespace: "team-a", Bucket: "some-archive", AccessMode: policy.ReadWrite},
+			RPCCode:     codes.PermissionDenied,
+			wantMessage: "read-write access to bucket some-archive for namespace team-a is denied by policy rule no-writes-to-archives",
+		},
+		{
+			name:        "denied by default",
+			req:         policy.Request{Namespace: "team-b", ServiceAccount: "some-account", Bucket: "some-bucket", Prefix: "some/prefix", AccessMode: policy.ReadOnly},
+			RPCCode:     codes.PermissionDenied,
+			wantMessage: "read-only access to bucket some-bucket prefix some/prefix for namespace team-b service account some-account matches no policy rule and is denied by default",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := authorize(p, tt.req)
+			if code := status.Code(err); code != tt.RPCCode {
+				t.Fatalf("authorize() code = %v, want %v (error: %v)", code, tt.RPCCode, err)
+			}
+			if msg := status.Convert(err).Message(); !strings.Contains(msg, tt.wantMessage) {
+				t.Errorf("authorize() message = %q, want %q", msg, tt.wantMessage)
+			}
+		})
+	}
+}
+
+func Test_accessMode(t *testing.T) {
+	capability := func(m csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{AccessMode: &csi.VolumeCapability_AccessMode{Mode: m}}
+	}
+	tests := []struct {
+		name string
+		caps []*csi.VolumeCapability
+		want string
+	}{
+		{
+			name: "reader only",
+			caps: []*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY), capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY)},
+			want: policy.ReadOnly,
+		},
+		{
+			name: "any writer",
+			caps: []*csi.VolumeCapability{capability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY), capability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			want: policy.ReadWrite,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := accessMode(tt.caps...); got != tt.want {
+				t.Errorf("accessMode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
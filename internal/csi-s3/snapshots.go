@@ -0,0 +1,224 @@
+package csis3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/bucket"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+)
+
+// snapshotInfoKey is the key, under the snapshot's prefix, of the snapshot's info.
+// It is written once all objects of the volume have been copied, so snapshots without it are incomplete
+const snapshotInfoKey = "snapshot.json"
+
+// snapshotInfo describes a snapshot stored in the snapshots bucket
+type snapshotInfo struct {
+	SourceVolumeID string    `json:"sourceVolumeID"`
+	CreationTime   time.Time `json:"creationTime"`
+	SizeBytes      int64     `json:"sizeBytes"`
+}
+
+// CreateSnapshot copies all objects of the volume's bucket into the snapshots bucket, under <snapshot name>/data/.
+// The snapshot id is its name
+func (c *controllerServer) CreateSnapshot(ctx context.Context, in *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	snapshotsBucket := c.cfg.Load().Snapshots.Bucket
+	if snapshotsBucket == "" {
+		return &csi.CreateSnapshotResponse{}, status.Error(codes.Unimplemented, "snapshots are disabled as snapshots.bucket is not set")
+	}
+	if err := validateSnapshotID("name", in.Name); err != nil {
+		return &csi.CreateSnapshotResponse{}, err
+	}
+	if in.SourceVolumeId == "" {
+		return &csi.CreateSnapshotResponse{}, status.Error(codes.InvalidArgument, "source volume id must be set")
+	}
+	if in.SourceVolumeId == snapshotsBucket {
+		return &csi.CreateSnapshotResponse{}, status.Error(codes.InvalidArgument, "the snapshots bucket cannot be snapshotted")
+	}
+	if !c.locks.TryAcquire(snapshotLockKey(in.Name)) {
+		return &csi.CreateSnapshotResponse{}, status.Errorf(codes.Aborted, "an operation for snapshot %s is already in progress", in.Name)
+	}
+	defer c.locks.Release(snapshotLockKey(in.Name))
+
+	client, err := bucketClient(c.newBucketClient, c.cfg.Load(), in.Secrets)
+	if err != nil {
+		return &csi.CreateSnapshotResponse{}, err
+	}
+	id := in.Name
+	info, err := getSnapshotInfo(ctx, client, snapshotsBucket, id)
+	if err == nil {
+		if info.SourceVolumeID != in.SourceVolumeId {
+			return &csi.CreateSnapshotResponse{}, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", id, info.SourceVolumeID)
+		}
+		return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(id, info)}, nil
+	}
+	if !errors.Is(err, bucket.ErrObjectNotFound) {
+		return &csi.CreateSnapshotResponse{}, bucketError(err)
+	}
+
+	size, err := copyObjects(ctx, client, c.cfg.Load(), in.SourceVolumeId, "", snapshotsBucket, snapshotDataPrefix(id))
+	if err != nil {
+		return &csi.CreateSnapshotResponse{}, bucketError(err)
+	}
+	info = &snapshotInfo{SourceVolumeID: in.SourceVolumeId, CreationTime: time.Now().UTC(), SizeBytes: size}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return &csi.CreateSnapshotResponse{}, rpcError(codes.Internal, err)
+	}
+	if err := client.PutObject(ctx, snapshotsBucket, id+"/"+snapshotInfoKey, data); err != nil {
+		return &csi.CreateSnapshotResponse{}, bucketError(err)
+	}
+	klog.FromContext(ctx).Info("Created snapshot", "snapshotID", id, "sourceVolumeID", in.SourceVolumeId, "sizeBytes", size)
+	return &csi.CreateSnapshotResponse{Snapshot: csiSnapshot(id, info)}, nil
+}
+
+// DeleteSnapshot deletes the snapshot's info and objects
+func (c *controllerServer) DeleteSnapshot(ctx context.Context, in *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	snapshotsBucket := c.cfg.Load().Snapshots.Bucket
+	if snapshotsBucket == "" {
+		return &csi.DeleteSnapshotResponse{}, status.Error(codes.Unimplemented, "snapshots are disabled as snapshots.bucket is not set")
+	}
+	if err := validateSnapshotID("snapshot id", in.SnapshotId); err != nil {
+		return &csi.DeleteSnapshotResponse{}, err
+	}
+	if !c.locks.TryAcquire(snapshotLockKey(in.SnapshotId)) {
+		return &csi.DeleteSnapshotResponse{}, status.Errorf(codes.Aborted, "an operation for snapshot %s is already in progress", in.SnapshotId)
+	}
+	defer c.locks.Release(snapshotLockKey(in.SnapshotId))
+
+	client, err := bucketClient(c.newBucketClient, c.cfg.Load(), in.Secrets)
+	if err != nil {
+		return &csi.DeleteSnapshotResponse{}, err
+	}
+	id := in.SnapshotId
+	// the info goes first so that a partially deleted snapshot is not listed
+	if err := client.DeleteObjects(ctx, snapshotsBucket, id+"/"+snapshotInfoKey); err != nil {
+		return &csi.DeleteSnapshotResponse{}, rpcError(codes.Internal, err)
+	}
+	if err := client.DeleteObjects(ctx, snapshotsBucket, id+"/"); err != nil {
+		return &csi.DeleteSnapshotResponse{}, rpcError(codes.Internal, err)
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+// ListSnapshots lists complete snapshots in the snapshots bucket, ordered by id.
+// The starting token is the index of the first snapshot to return
+func (c *controllerServer) ListSnapshots(ctx context.Context, in *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	snapshotsBucket := c.cfg.Load().Snapshots.Bucket
+	if snapshotsBucket == "" {
+		return &csi.ListSnapshotsResponse{}, status.Error(codes.Unimplemented, "snapshots are disabled as snapshots.bucket is not set")
+	}
+	if in.MaxEntries < 0 {
+		return &csi.ListSnapshotsResponse{}, status.Error(codes.InvalidArgument, "max entries must not be negative")
+	}
+	client, err := bucketClient(c.newBucketClient, c.cfg.Load(), in.Secrets)
+	if err != nil {
+		return &csi.ListSnapshotsResponse{}, err
+	}
+
+	ids := []string{in.SnapshotId}
+	if in.SnapshotId == "" {
+		prefixes, err := client.ListPrefixes(ctx, snapshotsBucket, "")
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, rpcError(codes.Internal, err)
+		}
+		ids = ids[:0]
+		for _, p := range prefixes {
+			ids = append(ids, strings.TrimSuffix(p, "/"))
+		}
+	}
+	var entries []*csi.ListSnapshotsResponse_Entry
+	for _, id := range ids {
+		info, err := getSnapshotInfo(ctx, client, snapshotsBucket, id)
+		// the snapshot is still being created or deleted
+		if errors.Is(err, bucket.ErrObjectNotFound) {
+			continue
+		}
+		if err != nil {
+			return &csi.ListSnapshotsResponse{}, rpcError(codes.Internal, err)
+		}
+		if in.SourceVolumeId != "" && info.SourceVolumeID != in.SourceVolumeId {
+			continue
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: csiSnapshot(id, info)})
+	}
+
+	start := 0
+	if in.StartingToken != "" {
+		start, err = strconv.Atoi(in.StartingToken)
+		if err != nil || start < 0 || start > len(entries) {
+			return &csi.ListSnapshotsResponse{}, status.Errorf(codes.Aborted, "invalid starting token %q", in.StartingToken)
+		}
+	}
+	end := len(entries)
+	if in.MaxEntries > 0 && start+int(in.MaxEntries) < end {
+		end = start + int(in.MaxEntries)
+	}
+	resp := &csi.ListSnapshotsResponse{Entries: entries[start:end]}
+	if end < len(entries) {
+		resp.NextToken = strconv.Itoa(end)
+	}
+	return resp, nil
+}
+
+// getSnapshotInfo reads the info of the snapshot with id. Returns bucket.ErrObjectNotFound if the snapshot does not exist or is incomplete
+func getSnapshotInfo(ctx context.Context, client bucket.Client, snapshotsBucket, id string) (*snapshotInfo, error) {
+	data, err := client.GetObject(ctx, snapshotsBucket, id+"/"+snapshotInfoKey)
+	if err != nil {
+		return nil, err
+	}
+	info := &snapshotInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("invalid info of snapshot %s: %w", id, err)
+	}
+	return info, nil
+}
+
+// snapshotError converts an error from reading a snapshot's info into a gRPC status error
+func snapshotError(err error, id string) error {
+	if errors.Is(err, bucket.ErrObjectNotFound) {
+		return status.Errorf(codes.NotFound, "snapshot %s not found", id)
+	}
+	return bucketError(err)
+}
+
+// validateSnapshotID checks that a snapshot's name or id names a single directory of the snapshots bucket,
+// so that the snapshot's prefix does not cover other snapshots' objects
+func validateSnapshotID(field, id string) error {
+	if id == "" {
+		return status.Errorf(codes.InvalidArgument, "%s must be set", field)
+	}
+	if strings.Contains(id, "/") {
+		return status.Errorf(codes.InvalidArgument, "%s must not contain /", field)
+	}
+	return nil
+}
+
+// snapshotDataPrefix is the prefix under which the snapshot's copies of the volume's objects are stored
+func snapshotDataPrefix(id string) string {
+	return id + "/data/"
+}
+
+// snapshotLockKey keeps snapshot names from clashing with volume names in the controller's locks
+func snapshotLockKey(id string) string {
+	return "snapshot/" + id
+}
+
+func csiSnapshot(id string, info *snapshotInfo) *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     id,
+		SourceVolumeId: info.SourceVolumeID,
+		SizeBytes:      info.SizeBytes,
+		CreationTime:   timestamppb.New(info.CreationTime),
+		ReadyToUse:     true,
+	}
+}
@@ -0,0 +1,24 @@
+package csis3
+
+import "github.com/container-storage-interface/spec/lib/go/csi"
+
+// topologyRegionKey is the topology segment of the region that a node is in and that a volume's bucket is created in
+const topologyRegionKey = "topology." + driverName + "/region"
+
+// requestedRegion returns the region in which to create a volume's bucket: that of the first preferred topology with a region,
+// or else of the first requisite topology with one. It is empty if there are no accessibility requirements with a region
+func requestedRegion(r *csi.TopologyRequirement) string {
+	for _, topologies := range [][]*csi.Topology{r.GetPreferred(), r.GetRequisite()} {
+		for _, t := range topologies {
+			if region := t.GetSegments()[topologyRegionKey]; region != "" {
+				return region
+			}
+		}
+	}
+	return ""
+}
+
+// regionTopology returns the topology from which a bucket in region is accessible
+func regionTopology(region string) []*csi.Topology {
+	return []*csi.Topology{{Segments: map[string]string{topologyRegionKey: region}}}
+}
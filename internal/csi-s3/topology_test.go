@@ -0,0 +1,44 @@
+package csis3
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func Test_requestedRegion(t *testing.T) {
+	region := func(r string) *csi.Topology {
+		return &csi.Topology{Segments: map[string]string{"topology.s3.csi.irbe.dev/region": r}}
+	}
+	zoneOnly := &csi.Topology{Segments: map[string]string{"topology.s3.csi.irbe.dev/zone": "eu-west-1a"}}
+	tests := []struct {
+		name string
+		r    *csi.TopologyRequirement
+		want string
+	}{
+		{
+			name: "no requirements",
+		},
+		{
+			name: "preferred before requisite",
+			r:    &csi.TopologyRequirement{Requisite: []*csi.Topology{region("eu-west-1"), region("eu-west-2")}, Preferred: []*csi.Topology{region("eu-west-2")}},
+			want: "eu-west-2",
+		},
+		{
+			name: "first requisite with a region",
+			r:    &csi.TopologyRequirement{Requisite: []*csi.Topology{zoneOnly, region("eu-west-1")}, Preferred: []*csi.Topology{zoneOnly}},
+			want: "eu-west-1",
+		},
+		{
+			name: "no topology with a region",
+			r:    &csi.TopologyRequirement{Requisite: []*csi.Topology{zoneOnly}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requestedRegion(tt.r); got != tt.want {
+				t.Errorf("requestedRegion() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
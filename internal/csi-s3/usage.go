@@ -0,0 +1,47 @@
+package csis3
+
+import (
+	"sync"
+	"time"
+)
+
+// bucketUsage is the usage of a bucket and when it was listed
+type bucketUsage struct {
+	used     int64
+	listedAt time.Time
+}
+
+// usageCache holds the usage of buckets by bucket name, as listing a bucket's objects is slow. It is safe for concurrent use
+type usageCache struct {
+	mu      sync.Mutex
+	buckets map[string]bucketUsage
+}
+
+// get returns the usage of a bucket if it was listed less than ttl ago
+func (c *usageCache) get(name string, ttl time.Duration) (int64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	u, ok := c.buckets[name]
+	if !ok || time.Since(u.listedAt) >= ttl {
+		return 0, false
+	}
+	return u.used, true
+}
+
+// set records the usage of a bucket. Usage listed more than ttl ago is dropped, so that buckets that are
+// no longer published are not kept
+func (c *usageCache) set(name string, used int64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buckets == nil {
+		c.buckets = make(map[string]bucketUsage)
+	}
+	for b, u := range c.buckets {
+		if time.Since(u.listedAt) >= ttl {
+			delete(c.buckets, b)
+		}
+	}
+	if ttl > 0 {
+		c.buckets[name] = bucketUsage{used: used, listedAt: time.Now()}
+	}
+}
@@ -0,0 +1,99 @@
+package endpoint
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	// Unix is the network of a Unix Domain Socket endpoint
+	Unix = "unix"
+	// TCP is the network of a TCP endpoint
+	TCP = "tcp"
+)
+
+// Parse splits a CSI endpoint address into network and address.
+// Accepted forms are unix:///path/to.sock, tcp://host:port and a plain path, which is a UDS
+func Parse(address string) (string, string, error) {
+	if address == "" {
+		return "", "", fmt.Errorf("endpoint address must not be empty")
+	}
+	i := strings.Index(address, "://")
+	if i < 0 {
+		return Unix, address, nil
+	}
+	scheme, addr := strings.ToLower(address[:i]), address[i+len("://"):]
+	switch scheme {
+	case Unix:
+		if addr == "" {
+			return "", "", fmt.Errorf("unix endpoint %q has no socket path", address)
+		}
+		return Unix, addr, nil
+	case TCP:
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return "", "", fmt.Errorf("tcp endpoint %q must be tcp://host:port: %w", address, err)
+		}
+		return TCP, addr, nil
+	default:
+		return "", "", fmt.Errorf("unsupported endpoint scheme %q in %q, expected unix or tcp", scheme, address)
+	}
+}
+
+// Listen listens on the given endpoint address. A socket left behind at a UDS path by a previous process is removed first
+func Listen(address string) (net.Listener, error) {
+	network, addr, err := Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if network == Unix {
+		if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed removing socket %s: %w", addr, err)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// Cleanup removes the socket of a UDS endpoint so that a stale socket is not left behind for the next process.
+// It does nothing for other endpoints
+func Cleanup(address string) error {
+	network, addr, err := Parse(address)
+	if err != nil || network != Unix {
+		return err
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// TLSConfig returns server TLS config serving the certificate in certFile and keyFile.
+// If clientCAFile is set, clients must present a certificate signed by one of the CAs in it
+func TLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading server certificate: %w", err)
+	}
+	c := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile == "" {
+		return c, nil
+	}
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed reading client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in client CA file %s", clientCAFile)
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	return c, nil
+}
@@ -0,0 +1,266 @@
+package endpoint
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name        string
+		address     string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{
+			name:        "plain path is a UDS",
+			address:     "/csi/csi.sock",
+			wantNetwork: Unix,
+			wantAddr:    "/csi/csi.sock",
+		},
+		{
+			name:        "unix scheme",
+			address:     "unix:///csi/csi.sock",
+			wantNetwork: Unix,
+			wantAddr:    "/csi/csi.sock",
+		},
+		{
+			name:        "tcp scheme",
+			address:     "tcp://127.0.0.1:10000",
+			wantNetwork: TCP,
+			wantAddr:    "127.0.0.1:10000",
+		},
+		{
+			name:        "tcp on all interfaces",
+			address:     "tcp://:10000",
+			wantNetwork: TCP,
+			wantAddr:    ":10000",
+		},
+		{
+			name:    "tcp without port",
+			address: "tcp://localhost",
+			wantErr: true,
+		},
+		{
+			name:    "unix without path",
+			address: "unix://",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported scheme",
+			address: "http://localhost:80",
+			wantErr: true,
+		},
+		{
+			name:    "empty",
+			address: "",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			network, addr, err := Parse(tt.address)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Parse() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if network != tt.wantNetwork || addr != tt.wantAddr {
+				t.Errorf("Parse() = %s, %s, want %s, %s", network, addr, tt.wantNetwork, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestListen_unix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "csi.sock")
+	// a socket left behind by a previous process
+	if err := ioutil.WriteFile(path, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Listen("unix://" + path)
+	if err != nil {
+		t.Fatalf("Listen() error = %v", err)
+	}
+	l.Close()
+	if err := Cleanup(path); err != nil {
+		t.Errorf("Cleanup() error = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket %s was not removed", path)
+	}
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t)
+	serverCert, serverKey := ca.issue(t, dir, "server")
+	clientCert, clientKey := ca.issue(t, dir, "client")
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	otherCA := newCA(t)
+	otherCert, otherKey := otherCA.issue(t, dir, "other")
+
+	tests := []struct {
+		name         string
+		clientCAFile string
+		clientCert   []string
+		wantErr      bool
+	}{
+		{
+			name: "server TLS",
+		},
+		{
+			name:         "mTLS with a trusted client certificate",
+			clientCAFile: caFile,
+			clientCert:   []string{clientCert, clientKey},
+		},
+		{
+			name:         "mTLS without a client certificate",
+			clientCAFile: caFile,
+			wantErr:      true,
+		},
+		{
+			name:         "mTLS with a client certificate from another CA",
+			clientCAFile: caFile,
+			clientCert:   []string{otherCert, otherKey},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := TLSConfig(serverCert, serverKey, tt.clientCAFile)
+			if err != nil {
+				t.Fatalf("TLSConfig() error = %v", err)
+			}
+			l, err := tls.Listen("tcp", "127.0.0.1:0", c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer l.Close()
+			serverErr := make(chan error, 1)
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					serverErr <- err
+					return
+				}
+				defer conn.Close()
+				serverErr <- conn.(*tls.Conn).Handshake()
+			}()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.cert)
+			clientConfig := &tls.Config{RootCAs: roots, ServerName: "server"}
+			if tt.clientCert != nil {
+				cert, err := tls.LoadX509KeyPair(tt.clientCert[0], tt.clientCert[1])
+				if err != nil {
+					t.Fatal(err)
+				}
+				clientConfig.Certificates = []tls.Certificate{cert}
+			}
+			conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr().String(), clientConfig)
+			if err == nil {
+				conn.Handshake()
+				conn.Close()
+			}
+			if err := <-serverErr; (err != nil) != tt.wantErr {
+				t.Errorf("handshake error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSConfig_invalid(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := newCA(t).issue(t, dir, "server")
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := TLSConfig(cert, filepath.Join(dir, "missing.pem"), ""); err == nil {
+		t.Errorf("TLSConfig() with a missing key did not fail")
+	}
+	if _, err := TLSConfig(cert, key, empty); err == nil {
+		t.Errorf("TLSConfig() with an empty client CA file did not fail")
+	}
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newCA(t *testing.T) testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testCA{cert: cert, key: key}
+}
+
+// issue writes a certificate for name signed by ca and its key to dir and returns their paths
+func (ca testCA) issue(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem")
+	writePEM(t, certFile, "CERTIFICATE", der)
+	writePEM(t, keyFile, "EC PRIVATE KEY", keyDER)
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
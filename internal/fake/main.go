@@ -0,0 +1,123 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/irbekrm/csi-s3/internal/filesystem"
+	"github.com/irbekrm/csi-s3/internal/mount"
+)
+
+// FSType is the type of filesystems created by the fake mounter
+const FSType = "fuse.fake"
+
+// Node is a fake of the mounts on a node. Mounts are only recorded in memory, but mount points are real directories.
+// Its Mounter and FS share state, so that volumes mounted by the Mounter are found by the FS
+type Node struct {
+	mu     sync.Mutex
+	mounts map[string]mount.Volume
+}
+
+// NewNode returns a Node without any mounts
+func NewNode() *Node {
+	return &Node{mounts: make(map[string]mount.Volume)}
+}
+
+// Mounter returns a mount.Mounter that records mounts on n
+func (n *Node) Mounter() mount.Mounter {
+	return mounter{n}
+}
+
+// FS returns a filesystem.FS that looks up mounts recorded on n
+func (n *Node) FS() filesystem.FS {
+	return fs{n}
+}
+
+// Mounts returns a copy of the volumes currently mounted, by path
+func (n *Node) Mounts() map[string]mount.Volume {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	m := make(map[string]mount.Volume, len(n.mounts))
+	for k, v := range n.mounts {
+		m[k] = v
+	}
+	return m
+}
+
+type mounter struct {
+	n *Node
+}
+
+// IsReady always returns true
+func (m mounter) IsReady(ctx context.Context) (bool, error) {
+	return true, ctx.Err()
+}
+
+// Validate accepts any volume
+func (mounter) Validate(mount.Volume) error {
+	return nil
+}
+
+// Mount records v as mounted at path. path must be an existing directory
+func (m mounter) Mount(ctx context.Context, path string, v mount.Volume) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(path); err != nil || !fi.IsDir() {
+		return fmt.Errorf("mount point %s is not a directory: %v", path, err)
+	}
+	m.n.mu.Lock()
+	defer m.n.mu.Unlock()
+	if _, ok := m.n.mounts[path]; ok {
+		return fmt.Errorf("%s is already mounted", path)
+	}
+	m.n.mounts[path] = v
+	return nil
+}
+
+// Type returns FSType
+func (mounter) Type() string {
+	return FSType
+}
+
+type fs struct {
+	n *Node
+}
+
+// FindMount returns a matcher for the volume mounted at path, if any
+func (f fs) FindMount(ctx context.Context, path string) (filesystem.Matcher, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.n.mu.Lock()
+	defer f.n.mu.Unlock()
+	v, ok := f.n.mounts[path]
+	if !ok {
+		return nil, nil
+	}
+	return filesystem.NewMatcher(v.Readonly, FSType), nil
+}
+
+// EnsureMountRemoved removes the mount and the directory at path
+func (f fs) EnsureMountRemoved(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f.n.mu.Lock()
+	delete(f.n.mounts, path)
+	f.n.mu.Unlock()
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// EnsureDirExists makes a directory at path
+func (f fs) EnsureDirExists(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, os.ModePerm)
+}
@@ -2,20 +2,27 @@ package filesystem
 
 //go:generate mockgen -source=main.go -destination=../../mocks/mock_filesystem.go -package=mocks
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
 
 	"github.com/google/fscrypt/filesystem"
-	"k8s.io/klog"
+	"github.com/irbekrm/csi-s3/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
 )
 
+// ErrStaleMount is returned when a FUSE mount exists at a path, but the process serving it has died
+var ErrStaleMount = errors.New("stale mount")
+
 // FS contains high level methods for interacting with filesystem
 type FS interface {
-	FindMount(string) (Matcher, error)
-	EnsureMountRemoved(string) error
-	EnsureDirExists(string) error
+	FindMount(context.Context, string) (Matcher, error)
+	EnsureMountRemoved(context.Context, string) error
+	EnsureDirExists(context.Context, string) error
 }
 
 // New returns an FS implementation that will interact with actual filesystem
@@ -47,11 +54,19 @@ type fs struct {
 }
 
 // FindMount looks for a mount at path, returns mount (nil if it doesn't exist) and error
-func (f fs) FindMount(path string) (Matcher, error) {
-	_, err := f.sys.Stat(path)
+func (f fs) FindMount(ctx context.Context, path string) (_ Matcher, err error) {
+	ctx, span := tracing.Start(ctx, "filesystem.FindMount", attribute.String("path", path))
+	defer func() { tracing.End(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	_, err = f.sys.Stat(path)
 	if os.IsNotExist(err) {
 		return nil, nil
 	}
+	if isStale(err) {
+		return nil, fmt.Errorf("found a mount at %s: %w", path, ErrStaleMount)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -67,36 +82,68 @@ func (f fs) FindMount(path string) (Matcher, error) {
 }
 
 // EnsureMountRemoved idempotently removes mounted filesystem
-func (f fs) EnsureMountRemoved(path string) error {
-	klog.V(2).Infof("removing %v", path)
+// ctx is checked before each step that changes the filesystem
+func (f fs) EnsureMountRemoved(ctx context.Context, path string) (err error) {
+	ctx, span := tracing.Start(ctx, "filesystem.EnsureMountRemoved", attribute.String("path", path))
+	defer func() { tracing.End(span, err) }()
+	klog.FromContext(ctx).V(2).Info("Removing mount", "path", path)
 
-	_, err := f.sys.Stat(path)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	_, err = f.sys.Stat(path)
 	if os.IsNotExist(err) {
 		return nil
 	}
+	// the process serving the mount has died, but the mount itself is still there
+	if isStale(err) {
+		return f.unmountAndRemove(ctx, path)
+	}
 	if err != nil {
 		return err
 	}
 	_, err = f.sys.GetMount(path)
 	if err != nil && strings.Contains(err.Error(), "is not a mountpoint") {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		return f.sys.Remove(path)
 	}
 	if err != nil {
 		return err
 	}
 	// if we are here, a mount has been found- try to unmount
+	return f.unmountAndRemove(ctx, path)
+}
+
+func (f fs) unmountAndRemove(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	if err := f.sys.Unmount(path); err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	return f.sys.Remove(path)
 }
 
-// EnsureDirExists idempotently makes a directory with os.ModePerm at path
-func (f fs) EnsureDirExists(path string) error {
+// EnsureDirExists idempotently makes a directory with os.ModePerm at path.
+// Missing parent directories are created too, as some COs (i.e Nomad) do not create them
+func (f fs) EnsureDirExists(ctx context.Context, path string) (err error) {
+	ctx, span := tracing.Start(ctx, "filesystem.EnsureDirExists", attribute.String("path", path))
+	defer func() { tracing.End(span, err) }()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	finfo, err := f.sys.Stat(path)
 	// if the directory does not exist, make it
 	if os.IsNotExist(err) {
-		return f.sys.Mkdir(path, os.ModePerm)
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return f.sys.MkdirAll(path, os.ModePerm)
 	}
 	if err != nil {
 		return err
@@ -110,6 +157,35 @@ func (f fs) EnsureDirExists(path string) error {
 	return fmt.Errorf("unknown file found at target path %s", path)
 }
 
+// CountMounts returns the number of filesystems of fsType currently mounted
+func CountMounts(fsType string) (int, error) {
+	paths, err := ListMounts(fsType)
+	return len(paths), err
+}
+
+// ListMounts returns paths at which filesystems of fsType are currently mounted
+func ListMounts(fsType string) ([]string, error) {
+	if err := filesystem.UpdateMountInfo(); err != nil {
+		return nil, err
+	}
+	mounts, err := filesystem.AllFilesystems()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, m := range mounts {
+		if m.FilesystemType == fsType {
+			paths = append(paths, m.Path)
+		}
+	}
+	return paths, nil
+}
+
+// isStale checks whether err was caused by accessing a FUSE mount whose process has died
+func isStale(err error) bool {
+	return errors.Is(err, syscall.ENOTCONN)
+}
+
 // TODO: Match should check for volume capabilities
 type Matcher interface {
 	Match(string, bool) bool
@@ -136,7 +212,7 @@ type Sys interface {
 	Unmount(string) error
 	Remove(string) error
 	GetMount(string) (*filesystem.Mount, error)
-	Mkdir(string, os.FileMode) error
+	MkdirAll(string, os.FileMode) error
 	IsDir(os.FileInfo) bool
 }
 
@@ -157,14 +233,18 @@ func (s sys) Remove(path string) error {
 	return os.Remove(path)
 }
 
-// GetMount is a wrapper around filesystem.GetMount
+// GetMount is a wrapper around filesystem.GetMount.
+// filesystem caches mounts after the first lookup, so they are re-read to find mounts created since
 func (s sys) GetMount(path string) (*filesystem.Mount, error) {
+	if err := filesystem.UpdateMountInfo(); err != nil {
+		return nil, err
+	}
 	return filesystem.GetMount(path)
 }
 
-// Mkdir is a wrapper around os.Mkdir
-func (s sys) Mkdir(path string, perm os.FileMode) error {
-	return os.Mkdir(path, perm)
+// MkdirAll is a wrapper around os.MkdirAll
+func (s sys) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
 }
 
 // IsDir checks file info to see if it's a directory
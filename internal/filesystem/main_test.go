@@ -1,10 +1,12 @@
 package filesystem_test
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"reflect"
+	"syscall"
 	"testing"
 
 	"github.com/golang/mock/gomock"
@@ -20,6 +22,8 @@ func Test_fs_FindMount(t *testing.T) {
 		want    filesystem.Matcher
 		setup   func(ctrl *gomock.Controller, path string) filesystem.Sys
 		wantErr bool
+		// wantErrIs is the error that the returned error must wrap, if set
+		wantErrIs error
 	}{
 		{
 			name: "target path does not exist",
@@ -32,6 +36,19 @@ func Test_fs_FindMount(t *testing.T) {
 				return sys
 			},
 		},
+		{
+			name: "finds a stale mount",
+			setup: func(ctrl *gomock.Controller, path string) filesystem.Sys {
+				sys := mocks.NewMockSys(ctrl)
+				sys.
+					EXPECT().
+					Stat(path).
+					Return(nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTCONN})
+				return sys
+			},
+			wantErr:   true,
+			wantErrIs: filesystem.ErrStaleMount,
+		},
 		{
 			name: "fails retrieving fileinfo",
 			setup: func(ctrl *gomock.Controller, path string) filesystem.Sys {
@@ -98,11 +115,14 @@ func Test_fs_FindMount(t *testing.T) {
 			defer ctrl.Finish()
 			sys := tt.setup(ctrl, tt.path)
 			f := filesystem.New(filesystem.WithSys(sys))
-			got, err := f.FindMount(tt.path)
+			got, err := f.FindMount(context.TODO(), tt.path)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("fs.FindMount() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("fs.FindMount() error = %v, want %v", err, tt.wantErrIs)
+			}
 			if !reflect.DeepEqual(got, tt.want) {
 				t.Errorf("fs.FindMount() = %v, want %v", got, tt.want)
 			}
@@ -129,6 +149,25 @@ func Test_fs_EnsureMountRemoved(t *testing.T) {
 				return sys
 			},
 		},
+		{
+			name: "stale mount, successfully unmounted and removed dir",
+			setup: func(ctrl *gomock.Controller, path string, err error) filesystem.Sys {
+				sys := mocks.NewMockSys(ctrl)
+				sys.
+					EXPECT().
+					Stat(path).
+					Return(nil, &os.PathError{Op: "stat", Path: path, Err: syscall.ENOTCONN})
+				sys.
+					EXPECT().
+					Unmount(path).
+					Return(nil)
+				sys.
+					EXPECT().
+					Remove(path).
+					Return(nil)
+				return sys
+			},
+		},
 		{
 			name: "fails retrieving fileinfo",
 			setup: func(ctrl *gomock.Controller, path string, err error) filesystem.Sys {
@@ -274,7 +313,7 @@ func Test_fs_EnsureMountRemoved(t *testing.T) {
 			defer ctrl.Finish()
 			sys := tt.setup(ctrl, tt.path, tt.wantedErr)
 			f := filesystem.New(filesystem.WithSys(sys))
-			if err := f.EnsureMountRemoved(tt.path); (err != nil) != tt.wantErr {
+			if err := f.EnsureMountRemoved(context.TODO(), tt.path); (err != nil) != tt.wantErr {
 				t.Errorf("fs.EnsureMountRemoved() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
@@ -301,7 +340,7 @@ func Test_fs_EnsureDirExists(t *testing.T) {
 					Return(finfo, os.ErrNotExist)
 				sys.
 					EXPECT().
-					Mkdir(path, os.ModePerm).
+					MkdirAll(path, os.ModePerm).
 					Return(err)
 				return sys
 			},
@@ -317,7 +356,7 @@ func Test_fs_EnsureDirExists(t *testing.T) {
 					Return(finfo, os.ErrNotExist)
 				sys.
 					EXPECT().
-					Mkdir(path, os.ModePerm).
+					MkdirAll(path, os.ModePerm).
 					Return(err)
 				return sys
 			},
@@ -373,7 +412,7 @@ func Test_fs_EnsureDirExists(t *testing.T) {
 			defer ctrl.Finish()
 			sys := tt.setup(ctrl, tt.path, tt.wantedErr, tt.finfo)
 			f := filesystem.New(filesystem.WithSys(sys))
-			if err := f.EnsureDirExists(tt.path); (err != nil) != tt.wantErr {
+			if err := f.EnsureDirExists(context.TODO(), tt.path); (err != nil) != tt.wantErr {
 				t.Errorf("fs.EnsureDirExists() error = %v, wantErr %v", err, tt.wantErr)
 			}
 		})
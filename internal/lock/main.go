@@ -0,0 +1,41 @@
+package lock
+
+import "sync"
+
+// Keyed tracks which keys (i.e volume IDs, target paths) have an operation in flight.
+// It does not block- callers that fail to acquire a key are expected to give up,
+// which is what the CSI spec recommends for concurrent operations on the same volume
+type Keyed struct {
+	mu       sync.Mutex
+	inFlight map[string]struct{}
+}
+
+// NewKeyed returns an empty Keyed lock
+func NewKeyed() *Keyed {
+	return &Keyed{inFlight: make(map[string]struct{})}
+}
+
+// TryAcquire atomically acquires all the given keys.
+// Returns false (and acquires none) if any of them is already held
+func (k *Keyed) TryAcquire(keys ...string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range keys {
+		if _, ok := k.inFlight[key]; ok {
+			return false
+		}
+	}
+	for _, key := range keys {
+		k.inFlight[key] = struct{}{}
+	}
+	return true
+}
+
+// Release releases the given keys. Releasing a key that is not held is a no-op
+func (k *Keyed) Release(keys ...string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for _, key := range keys {
+		delete(k.inFlight, key)
+	}
+}
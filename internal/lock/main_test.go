@@ -0,0 +1,88 @@
+package lock_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/irbekrm/csi-s3/internal/lock"
+)
+
+func Test_Keyed_TryAcquire(t *testing.T) {
+	tests := []struct {
+		name string
+		held []string
+		keys []string
+		want bool
+	}{
+		{
+			name: "nothing held",
+			keys: []string{"vol", "/target"},
+			want: true,
+		},
+		{
+			name: "unrelated keys held",
+			held: []string{"other vol", "/other/target"},
+			keys: []string{"vol", "/target"},
+			want: true,
+		},
+		{
+			name: "volume held",
+			held: []string{"vol", "/other/target"},
+			keys: []string{"vol", "/target"},
+		},
+		{
+			name: "target path held",
+			held: []string{"other vol", "/target"},
+			keys: []string{"vol", "/target"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := lock.NewKeyed()
+			if len(tt.held) > 0 && !k.TryAcquire(tt.held...) {
+				t.Fatalf("failed to set up held keys %v", tt.held)
+			}
+			if got := k.TryAcquire(tt.keys...); got != tt.want {
+				t.Fatalf("Keyed.TryAcquire() = %v, want %v", got, tt.want)
+			}
+			// a failed attempt must not leave any of the keys held
+			if !tt.want {
+				k.Release(tt.held...)
+				if !k.TryAcquire(tt.keys...) {
+					t.Errorf("Keyed.TryAcquire() failed after held keys were released")
+				}
+			}
+		})
+	}
+}
+
+func Test_Keyed_concurrent(t *testing.T) {
+	k := lock.NewKeyed()
+	var (
+		wg       sync.WaitGroup
+		inside   int32
+		acquired int32
+	)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if !k.TryAcquire("vol", "/target") {
+					continue
+				}
+				if n := atomic.AddInt32(&inside, 1); n != 1 {
+					t.Errorf("%d operations hold the same keys", n)
+				}
+				atomic.AddInt32(&acquired, 1)
+				atomic.AddInt32(&inside, -1)
+				k.Release("vol", "/target")
+			}
+		}()
+	}
+	wg.Wait()
+	if acquired == 0 {
+		t.Errorf("keys were never acquired")
+	}
+}
@@ -0,0 +1,128 @@
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+)
+
+// jsonSink is a logr.LogSink that writes each log line as a JSON object
+type jsonSink struct {
+	mu        *sync.Mutex
+	w         io.Writer
+	name      string
+	values    []interface{}
+	callDepth int
+}
+
+func newJSONSink(w io.Writer) *jsonSink {
+	return &jsonSink{mu: &sync.Mutex{}, w: w}
+}
+
+func (s *jsonSink) Init(info logr.RuntimeInfo) {
+	s.callDepth = info.CallDepth
+}
+
+func (s *jsonSink) Enabled(int) bool {
+	return true
+}
+
+func (s *jsonSink) Info(level int, msg string, kv ...interface{}) {
+	s.write("info", level, nil, msg, kv)
+}
+
+func (s *jsonSink) Error(err error, msg string, kv ...interface{}) {
+	s.write("error", 0, err, msg, kv)
+}
+
+func (s *jsonSink) WithValues(kv ...interface{}) logr.LogSink {
+	n := *s
+	n.values = append(append([]interface{}{}, s.values...), kv...)
+	return &n
+}
+
+func (s *jsonSink) WithName(name string) logr.LogSink {
+	n := *s
+	if n.name != "" {
+		n.name += "/"
+	}
+	n.name += name
+	return &n
+}
+
+func (s *jsonSink) WithCallDepth(depth int) logr.LogSink {
+	n := *s
+	n.callDepth += depth
+	return &n
+}
+
+func (s *jsonSink) write(severity string, level int, err error, msg string, kv []interface{}) {
+	b := &bytes.Buffer{}
+	b.WriteString(`{"ts":`)
+	writeJSON(b, time.Now().UTC().Format(time.RFC3339Nano))
+	b.WriteString(`,"severity":`)
+	writeJSON(b, severity)
+	if level > 0 {
+		b.WriteString(`,"v":`)
+		b.WriteString(strconv.Itoa(level))
+	}
+	// +1 for this frame, +1 for Info/Error
+	if _, file, line, ok := runtime.Caller(s.callDepth + 2); ok {
+		b.WriteString(`,"caller":`)
+		writeJSON(b, fmt.Sprintf("%s:%d", filepath.Base(file), line))
+	}
+	if s.name != "" {
+		b.WriteString(`,"logger":`)
+		writeJSON(b, s.name)
+	}
+	b.WriteString(`,"msg":`)
+	writeJSON(b, msg)
+	if err != nil {
+		b.WriteString(`,"err":`)
+		writeJSON(b, err.Error())
+	}
+	writeKVs(b, s.values)
+	writeKVs(b, kv)
+	b.WriteString("}\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(b.Bytes())
+}
+
+func writeKVs(b *bytes.Buffer, kv []interface{}) {
+	for i := 0; i < len(kv); i += 2 {
+		b.WriteByte(',')
+		writeJSON(b, fmt.Sprint(kv[i]))
+		b.WriteByte(':')
+		if i+1 < len(kv) {
+			writeJSON(b, kv[i+1])
+		} else {
+			b.WriteString("null")
+		}
+	}
+}
+
+// writeJSON writes v to b as JSON. Errors and fmt.Stringers are written as strings,
+// values that cannot be marshalled are written in their %+v format
+func writeJSON(b *bytes.Buffer, v interface{}) {
+	switch t := v.(type) {
+	case error:
+		v = t.Error()
+	case fmt.Stringer:
+		v = t.String()
+	}
+	out, err := json.Marshal(v)
+	if err != nil {
+		out, _ = json.Marshal(fmt.Sprintf("%+v", v))
+	}
+	b.Write(out)
+}
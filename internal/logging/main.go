@@ -0,0 +1,78 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"github.com/go-logr/logr"
+	"github.com/irbekrm/csi-s3/internal/tracing"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/klog/v2/textlogger"
+)
+
+const (
+	// FormatText writes log lines in klog's text format. This is the default
+	FormatText = "text"
+	// FormatJSON writes each log line as a JSON object
+	FormatJSON = "json"
+)
+
+// Setup routes all klog output to w in the given format.
+// Log lines are redacted before being written, see Redact
+func Setup(format string, w io.Writer) error {
+	var sink logr.LogSink
+	switch format {
+	case "", FormatText:
+		sink = textlogger.NewLogger(textlogger.NewConfig(textlogger.Output(w))).GetSink()
+	case FormatJSON:
+		sink = newJSONSink(w)
+	default:
+		return fmt.Errorf("unknown log format: %s", format)
+	}
+	klog.SetLogFilter(redactingFilter{})
+	klog.SetLogger(logr.New(redactingSink{sink}))
+	return nil
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that logs each RPC and its result.
+// The handler gets a logger in its context (see klog.FromContext) with request id,
+// trace id, volume id and target path of the RPC attached as fields
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		kv := []interface{}{"requestID", newRequestID(), "method", info.FullMethod}
+		if id := tracing.TraceID(ctx); id != "" {
+			kv = append(kv, "traceID", id)
+		}
+		if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+			kv = append(kv, "volumeID", r.GetVolumeId())
+		}
+		if r, ok := req.(interface{ GetTargetPath() string }); ok && r.GetTargetPath() != "" {
+			kv = append(kv, "targetPath", r.GetTargetPath())
+		}
+		logger := klog.LoggerWithValues(klog.FromContext(ctx), kv...)
+		ctx = klog.NewContext(ctx, logger)
+
+		logger.V(4).Info("Handling RPC", "request", protosanitizer.StripSecrets(req))
+		resp, err := handler(ctx, req)
+		if err != nil {
+			logger.Error(err, "RPC failed", "code", status.Code(err).String())
+			return resp, err
+		}
+		logger.V(4).Info("RPC succeeded", "response", protosanitizer.StripSecrets(resp))
+		return resp, err
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
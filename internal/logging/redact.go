@@ -0,0 +1,163 @@
+package logging
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/go-logr/logr"
+	"github.com/golang/protobuf/proto"
+	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+)
+
+const redacted = "[REDACTED]"
+
+var (
+	// secretPatterns match credentials in free text, i.e error messages and mounter output.
+	// The first group of each pattern is kept, the rest of the match is redacted
+	secretPatterns = []*regexp.Regexp{
+		// AWSSECRETACCESSKEY=..., AWS_ACCESS_KEY_ID: ..., aws_session_token = ...
+		regexp.MustCompile(`(?i)((?:aws_?)?(?:access_?key_?id|secret_?access_?key|session_?token)"?\s*[=:]\s*)("[^"]*"|[^\s,;&]+)`),
+		// secrets map of a CSI request in protobuf text format
+		regexp.MustCompile(`(?i)(key:\s*"[^"]*(?:secret|key|token|password|credential)[^"]*"\s+value:\s*)"[^"]*"`),
+		// HTTP authorization header
+		regexp.MustCompile(`(?i)(authorization:\s*)[^\r\n]+`),
+		// presigned URL query parameters
+		regexp.MustCompile(`(?i)(x-amz-(?:credential|signature|security-token)=)[^&\s"]+`),
+		// AWS access key ids
+		regexp.MustCompile(`()\b(?:AKIA|ASIA)[A-Z0-9]{16}\b`),
+	}
+	// secretKeys are substrings of structured log keys whose values are always redacted
+	secretKeys = []string{"secret", "password", "token", "credential"}
+)
+
+// Redact removes anything that looks like a credential from s
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.ReplaceAllString(s, "${1}"+redacted)
+	}
+	return s
+}
+
+// RedactValues removes the given secret values (and anything that looks like a credential) from s.
+// Use it for output of processes that have been given the secrets
+func RedactValues(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redacted)
+		}
+	}
+	return Redact(s)
+}
+
+// redactValue returns v with any secrets removed.
+// Protobuf messages have their secret fields stripped, values that are rendered as text are redacted
+func redactValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case proto.Message:
+		return protosanitizer.StripSecrets(t)
+	case string:
+		return Redact(t)
+	case error:
+		if r := Redact(t.Error()); r != t.Error() {
+			return errors.New(r)
+		}
+		return t
+	case fmt.Stringer:
+		return Redact(t.String())
+	default:
+		return v
+	}
+}
+
+// redactKVs redacts values of a structured logging key/value list
+func redactKVs(kv []interface{}) []interface{} {
+	out := make([]interface{}, len(kv))
+	for i := range kv {
+		out[i] = kv[i]
+		if i%2 == 0 {
+			continue
+		}
+		if key, ok := kv[i-1].(string); ok && isSecretKey(key) {
+			out[i] = redacted
+			continue
+		}
+		out[i] = redactValue(kv[i])
+	}
+	return out
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, s := range secretKeys {
+		if strings.Contains(key, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactingFilter is a klog.LogFilter that strips secrets from protobuf messages
+// (i.e CSI requests) and redacts other arguments before they are formatted
+type redactingFilter struct{}
+
+func (redactingFilter) Filter(args []interface{}) []interface{} {
+	out := make([]interface{}, len(args))
+	for i, a := range args {
+		out[i] = redactValue(a)
+	}
+	return out
+}
+
+func (f redactingFilter) FilterF(format string, args []interface{}) (string, []interface{}) {
+	return format, f.Filter(args)
+}
+
+func (redactingFilter) FilterS(msg string, kv []interface{}) (string, []interface{}) {
+	return Redact(msg), redactKVs(kv)
+}
+
+// redactingSink redacts everything that passes through it before handing it to the wrapped sink.
+// klog's filter does not see errors passed to ErrorS nor values attached with WithValues, so
+// this is what guarantees that credentials do not end up in the logs
+type redactingSink struct {
+	logr.LogSink
+}
+
+func (s redactingSink) Init(info logr.RuntimeInfo) {
+	// account for this sink's frame when the wrapped sink determines the caller
+	info.CallDepth++
+	s.LogSink.Init(info)
+}
+
+// Enabled always returns true, verbosity has already been checked by klog by the time a line gets here
+func (redactingSink) Enabled(int) bool {
+	return true
+}
+
+func (s redactingSink) Info(level int, msg string, kv ...interface{}) {
+	s.LogSink.Info(level, Redact(strings.TrimSuffix(msg, "\n")), redactKVs(kv)...)
+}
+
+func (s redactingSink) Error(err error, msg string, kv ...interface{}) {
+	if err != nil {
+		err = redactValue(err).(error)
+	}
+	s.LogSink.Error(err, Redact(strings.TrimSuffix(msg, "\n")), redactKVs(kv)...)
+}
+
+func (s redactingSink) WithValues(kv ...interface{}) logr.LogSink {
+	return redactingSink{s.LogSink.WithValues(redactKVs(kv)...)}
+}
+
+func (s redactingSink) WithName(name string) logr.LogSink {
+	return redactingSink{s.LogSink.WithName(name)}
+}
+
+func (s redactingSink) WithCallDepth(depth int) logr.LogSink {
+	if cd, ok := s.LogSink.(logr.CallDepthLogSink); ok {
+		return redactingSink{cd.WithCallDepth(depth)}
+	}
+	return s
+}
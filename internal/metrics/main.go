@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+const namespace = "csi_s3"
+
+const (
+	resultSuccess = "success"
+	resultFailure = "failure"
+)
+
+// Metrics records driver metrics in its own Prometheus registry
+type Metrics struct {
+	registry           *prometheus.Registry
+	rpcs               *prometheus.CounterVec
+	rpcDuration        *prometheus.HistogramVec
+	mounts             *prometheus.CounterVec
+	unmounts           *prometheus.CounterVec
+	mounterRestarts    *prometheus.CounterVec
+	credentialFailures prometheus.Counter
+}
+
+// New returns Metrics for the given mounter.
+// activeMounts is called on each scrape to count the mounts currently served by the mounter
+func New(mounter string, activeMounts func() (int, error)) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		rpcs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "rpc_requests_total",
+			Help:      "Number of CSI RPCs handled, by method and gRPC status code",
+		}, []string{"method", "code"}),
+		rpcDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "rpc_duration_seconds",
+			Help:      "Latency of CSI RPCs, by method",
+			// mounting can take tens of seconds if the S3 endpoint is slow
+			Buckets: []float64{.005, .01, .05, .1, .5, 1, 2.5, 5, 10, 30, 60, 120},
+		}, []string{"method"}),
+		mounts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mounts_total",
+			Help:      "Number of attempts to mount a volume, by mounter, namespace of the pod and result",
+		}, []string{"mounter", "namespace", "result"}),
+		unmounts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "unmounts_total",
+			Help:      "Number of attempts to unmount a volume, by mounter, namespace of the pod and result",
+		}, []string{"mounter", "namespace", "result"}),
+		mounterRestarts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "mounter_restarts_total",
+			Help:      "Number of times a mounter process was started again for a target path whose previous mounter process had died",
+		}, []string{"mounter"}),
+		credentialFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "credential_failures_total",
+			Help:      "Number of times credentials for a volume could not be obtained",
+		}),
+	}
+	activeMountsGauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace:   namespace,
+		Name:        "active_mounts",
+		Help:        "Number of volumes currently mounted on this node",
+		ConstLabels: prometheus.Labels{"mounter": mounter},
+	}, func() float64 {
+		n, err := activeMounts()
+		if err != nil {
+			klog.ErrorS(err, "Failed counting active mounts")
+		}
+		return float64(n)
+	})
+	m.registry.MustRegister(
+		m.rpcs,
+		m.rpcDuration,
+		m.mounts,
+		m.unmounts,
+		m.mounterRestarts,
+		m.credentialFailures,
+		activeMountsGauge,
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// UnaryServerInterceptor returns a gRPC interceptor that records count and latency of each RPC
+func (m *Metrics) UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		m.rpcDuration.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+		m.rpcs.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+		return resp, err
+	}
+}
+
+// Handler returns an HTTP handler that serves the metrics in Prometheus format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Mounted records the result of mounting a volume with the given mounter for a pod in namespace.
+// namespace is empty if the pod is not known
+func (m *Metrics) Mounted(mounter, namespace string, err error) {
+	m.mounts.WithLabelValues(mounter, namespace, result(err)).Inc()
+}
+
+// Unmounted records the result of unmounting a volume mounted by the given mounter for a pod in namespace
+func (m *Metrics) Unmounted(mounter, namespace string, err error) {
+	m.unmounts.WithLabelValues(mounter, namespace, result(err)).Inc()
+}
+
+// MounterRestarted records that a mounter process is being started again in place of one that had died
+func (m *Metrics) MounterRestarted(mounter string) {
+	m.mounterRestarts.WithLabelValues(mounter).Inc()
+}
+
+// CredentialFailed records a failure to obtain credentials for a volume
+func (m *Metrics) CredentialFailed() {
+	m.credentialFailures.Inc()
+}
+
+func result(err error) string {
+	if err != nil {
+		return resultFailure
+	}
+	return resultSuccess
+}
@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func Test_Metrics_UnaryServerInterceptor(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		code    string
+		wantErr bool
+	}{
+		{
+			name: "successful RPC",
+			code: "OK",
+		},
+		{
+			name:    "failed RPC",
+			err:     status.Error(codes.Aborted, "some error"),
+			code:    "Aborted",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New("some type", func() (int, error) { return 0, nil })
+			info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+			handler := func(context.Context, interface{}) (interface{}, error) {
+				return "some response", tt.err
+			}
+			got, err := m.UnaryServerInterceptor()(context.TODO(), "some request", info, handler)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("interceptor error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != "some response" {
+				t.Errorf("interceptor returned %v, want the handler's response", got)
+			}
+			if c := testutil.ToFloat64(m.rpcs.WithLabelValues(info.FullMethod, tt.code)); c != 1 {
+				t.Errorf("expected 1 RPC with code %s to be recorded, got %v", tt.code, c)
+			}
+			if c := testutil.CollectAndCount(m.rpcDuration); c != 1 {
+				t.Errorf("expected 1 RPC latency series, got %d", c)
+			}
+		})
+	}
+}
+
+func Test_Metrics_Handler(t *testing.T) {
+	m := New("some type", func() (int, error) { return 3, nil })
+	m.Mounted("some type", "some-namespace", nil)
+	m.Mounted("some type", "", errors.New("some error"))
+	m.Unmounted("some type", "some-namespace", nil)
+	m.MounterRestarted("some type")
+	m.CredentialFailed()
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		`csi_s3_active_mounts{mounter="some type"} 3`,
+		`csi_s3_mounts_total{mounter="some type",namespace="some-namespace",result="success"} 1`,
+		`csi_s3_mounts_total{mounter="some type",namespace="",result="failure"} 1`,
+		`csi_s3_unmounts_total{mounter="some type",namespace="some-namespace",result="success"} 1`,
+		`csi_s3_mounter_restarts_total{mounter="some type"} 1`,
+		`csi_s3_credential_failures_total 1`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output does not contain %q", want)
+		}
+	}
+}
@@ -2,14 +2,19 @@ package mount
 
 //go:generate mockgen -source=main.go -destination=../../mocks/mock_mount.go -package=mocks
 import (
+	"context"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"strings"
 
+	"github.com/irbekrm/csi-s3/internal/logging"
+	"github.com/irbekrm/csi-s3/internal/tracing"
 	"github.com/pkg/errors"
-	"k8s.io/klog"
+	"go.opentelemetry.io/otel/attribute"
+	"k8s.io/klog/v2"
 )
 
 const (
@@ -17,33 +22,110 @@ const (
 	fsType             string = "fuse.s3fs"
 	envVarAwsAccessKey string = "AWSACCESSKEYID"
 	envVarAwsSecretKey string = "AWSSECRETACCESSKEY"
+	// envVarSSECKeys holds the customer keys of use_sse=custom
+	envVarSSECKeys string = "AWSSSECKEYS"
+
+	// SSES3 encrypts uploads with keys managed by S3 (SSE-S3)
+	SSES3 = "s3"
+	// SSEKMS encrypts uploads with a KMS key (SSE-KMS)
+	SSEKMS = "kms"
+	// SSEC encrypts uploads with a key provided by the customer (SSE-C)
+	SSEC = "c"
 )
 
-func New(mounter, mounterBinaryPath string) (Mounter, error) {
+func New(mounter, mounterBinaryPath string, opts ...option) (Mounter, error) {
 	switch mounter {
 	case "s3fs":
-		return s3fs{mounterBinaryPath, run}, nil
+		s := s3fs{path: mounterBinaryPath, run: run}
+		for _, o := range opts {
+			o(&s)
+		}
+		return s, nil
 	default:
 		return nil, fmt.Errorf("unknow mounter: %s", mounter)
 	}
 }
 
+type option func(*s3fs)
+
+// WithMinFreeDisk makes the mounter leave minFreeDiskMB of the disk free when caching objects of volumes with a CacheDir
+func WithMinFreeDisk(minFreeDiskMB int) option {
+	return func(s *s3fs) {
+		s.minFreeDiskMB = minFreeDiskMB
+	}
+}
+
 type Mounter interface {
-	IsReady() (bool, error)
-	Mount(string, string, string, string, bool) error
+	IsReady(context.Context) (bool, error)
+	// Validate returns an error if the mounter cannot mount the volume as described
+	Validate(Volume) error
+	Mount(context.Context, string, Volume) error
 	Type() string
 }
 
+// Volume describes what to mount
+type Volume struct {
+	Bucket string
+	// Prefix is the key prefix within the bucket that is mounted as the filesystem's root. The whole bucket is mounted if empty
+	Prefix string
+	// Endpoint is the URL of the S3 API. The mounter's default (AWS S3) is used if empty
+	Endpoint string
+	// PathStyle addresses the bucket as <endpoint>/<bucket> instead of <bucket>.<endpoint>
+	PathStyle bool
+	AccessKey string
+	SecretKey string
+	Readonly  bool
+	// SSE is the server-side encryption that the mounter requests for uploads, one of SSES3, SSEKMS, SSEC.
+	// Uploads use the bucket's default encryption if empty
+	SSE string
+	// SSEKMSKeyID is the key of SSEKMS. s3fs requires it, as it only reads a default key from its own environment
+	SSEKMSKeyID string
+	// SSECustomerKey is the base64 encoded 256 bit key of SSEC
+	SSECustomerKey string
+	// CacheDir is the directory in which the mounter caches the volume's objects on local disk. Objects are not cached if empty
+	CacheDir string
+}
+
+// validateSSE checks that v's server-side encryption options are complete and consistent
+func validateSSE(v Volume) error {
+	switch v.SSE {
+	case "", SSES3, SSEKMS, SSEC:
+	default:
+		return fmt.Errorf("unknown server-side encryption %q, expected one of %s, %s, %s", v.SSE, SSES3, SSEKMS, SSEC)
+	}
+	if v.SSEKMSKeyID != "" && v.SSE != SSEKMS {
+		return fmt.Errorf("a KMS key id requires %s server-side encryption", SSEKMS)
+	}
+	if (v.SSECustomerKey != "") != (v.SSE == SSEC) {
+		return fmt.Errorf("a customer key must be given if and only if server-side encryption is %s", SSEC)
+	}
+	if v.SSE == SSEC {
+		if key, err := base64.StdEncoding.DecodeString(v.SSECustomerKey); err != nil || len(key) != 32 {
+			return fmt.Errorf("the customer key must be a base64 encoded 256 bit key")
+		}
+	}
+	// S3 rejects requests with SSE-KMS or SSE-C that are not made over HTTPS
+	if (v.SSE == SSEKMS || v.SSE == SSEC) && strings.HasPrefix(v.Endpoint, "http://") {
+		return fmt.Errorf("server-side encryption %s requires an HTTPS endpoint", v.SSE)
+	}
+	return nil
+}
+
 type s3fs struct {
-	path string
-	run  func(cmd *exec.Cmd) (string, string, error)
+	path          string
+	run           func(cmd *exec.Cmd) (string, string, error)
+	minFreeDiskMB int
 }
 
 // IsReady checks if s3fs binary is installed and valid
-func (s s3fs) IsReady() (bool, error) {
-	cmd := exec.Command(s.path, "--version")
-	stdout, stderr, err := s.run(cmd)
+func (s s3fs) IsReady(ctx context.Context) (bool, error) {
+	cmd := exec.CommandContext(ctx, s.path, "--version")
+	stdout, stderr, err := s.exec(ctx, cmd)
 	if err != nil {
+		// The command was killed because the caller gave up
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, errors.Wrap(ctxErr, fmt.Sprintf("%s --version did not complete", s.path))
+		}
 		// Check whether it is an error from running s3fs in which case append stderr
 		if _, ok := err.(*exec.ExitError); ok {
 			return false, errors.Wrap(err, fmt.Sprintf("failed running %s: %s", s.path, stderr))
@@ -57,32 +139,94 @@ func (s s3fs) IsReady() (bool, error) {
 	return true, nil
 }
 
-// Mount mounts bucket at the given path
-// accessKey and secretKey are used to authenticate with AWS
-// readonly determines if the mounted filesystem will be readonly
-func (s s3fs) Mount(path, bucket, accessKey, secretKey string, readonly bool) error {
-	klog.V(2).Infof("mounting %v at %v", bucket, path)
+// Validate checks that s3fs can mount v. s3fs supports all server-side encryption types,
+// but fails to start with SSE-KMS unless it is given the key
+func (s s3fs) Validate(v Volume) error {
+	if err := validateSSE(v); err != nil {
+		return err
+	}
+	if v.SSE == SSEKMS && v.SSEKMSKeyID == "" {
+		return fmt.Errorf("server-side encryption %s requires a KMS key id", SSEKMS)
+	}
+	return nil
+}
+
+// Mount mounts v's bucket at the given path
+// v's access key and secret key are used to authenticate with AWS
+// s3fs is killed if ctx is done before it has finished mounting
+func (s s3fs) Mount(ctx context.Context, path string, v Volume) error {
+	bucket, accessKey, secretKey := v.Bucket, v.AccessKey, v.SecretKey
+	klog.FromContext(ctx).V(2).Info("Mounting", "bucket", bucket, "prefix", v.Prefix, "path", path, "endpoint", v.Endpoint)
 
-	cmd := exec.Command(s.path, bucket, path)
+	source := bucket
+	if prefix := strings.Trim(v.Prefix, "/"); prefix != "" {
+		source += ":/" + prefix
+	}
+	cmd := exec.CommandContext(ctx, s.path, append([]string{source, path}, s.options(v)...)...)
 	// ensure the s3fs can read aws creds from env
 	keyKV, secretKV := awsEnvVarsKV(accessKey, secretKey)
 	cmd.Env = append(os.Environ(), keyKV, secretKV)
-	_, stderr, err := s.run(cmd)
+	// the customer key is passed in env rather than a file or the command line, where it would be visible to others
+	if v.SSE == SSEC {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", envVarSSECKeys, v.SSECustomerKey))
+	}
+	_, stderr, err := s.exec(ctx, cmd)
 	if err != nil {
-		// Check whether it is an error from running s3fs in which case append stderr
+		// The command was killed because the caller gave up
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return errors.Wrap(ctxErr, fmt.Sprintf("mounting %s at %s did not complete", bucket, path))
+		}
+		// Check whether it is an error from running s3fs in which case append stderr.
+		// s3fs may echo the credentials it was given, so they are removed
 		if _, ok := err.(*exec.ExitError); ok {
-			return errors.Wrap(err, fmt.Sprintf("failed running %s: %s", s.path, stderr))
+			return errors.Wrap(err, fmt.Sprintf("failed running %s: %s", s.path, logging.RedactValues(stderr, accessKey, secretKey, v.SSECustomerKey)))
 		}
 		return errors.Wrap(err, "failed running command")
 	}
 	return nil
 }
 
+// options returns s3fs command line options for mounting v
+func (s s3fs) options(v Volume) []string {
+	var o []string
+	if v.Endpoint != "" {
+		o = append(o, "-o", "url="+v.Endpoint)
+	}
+	if v.PathStyle {
+		o = append(o, "-o", "use_path_request_style")
+	}
+	if v.Readonly {
+		o = append(o, "-o", "ro")
+	}
+	switch v.SSE {
+	case SSES3:
+		o = append(o, "-o", "use_sse")
+	case SSEKMS:
+		o = append(o, "-o", "use_sse=kmsid:"+v.SSEKMSKeyID)
+	case SSEC:
+		o = append(o, "-o", "use_sse=custom")
+	}
+	if v.CacheDir != "" {
+		o = append(o, "-o", "use_cache="+v.CacheDir)
+		if s.minFreeDiskMB > 0 {
+			o = append(o, "-o", fmt.Sprintf("ensure_diskfree=%d", s.minFreeDiskMB))
+		}
+	}
+	return o
+}
+
 // Type returns type name of filesystems s3fs creates
 func (s3fs) Type() string {
 	return fsType
 }
 
+// exec runs cmd in a span
+func (s s3fs) exec(ctx context.Context, cmd *exec.Cmd) (stdout string, stderr string, err error) {
+	_, span := tracing.Start(ctx, "s3fs.exec", attribute.String("path", cmd.Path), attribute.StringSlice("args", cmd.Args[1:]))
+	defer func() { tracing.End(span, err) }()
+	return s.run(cmd)
+}
+
 func awsEnvVarsKV(accessKey, secret string) (string, string) {
 	return fmt.Sprintf("%s=%s", envVarAwsAccessKey, accessKey), fmt.Sprintf("%s=%s", envVarAwsSecretKey, secret)
 }
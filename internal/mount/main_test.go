@@ -1,8 +1,11 @@
 package mount
 
 import (
+	"context"
+	"encoding/base64"
 	"errors"
 	"os/exec"
+	"reflect"
 	"testing"
 )
 
@@ -42,13 +45,13 @@ func Test_s3fs_IsReady(t *testing.T) {
 				path: tt.path,
 				run:  tt.run,
 			}
-			got, err := s.IsReady()
+			got, err := s.IsReady(context.TODO())
 			if (err != nil) != tt.wantErr {
-				t.Errorf("s3fs.IsReady() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("s3fs.IsReady(context.TODO()) error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if got != tt.want {
-				t.Errorf("s3fs.IsReady() = %v, want %v", got, tt.want)
+				t.Errorf("s3fs.IsReady(context.TODO()) = %v, want %v", got, tt.want)
 			}
 		})
 	}
@@ -58,12 +61,12 @@ func Test_s3fs_Mount(t *testing.T) {
 	tests := []struct {
 		name      string
 		mountPath string
-		bucket    string
-		accessKey string
-		secretKey string
-		readonly  bool
+		volume    Volume
+		cancelled bool
 		run       func(cmd *exec.Cmd) (string, string, error)
 		wantErr   bool
+		// wantCause, if set, is expected to be found in the returned error's chain
+		wantCause error
 	}{
 		{
 			name: "failed executing command",
@@ -72,6 +75,15 @@ func Test_s3fs_Mount(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name:      "command killed because context was cancelled",
+			cancelled: true,
+			run: func(cmd *exec.Cmd) (string, string, error) {
+				return "", "", errors.New("signal: killed")
+			},
+			wantErr:   true,
+			wantCause: context.Canceled,
+		},
 		{
 			name: "success",
 			run: func(cmd *exec.Cmd) (string, string, error) {
@@ -84,9 +96,164 @@ func Test_s3fs_Mount(t *testing.T) {
 			s := s3fs{
 				run: tt.run,
 			}
-			if err := s.Mount(tt.mountPath, tt.bucket, tt.accessKey, tt.secretKey, tt.readonly); (err != nil) != tt.wantErr {
-				t.Errorf("s3fs.Mount() error = %v, wantErr %v", err, tt.wantErr)
+			ctx, cancel := context.WithCancel(context.TODO())
+			defer cancel()
+			if tt.cancelled {
+				cancel()
+			}
+			err := s.Mount(ctx, tt.mountPath, tt.volume)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("s3fs.Mount() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantCause != nil && !errors.Is(err, tt.wantCause) {
+				t.Errorf("s3fs.Mount() error = %v, want cause %v", err, tt.wantCause)
 			}
 		})
 	}
 }
+
+func Test_s3fs_Mount_args(t *testing.T) {
+	tests := []struct {
+		name   string
+		s      s3fs
+		volume Volume
+		want   []string
+		// wantEnv is an environment variable the command must be run with
+		wantEnv string
+	}{
+		{
+			name:   "defaults",
+			s:      s3fs{path: "s3fs"},
+			volume: Volume{Bucket: "some-bucket"},
+			want:   []string{"s3fs", "some-bucket", "/some/path"},
+		},
+		{
+			name:   "custom endpoint, read only",
+			s:      s3fs{path: "s3fs"},
+			volume: Volume{Bucket: "some-bucket", Endpoint: "https://minio.example.com", PathStyle: true, Readonly: true},
+			want:   []string{"s3fs", "some-bucket", "/some/path", "-o", "url=https://minio.example.com", "-o", "use_path_request_style", "-o", "ro"},
+		},
+		{
+			name:   "cache",
+			s:      s3fs{path: "s3fs", minFreeDiskMB: 1024},
+			volume: Volume{Bucket: "some-bucket", CacheDir: "/var/cache/csi-s3/some-volume"},
+			want:   []string{"s3fs", "some-bucket", "/some/path", "-o", "use_cache=/var/cache/csi-s3/some-volume", "-o", "ensure_diskfree=1024"},
+		},
+		{
+			name:   "prefix",
+			s:      s3fs{path: "s3fs"},
+			volume: Volume{Bucket: "some-bucket", Prefix: "/some/prefix/"},
+			want:   []string{"s3fs", "some-bucket:/some/prefix", "/some/path"},
+		},
+		{
+			name:   "sse s3",
+			s:      s3fs{path: "s3fs"},
+			volume: Volume{Bucket: "some-bucket", SSE: SSES3},
+			want:   []string{"s3fs", "some-bucket", "/some/path", "-o", "use_sse"},
+		},
+		{
+			name:   "sse kms with a key",
+			s:      s3fs{path: "s3fs"},
+			volume: Volume{Bucket: "some-bucket", SSE: SSEKMS, SSEKMSKeyID: "some-key-id"},
+			want:   []string{"s3fs", "some-bucket", "/some/path", "-o", "use_sse=kmsid:some-key-id"},
+		},
+		{
+			name:    "sse c",
+			s:       s3fs{path: "s3fs"},
+			volume:  Volume{Bucket: "some-bucket", SSE: SSEC, SSECustomerKey: "some-customer-key"},
+			want:    []string{"s3fs", "some-bucket", "/some/path", "-o", "use_sse=custom"},
+			wantEnv: "AWSSSECKEYS=some-customer-key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got, env []string
+			tt.s.run = func(cmd *exec.Cmd) (string, string, error) {
+				got, env = cmd.Args, cmd.Env
+				return "", "", nil
+			}
+			if err := tt.s.Mount(context.TODO(), "/some/path", tt.volume); err != nil {
+				t.Fatalf("s3fs.Mount() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("s3fs.Mount() ran %v, want %v", got, tt.want)
+			}
+			if tt.wantEnv != "" && !contains(env, tt.wantEnv) {
+				t.Errorf("s3fs.Mount() ran without %s in its environment", tt.wantEnv)
+			}
+		})
+	}
+}
+
+func Test_s3fs_Validate(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name    string
+		volume  Volume
+		wantErr bool
+	}{
+		{
+			name:   "no encryption",
+			volume: Volume{Bucket: "some-bucket"},
+		},
+		{
+			name:   "sse kms with a key",
+			volume: Volume{Bucket: "some-bucket", SSE: SSEKMS, SSEKMSKeyID: "some-key-id"},
+		},
+		{
+			name:   "sse c",
+			volume: Volume{Bucket: "some-bucket", SSE: SSEC, SSECustomerKey: key},
+		},
+		{
+			name:    "unknown encryption",
+			volume:  Volume{Bucket: "some-bucket", SSE: "aes"},
+			wantErr: true,
+		},
+		{
+			name:    "sse kms without a key",
+			volume:  Volume{Bucket: "some-bucket", SSE: SSEKMS},
+			wantErr: true,
+		},
+		{
+			name:    "KMS key without sse kms",
+			volume:  Volume{Bucket: "some-bucket", SSE: SSES3, SSEKMSKeyID: "some-key-id"},
+			wantErr: true,
+		},
+		{
+			name:    "sse c without a customer key",
+			volume:  Volume{Bucket: "some-bucket", SSE: SSEC},
+			wantErr: true,
+		},
+		{
+			name:    "customer key without sse c",
+			volume:  Volume{Bucket: "some-bucket", SSECustomerKey: key},
+			wantErr: true,
+		},
+		{
+			name:    "customer key of wrong length",
+			volume:  Volume{Bucket: "some-bucket", SSE: SSEC, SSECustomerKey: base64.StdEncoding.EncodeToString(make([]byte, 16))},
+			wantErr: true,
+		},
+		{
+			name:    "sse kms over HTTP",
+			volume:  Volume{Bucket: "some-bucket", Endpoint: "http://minio:9000", SSE: SSEKMS, SSEKMSKeyID: "some-key-id"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := (s3fs{}).Validate(tt.volume); (err != nil) != tt.wantErr {
+				t.Errorf("s3fs.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func contains(s []string, v string) bool {
+	for _, e := range s {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
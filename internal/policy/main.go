@@ -0,0 +1,157 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	// Allow lets requests matching a rule through
+	Allow = "allow"
+	// Deny rejects requests matching a rule
+	Deny = "deny"
+
+	// ReadOnly is the access mode of volumes that are published or created read only
+	ReadOnly = "read-only"
+	// ReadWrite is the access mode of all other volumes
+	ReadWrite = "read-write"
+)
+
+// Policy decides which requests for buckets are allowed.
+// Rules are evaluated in order and the first rule that matches a request decides it
+type Policy struct {
+	Rules []Rule `json:"rules"`
+	// Default decides requests that match no rule, one of allow, deny. Defaults to deny if there are rules
+	Default string `json:"default"`
+}
+
+// Rule matches requests whose fields match all of its selectors. An empty selector matches any value
+type Rule struct {
+	// Name identifies the rule in errors
+	Name string `json:"name"`
+	// Effect is one of allow, deny
+	Effect string `json:"effect"`
+	// Namespaces of pods or PVCs
+	Namespaces []string `json:"namespaces"`
+	// ServiceAccounts of pods. Requests without a service account, such as CreateVolume, do not match rules that list any
+	ServiceAccounts []string `json:"serviceAccounts"`
+	// Buckets are patterns as in path.Match, i.e team-a-*
+	Buckets []string `json:"buckets"`
+	// Prefixes are patterns of the key prefix within the bucket, as in path.Match. A pattern also matches the prefixes
+	// under those it matches. The whole bucket is the empty prefix
+	Prefixes []string `json:"prefixes"`
+	// AccessModes are read-only, read-write
+	AccessModes []string `json:"accessModes"`
+}
+
+// Request is a request for a bucket. Fields that are not known are empty
+type Request struct {
+	Namespace      string
+	ServiceAccount string
+	Bucket         string
+	// Prefix has no leading or trailing slashes
+	Prefix     string
+	AccessMode string
+}
+
+// Decision is the result of evaluating a request
+type Decision struct {
+	Allowed bool
+	// Rule is the rule that decided the request, nil if the default did
+	Rule *Rule
+}
+
+// Validate checks that the policy's rules are well formed
+func (p Policy) Validate() error {
+	if p.Default != "" && p.Default != Allow && p.Default != Deny {
+		return fmt.Errorf("unknown default %q, expected one of %s, %s", p.Default, Allow, Deny)
+	}
+	names := make(map[string]bool)
+	for i, r := range p.Rules {
+		if r.Name == "" {
+			return fmt.Errorf("rule %d must have a name", i)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("rule name %s is not unique", r.Name)
+		}
+		names[r.Name] = true
+		if r.Effect != Allow && r.Effect != Deny {
+			return fmt.Errorf("rule %s has unknown effect %q, expected one of %s, %s", r.Name, r.Effect, Allow, Deny)
+		}
+		for _, pattern := range append(append([]string{}, r.Buckets...), r.Prefixes...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %s has malformed pattern %q: %w", r.Name, pattern, err)
+			}
+		}
+		for _, m := range r.AccessModes {
+			if m != ReadOnly && m != ReadWrite {
+				return fmt.Errorf("rule %s has unknown access mode %q, expected one of %s, %s", r.Name, m, ReadOnly, ReadWrite)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate decides req. A policy without rules allows everything unless its default is deny
+func (p Policy) Evaluate(req Request) Decision {
+	for i := range p.Rules {
+		if r := &p.Rules[i]; r.matches(req) {
+			return Decision{Allowed: r.Effect == Allow, Rule: r}
+		}
+	}
+	switch p.Default {
+	case Allow:
+		return Decision{Allowed: true}
+	case Deny:
+		return Decision{}
+	}
+	return Decision{Allowed: len(p.Rules) == 0}
+}
+
+func (r *Rule) matches(req Request) bool {
+	return matchAny(r.Namespaces, req.Namespace, equal) &&
+		matchAny(r.ServiceAccounts, req.ServiceAccount, equal) &&
+		matchAny(r.Buckets, req.Bucket, glob) &&
+		matchAny(r.Prefixes, req.Prefix, prefixGlob) &&
+		matchAny(r.AccessModes, req.AccessMode, equal)
+}
+
+// matchAny returns true if selector is empty or one of its values matches v
+func matchAny(selector []string, v string, match func(string, string) bool) bool {
+	if len(selector) == 0 {
+		return true
+	}
+	for _, s := range selector {
+		if match(s, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func equal(s, v string) bool {
+	// an unknown value matches no selector
+	return v != "" && s == v
+}
+
+func glob(pattern, v string) bool {
+	// patterns have been validated
+	ok, _ := path.Match(pattern, v)
+	return ok
+}
+
+// prefixGlob returns true if pattern matches prefix or one of the directories above it, as mounting a prefix gives
+// access to part of each of those
+func prefixGlob(pattern, prefix string) bool {
+	for {
+		if glob(pattern, prefix) {
+			return true
+		}
+		i := strings.LastIndex(prefix, "/")
+		if i < 0 {
+			return false
+		}
+		prefix = prefix[:i]
+	}
+}
@@ -0,0 +1,160 @@
+package policy
+
+import "testing"
+
+func Test_Policy_Evaluate(t *testing.T) {
+	teamA := Policy{Rules: []Rule{
+		{Name: "no-writes-to-archives", Effect: Deny, Buckets: []string{"*-archive"}, AccessModes: []string{ReadWrite}},
+		{Name: "team-a", Effect: Allow, Namespaces: []string{"team-a"}, Buckets: []string{"team-a-*"}},
+		{Name: "team-a-uploader", Effect: Allow, Namespaces: []string{"team-b"}, ServiceAccounts: []string{"uploader"}, Buckets: []string{"team-a-inbox"}, Prefixes: []string{"team-b/*"}},
+	}}
+	tests := []struct {
+		name        string
+		policy      Policy
+		req         Request
+		wantAllowed bool
+		wantRule    string
+	}{
+		{
+			name:        "no rules allow everything",
+			req:         Request{Namespace: "team-a", Bucket: "some-bucket", AccessMode: ReadWrite},
+			wantAllowed: true,
+		},
+		{
+			name:        "no rules with default deny",
+			policy:      Policy{Default: Deny},
+			req:         Request{Namespace: "team-a", Bucket: "some-bucket", AccessMode: ReadWrite},
+			wantAllowed: false,
+		},
+		{
+			name:        "matching allow rule",
+			policy:      teamA,
+			req:         Request{Namespace: "team-a", Bucket: "team-a-data", AccessMode: ReadWrite},
+			wantAllowed: true,
+			wantRule:    "team-a",
+		},
+		{
+			name:        "the first matching rule decides",
+			policy:      teamA,
+			req:         Request{Namespace: "team-a", Bucket: "team-a-archive", AccessMode: ReadWrite},
+			wantAllowed: false,
+			wantRule:    "no-writes-to-archives",
+		},
+		{
+			name:        "access mode selector",
+			policy:      teamA,
+			req:         Request{Namespace: "team-a", Bucket: "team-a-archive", AccessMode: ReadOnly},
+			wantAllowed: true,
+			wantRule:    "team-a",
+		},
+		{
+			name:        "no matching rule is denied by default",
+			policy:      teamA,
+			req:         Request{Namespace: "team-b", Bucket: "team-a-data", AccessMode: ReadOnly},
+			wantAllowed: false,
+		},
+		{
+			name:        "no matching rule with default allow",
+			policy:      Policy{Rules: teamA.Rules, Default: Allow},
+			req:         Request{Namespace: "team-b", Bucket: "team-b-data", AccessMode: ReadOnly},
+			wantAllowed: true,
+		},
+		{
+			name:        "service account and prefix",
+			policy:      teamA,
+			req:         Request{Namespace: "team-b", ServiceAccount: "uploader", Bucket: "team-a-inbox", Prefix: "team-b/uploads", AccessMode: ReadWrite},
+			wantAllowed: true,
+			wantRule:    "team-a-uploader",
+		},
+		{
+			name:        "prefix patterns match prefixes under those they match",
+			policy:      teamA,
+			req:         Request{Namespace: "team-b", ServiceAccount: "uploader", Bucket: "team-a-inbox", Prefix: "team-b/uploads/2021", AccessMode: ReadWrite},
+			wantAllowed: true,
+			wantRule:    "team-a-uploader",
+		},
+		{
+			name:        "prefix patterns do not match the whole bucket",
+			policy:      teamA,
+			req:         Request{Namespace: "team-b", ServiceAccount: "uploader", Bucket: "team-a-inbox", AccessMode: ReadWrite},
+			wantAllowed: false,
+		},
+		{
+			name:        "unknown service account matches no service account selector",
+			policy:      teamA,
+			req:         Request{Namespace: "team-b", Bucket: "team-a-inbox", Prefix: "team-b/uploads", AccessMode: ReadWrite},
+			wantAllowed: false,
+		},
+		{
+			name:        "unknown namespace matches no namespace selector",
+			policy:      teamA,
+			req:         Request{Bucket: "team-a-data", AccessMode: ReadWrite},
+			wantAllowed: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.policy.Evaluate(tt.req)
+			if got.Allowed != tt.wantAllowed {
+				t.Errorf("Policy.Evaluate() allowed = %v, want %v", got.Allowed, tt.wantAllowed)
+			}
+			var rule string
+			if got.Rule != nil {
+				rule = got.Rule.Name
+			}
+			if rule != tt.wantRule {
+				t.Errorf("Policy.Evaluate() rule = %q, want %q", rule, tt.wantRule)
+			}
+		})
+	}
+}
+
+func Test_Policy_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		wantErr bool
+	}{
+		{
+			name:   "valid",
+			policy: Policy{Default: Allow, Rules: []Rule{{Name: "some-rule", Effect: Deny, Buckets: []string{"some-*"}, AccessModes: []string{ReadWrite}}}},
+		},
+		{
+			name:    "unknown default",
+			policy:  Policy{Default: "audit"},
+			wantErr: true,
+		},
+		{
+			name:    "rule without a name",
+			policy:  Policy{Rules: []Rule{{Effect: Allow}}},
+			wantErr: true,
+		},
+		{
+			name:    "duplicate rule names",
+			policy:  Policy{Rules: []Rule{{Name: "some-rule", Effect: Allow}, {Name: "some-rule", Effect: Deny}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown effect",
+			policy:  Policy{Rules: []Rule{{Name: "some-rule", Effect: "permit"}}},
+			wantErr: true,
+		},
+		{
+			name:    "malformed pattern",
+			policy:  Policy{Rules: []Rule{{Name: "some-rule", Effect: Allow, Prefixes: []string{"team-[a"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown access mode",
+			policy:  Policy{Rules: []Rule{{Name: "some-rule", Effect: Allow, AccessModes: []string{"ReadWriteOnce"}}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Policy.Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,616 @@
+package s3test
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	xmlns           = "http://s3.amazonaws.com/doc/2006-03-01/"
+	timeFormat      = "2006-01-02T15:04:05.000Z"
+	versioningOn    = "Enabled"
+	versioningOff   = "Suspended"
+	nullVersionID   = "null"
+	defaultMaxKeys  = 1000
+	maxBucketLength = 63
+)
+
+// configurations are the bucket sub-resources, by their query parameter, that are stored as they are sent without being interpreted
+var configurations = map[string]struct {
+	// put and get are the names of the operations
+	put, get string
+	// notFound is the error code returned when the configuration has not been set
+	notFound string
+}{
+	"encryption":        {"PutBucketEncryption", "GetBucketEncryption", "ServerSideEncryptionConfigurationNotFoundError"},
+	"lifecycle":         {"PutBucketLifecycleConfiguration", "GetBucketLifecycleConfiguration", "NoSuchLifecycleConfiguration"},
+	"object-lock":       {"PutObjectLockConfiguration", "GetObjectLockConfiguration", "ObjectLockConfigurationNotFoundError"},
+	"publicAccessBlock": {"PutPublicAccessBlock", "GetPublicAccessBlock", "NoSuchPublicAccessBlockConfiguration"},
+}
+
+type bucket struct {
+	name    string
+	region  string
+	created time.Time
+	tags    map[string]string
+	// versioning is empty if it has never been enabled
+	versioning string
+	// objectLock can only be enabled when the bucket is created
+	objectLock bool
+	// configurations holds the XML documents of sub-resources, by their query parameter
+	configurations map[string][]byte
+	// objects holds versions of each key, oldest first
+	objects map[string][]*object
+	uploads map[string]*upload
+}
+
+func newBucket(name, region string) *bucket {
+	return &bucket{
+		name:           name,
+		region:         region,
+		created:        time.Now().UTC(),
+		objects:        make(map[string][]*object),
+		uploads:        make(map[string]*upload),
+		configurations: make(map[string][]byte),
+	}
+}
+
+// put stores o as the current version of its key
+func (b *bucket) put(o *object) {
+	versions := b.objects[o.key]
+	if b.versioning == versioningOn {
+		o.versionID = newID()
+	} else {
+		// without versioning the null version is replaced
+		o.versionID = nullVersionID
+		for i, v := range versions {
+			if v.versionID == nullVersionID {
+				versions = append(versions[:i:i], versions[i+1:]...)
+				break
+			}
+		}
+	}
+	b.objects[o.key] = append(versions, o)
+}
+
+// current returns the current version of key, nil if it does not exist or is deleted
+func (b *bucket) current(key string) *object {
+	versions := b.objects[key]
+	if len(versions) == 0 || versions[len(versions)-1].deleteMarker {
+		return nil
+	}
+	return versions[len(versions)-1]
+}
+
+// version returns the given version of key
+func (b *bucket) version(key, versionID string) *object {
+	for _, v := range b.objects[key] {
+		if v.versionID == versionID {
+			return v
+		}
+	}
+	return nil
+}
+
+// remove deletes key the way DeleteObject does and returns the version id of the created delete marker or the deleted version
+func (b *bucket) remove(key, versionID string) (string, bool) {
+	versions := b.objects[key]
+	if versionID != "" {
+		for i, v := range versions {
+			if v.versionID == versionID {
+				b.setVersions(key, append(versions[:i:i], versions[i+1:]...))
+				return versionID, v.deleteMarker
+			}
+		}
+		return versionID, false
+	}
+	if b.versioning == "" {
+		delete(b.objects, key)
+		return "", false
+	}
+	marker := &object{key: key, deleteMarker: true, modified: time.Now().UTC()}
+	b.put(marker)
+	return marker.versionID, true
+}
+
+func (b *bucket) setVersions(key string, versions []*object) {
+	if len(versions) == 0 {
+		delete(b.objects, key)
+		return
+	}
+	b.objects[key] = versions
+}
+
+func (b *bucket) empty() bool {
+	return len(b.objects) == 0 && len(b.uploads) == 0
+}
+
+// sortedKeys returns keys that have a current version and start with prefix, sorted
+func (b *bucket) sortedKeys(prefix string) []string {
+	var keys []string
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) && b.current(k) != nil {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *Server) listBuckets(w http.ResponseWriter, r *http.Request, _, _ string) error {
+	type bucketXML struct {
+		Name         string `xml:"Name"`
+		CreationDate string `xml:"CreationDate"`
+	}
+	resp := struct {
+		XMLName xml.Name    `xml:"ListAllMyBucketsResult"`
+		Xmlns   string      `xml:"xmlns,attr"`
+		Buckets []bucketXML `xml:"Buckets>Bucket"`
+	}{Xmlns: xmlns}
+	var names []string
+	for n := range s.buckets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	for _, n := range names {
+		resp.Buckets = append(resp.Buckets, bucketXML{Name: n, CreationDate: s.buckets[n].created.Format(timeFormat)})
+	}
+	writeXML(w, http.StatusOK, resp)
+	return nil
+}
+
+func (s *Server) createBucket(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	if len(name) < 3 || len(name) > maxBucketLength || strings.ToLower(name) != name {
+		return &Error{Code: "InvalidBucketName", Message: "The specified bucket is not valid.", Resource: name, Status: http.StatusBadRequest}
+	}
+	if _, ok := s.buckets[name]; ok {
+		return &Error{Code: "BucketAlreadyOwnedByYou", Message: "Your previous request to create the named bucket succeeded and you already own it.", Resource: name, Status: http.StatusConflict}
+	}
+	region := s.region
+	if r.ContentLength != 0 {
+		var c struct {
+			LocationConstraint string `xml:"LocationConstraint"`
+		}
+		if err := decodeXML(r, &c); err != nil {
+			return err
+		}
+		if c.LocationConstraint != "" {
+			region = c.LocationConstraint
+		}
+	}
+	// a bucket can only be created in the region that the request is signed for
+	if signed := signingRegion(r); signed != "" && signed != region {
+		return &Error{Code: "IllegalLocationConstraintException", Message: fmt.Sprintf("The %s location constraint is incompatible for the region specific endpoint this request was sent to.", region), Resource: name, Status: http.StatusBadRequest}
+	}
+	b := newBucket(name, region)
+	// object lock requires versioning, which is enabled with it
+	if r.Header.Get("x-amz-bucket-object-lock-enabled") == "true" {
+		b.objectLock, b.versioning = true, versioningOn
+	}
+	s.buckets[name] = b
+	w.Header().Set("Location", "/"+name)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) headBucket(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("x-amz-bucket-region", b.region)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) deleteBucket(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	if !b.empty() {
+		return &Error{Code: "BucketNotEmpty", Message: "The bucket you tried to delete is not empty", Resource: name, Status: http.StatusConflict}
+	}
+	delete(s.buckets, name)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) getBucketLocation(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	// buckets in us-east-1 have an empty location constraint
+	location := b.region
+	if location == defaultRegion {
+		location = ""
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"LocationConstraint"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:",chardata"`
+	}{Xmlns: xmlns, Location: location})
+	return nil
+}
+
+func (s *Server) putBucketTagging(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	tags, err := decodeTagging(r)
+	if err != nil {
+		return err
+	}
+	b.tags = tags
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) getBucketTagging(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	if len(b.tags) == 0 {
+		return &Error{Code: "NoSuchTagSet", Message: "The TagSet does not exist", Resource: name, Status: http.StatusNotFound}
+	}
+	writeXML(w, http.StatusOK, encodeTagging(b.tags))
+	return nil
+}
+
+func (s *Server) deleteBucketTagging(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	b.tags = nil
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) putBucketVersioning(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	var c struct {
+		Status string `xml:"Status"`
+	}
+	if err := decodeXML(r, &c); err != nil {
+		return err
+	}
+	if c.Status != versioningOn && c.Status != versioningOff {
+		return &Error{Code: "IllegalVersioningConfigurationException", Message: "The versioning status must be Enabled or Suspended", Status: http.StatusBadRequest}
+	}
+	b.versioning = c.Status
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) getBucketVersioning(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name `xml:"VersioningConfiguration"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Status  string   `xml:"Status,omitempty"`
+	}{Xmlns: xmlns, Status: b.versioning})
+	return nil
+}
+
+// putBucketConfiguration implements the put operations of configurations
+func (s *Server) putBucketConfiguration(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	sub := configuration(r)
+	if sub == "object-lock" && !b.objectLock {
+		return &Error{Code: "InvalidBucketState", Message: "Object Lock configuration cannot be enabled on existing buckets", Resource: name, Status: http.StatusConflict}
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return errMalformedXML(err)
+	}
+	b.configurations[sub] = data
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// getBucketConfiguration implements the get operations of configurations
+func (s *Server) getBucketConfiguration(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	sub := configuration(r)
+	data, ok := b.configurations[sub]
+	if !ok {
+		return &Error{Code: configurations[sub].notFound, Message: "The " + sub + " configuration does not exist", Resource: name, Status: http.StatusNotFound}
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	return nil
+}
+
+// configuration returns the configuration sub-resource that the request is for, empty if none
+func configuration(r *http.Request) string {
+	for sub := range configurations {
+		if _, ok := r.URL.Query()[sub]; ok {
+			return sub
+		}
+	}
+	return ""
+}
+
+type objectXML struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int    `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type prefixXML struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjects implements both ListObjects and ListObjectsV2
+func (s *Server) listObjects(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := defaultMaxKeys
+	if mk := q.Get("max-keys"); mk != "" {
+		if maxKeys, err = strconv.Atoi(mk); err != nil || maxKeys < 0 {
+			return &Error{Code: "InvalidArgument", Message: "max-keys must be a non-negative integer", Status: http.StatusBadRequest}
+		}
+	}
+	marker := q.Get("marker")
+	if v2 {
+		marker = q.Get("start-after")
+		if token := q.Get("continuation-token"); token != "" {
+			t, err := base64.StdEncoding.DecodeString(token)
+			if err != nil {
+				return &Error{Code: "InvalidArgument", Message: "The continuation token provided is incorrect", Status: http.StatusBadRequest}
+			}
+			marker = string(t)
+		}
+	}
+
+	var contents []objectXML
+	var prefixes []prefixXML
+	seen := make(map[string]bool)
+	last, truncated := "", false
+	for _, k := range b.sortedKeys(prefix) {
+		// keys under a common prefix that has already been returned are skipped
+		if k <= marker || (delimiter != "" && strings.HasSuffix(marker, delimiter) && strings.HasPrefix(k, marker)) {
+			continue
+		}
+		entry, isPrefix := k, false
+		if delimiter != "" {
+			if i := strings.Index(k[len(prefix):], delimiter); i >= 0 {
+				entry, isPrefix = k[:len(prefix)+i+len(delimiter)], true
+			}
+		}
+		if seen[entry] {
+			continue
+		}
+		if len(contents)+len(prefixes) >= maxKeys {
+			truncated = true
+			break
+		}
+		seen[entry] = true
+		last = entry
+		if isPrefix {
+			prefixes = append(prefixes, prefixXML{entry})
+			continue
+		}
+		o := b.current(k)
+		contents = append(contents, objectXML{Key: k, LastModified: o.modified.Format(timeFormat), ETag: o.etag, Size: len(o.data), StorageClass: "STANDARD"})
+	}
+
+	if v2 {
+		resp := struct {
+			XMLName               xml.Name    `xml:"ListBucketResult"`
+			Xmlns                 string      `xml:"xmlns,attr"`
+			Name                  string      `xml:"Name"`
+			Prefix                string      `xml:"Prefix"`
+			Delimiter             string      `xml:"Delimiter,omitempty"`
+			MaxKeys               int         `xml:"MaxKeys"`
+			KeyCount              int         `xml:"KeyCount"`
+			IsTruncated           bool        `xml:"IsTruncated"`
+			ContinuationToken     string      `xml:"ContinuationToken,omitempty"`
+			NextContinuationToken string      `xml:"NextContinuationToken,omitempty"`
+			StartAfter            string      `xml:"StartAfter,omitempty"`
+			Contents              []objectXML `xml:"Contents"`
+			CommonPrefixes        []prefixXML `xml:"CommonPrefixes"`
+		}{
+			Xmlns: xmlns, Name: name, Prefix: prefix, Delimiter: delimiter, MaxKeys: maxKeys,
+			KeyCount: len(contents) + len(prefixes), IsTruncated: truncated,
+			ContinuationToken: q.Get("continuation-token"), StartAfter: q.Get("start-after"),
+			Contents: contents, CommonPrefixes: prefixes,
+		}
+		if truncated {
+			resp.NextContinuationToken = base64.StdEncoding.EncodeToString([]byte(last))
+		}
+		writeXML(w, http.StatusOK, resp)
+		return nil
+	}
+	resp := struct {
+		XMLName        xml.Name    `xml:"ListBucketResult"`
+		Xmlns          string      `xml:"xmlns,attr"`
+		Name           string      `xml:"Name"`
+		Prefix         string      `xml:"Prefix"`
+		Marker         string      `xml:"Marker"`
+		NextMarker     string      `xml:"NextMarker,omitempty"`
+		Delimiter      string      `xml:"Delimiter,omitempty"`
+		MaxKeys        int         `xml:"MaxKeys"`
+		IsTruncated    bool        `xml:"IsTruncated"`
+		Contents       []objectXML `xml:"Contents"`
+		CommonPrefixes []prefixXML `xml:"CommonPrefixes"`
+	}{
+		Xmlns: xmlns, Name: name, Prefix: prefix, Marker: marker, Delimiter: delimiter, MaxKeys: maxKeys,
+		IsTruncated: truncated, Contents: contents, CommonPrefixes: prefixes,
+	}
+	if truncated {
+		resp.NextMarker = last
+	}
+	writeXML(w, http.StatusOK, resp)
+	return nil
+}
+
+// listObjectVersions returns all versions and delete markers of keys with the requested prefix. Pagination is not supported
+func (s *Server) listObjectVersions(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	type versionXML struct {
+		Key          string `xml:"Key"`
+		VersionID    string `xml:"VersionId"`
+		IsLatest     bool   `xml:"IsLatest"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag,omitempty"`
+		Size         int    `xml:"Size,omitempty"`
+	}
+	type entryXML struct {
+		XMLName xml.Name
+		versionXML
+	}
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for k := range b.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var entries []entryXML
+	for _, k := range keys {
+		versions := b.objects[k]
+		// versions are listed newest first
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			e := entryXML{
+				XMLName:    xml.Name{Local: "Version"},
+				versionXML: versionXML{Key: k, VersionID: v.versionID, IsLatest: i == len(versions)-1, LastModified: v.modified.Format(timeFormat)},
+			}
+			if v.deleteMarker {
+				e.XMLName.Local = "DeleteMarker"
+			} else {
+				e.ETag, e.Size = v.etag, len(v.data)
+			}
+			entries = append(entries, e)
+		}
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName     xml.Name   `xml:"ListVersionsResult"`
+		Xmlns       string     `xml:"xmlns,attr"`
+		Name        string     `xml:"Name"`
+		Prefix      string     `xml:"Prefix"`
+		IsTruncated bool       `xml:"IsTruncated"`
+		Entries     []entryXML `xml:",any"`
+	}{Xmlns: xmlns, Name: name, Prefix: prefix, Entries: entries})
+	return nil
+}
+
+func (s *Server) deleteObjects(w http.ResponseWriter, r *http.Request, name, _ string) error {
+	b, err := s.bucket(name)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Quiet   bool `xml:"Quiet"`
+		Objects []struct {
+			Key       string `xml:"Key"`
+			VersionID string `xml:"VersionId"`
+		} `xml:"Object"`
+	}
+	if err := decodeXML(r, &req); err != nil {
+		return err
+	}
+	type deletedXML struct {
+		Key                   string `xml:"Key"`
+		VersionID             string `xml:"VersionId,omitempty"`
+		DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+		DeleteMarkerVersionID string `xml:"DeleteMarkerVersionId,omitempty"`
+	}
+	var deleted []deletedXML
+	for _, o := range req.Objects {
+		versionID, marker := b.remove(o.Key, o.VersionID)
+		d := deletedXML{Key: o.Key, VersionID: o.VersionID, DeleteMarker: marker}
+		if marker && o.VersionID == "" {
+			d.DeleteMarkerVersionID = versionID
+		}
+		deleted = append(deleted, d)
+	}
+	if req.Quiet {
+		deleted = nil
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName xml.Name     `xml:"DeleteResult"`
+		Xmlns   string       `xml:"xmlns,attr"`
+		Deleted []deletedXML `xml:"Deleted"`
+	}{Xmlns: xmlns, Deleted: deleted})
+	return nil
+}
+
+type taggingXML struct {
+	XMLName xml.Name `xml:"Tagging"`
+	Xmlns   string   `xml:"xmlns,attr,omitempty"`
+	Tags    []struct {
+		Key   string `xml:"Key"`
+		Value string `xml:"Value"`
+	} `xml:"TagSet>Tag"`
+}
+
+func decodeTagging(r *http.Request) (map[string]string, error) {
+	var t taggingXML
+	if err := decodeXML(r, &t); err != nil {
+		return nil, err
+	}
+	tags := make(map[string]string, len(t.Tags))
+	for _, tag := range t.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	return tags, nil
+}
+
+func encodeTagging(tags map[string]string) taggingXML {
+	t := taggingXML{Xmlns: xmlns}
+	var keys []string
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		t.Tags = append(t.Tags, struct {
+			Key   string `xml:"Key"`
+			Value string `xml:"Value"`
+		}{k, tags[k]})
+	}
+	return t
+}
@@ -0,0 +1,481 @@
+package s3test
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultRegion = "us-east-1"
+
+// Server is an in-process S3 compatible HTTP server that keeps buckets and objects in memory.
+// Buckets are addressed path-style (http://<server>/<bucket>/<key>), so clients must be configured to use path-style requests.
+// Request signatures are not verified, but as on AWS, requests for a bucket that are signed for another region than the bucket's are rejected
+type Server struct {
+	srv       *httptest.Server
+	region    string
+	accessKey string
+
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	faults   []*Fault
+	requests []Request
+}
+
+type option func(*Server)
+
+// WithRegion sets the region of buckets created without a location constraint. Defaults to us-east-1
+func WithRegion(region string) option {
+	return func(s *Server) {
+		s.region = region
+	}
+}
+
+// WithAccessKey makes the server reject requests that were not signed with accessKey with InvalidAccessKeyId
+func WithAccessKey(accessKey string) option {
+	return func(s *Server) {
+		s.accessKey = accessKey
+	}
+}
+
+// New starts a Server. It must be closed with Close
+func New(opts ...option) *Server {
+	s := &Server{region: defaultRegion, buckets: make(map[string]*bucket)}
+	for _, o := range opts {
+		o(s)
+	}
+	s.srv = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// URL returns the endpoint of the server, i.e http://127.0.0.1:34567
+func (s *Server) URL() string {
+	return s.srv.URL
+}
+
+// Region returns the default region of the server
+func (s *Server) Region() string {
+	return s.region
+}
+
+// Close shuts down the server
+func (s *Server) Close() {
+	s.srv.Close()
+}
+
+// Fault makes requests matching its Operation, Bucket and Key slow or fail. Empty fields match any request
+type Fault struct {
+	// Operation is the S3 API operation, i.e PutObject, ListObjectsV2
+	Operation string
+	Bucket    string
+	Key       string
+	// Delay is added before the request is handled. The delay ends early if the client gives up
+	Delay time.Duration
+	// Code is the S3 error code returned, i.e SlowDown. If empty, the request is handled after Delay
+	Code string
+	// Status is the HTTP status returned with Code. Defaults to 500
+	Status int
+	// Times is the number of requests the fault applies to. 0 applies it to all matching requests
+	Times int
+}
+
+// Inject adds a fault. Faults are applied in the order they were added, the first matching one wins
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all injected faults
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Request is a request handled by the server
+type Request struct {
+	Operation string
+	Bucket    string
+	Key       string
+}
+
+// Requests returns the requests handled so far, in order
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// CreateBucket creates a bucket in the server's default region
+func (s *Server) CreateBucket(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.buckets[name] = newBucket(name, s.region)
+}
+
+// PutObject creates or replaces an object. The bucket must exist
+func (s *Server) PutObject(bucketName, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return fmt.Errorf("bucket %s does not exist", bucketName)
+	}
+	b.put(&object{key: key, data: data, etag: etag(data), modified: time.Now().UTC()})
+	return nil
+}
+
+// Object returns the data of the current version of an object
+func (s *Server) Object(bucketName, key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, false
+	}
+	o := b.current(key)
+	if o == nil {
+		return nil, false
+	}
+	return o.data, true
+}
+
+// Buckets returns names of all buckets, sorted
+func (s *Server) Buckets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for n := range s.buckets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BucketTags returns the tags of a bucket
+func (s *Server) BucketTags(bucketName string) (map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return nil, false
+	}
+	return copyTags(b.tags), true
+}
+
+// BucketConfiguration returns the XML document of a configuration sub-resource of a bucket, i.e encryption or lifecycle
+func (s *Server) BucketConfiguration(bucketName, subresource string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.buckets[bucketName]
+	if !ok {
+		return "", false
+	}
+	data, ok := b.configurations[subresource]
+	return string(data), ok
+}
+
+// handler handles a request for an operation. It is called with s.mu held
+type handler func(w http.ResponseWriter, r *http.Request, bucket, key string) error
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("x-amz-request-id", newID())
+	bucketName, key := splitPath(r.URL.Path)
+	op, h := s.route(r, bucketName, key)
+
+	s.mu.Lock()
+	s.requests = append(s.requests, Request{Operation: op, Bucket: bucketName, Key: key})
+	f := s.matchFault(op, bucketName, key)
+	s.mu.Unlock()
+
+	if f != nil {
+		if !sleep(r.Context(), f.Delay) {
+			return
+		}
+		if f.Code != "" {
+			status := f.Status
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			writeError(w, r, &Error{Code: f.Code, Message: "injected fault", Status: status})
+			return
+		}
+	}
+	if s.accessKey != "" && !signedWith(r, s.accessKey) {
+		writeError(w, r, &Error{Code: "InvalidAccessKeyId", Message: "The AWS Access Key Id you provided does not exist in our records.", Status: http.StatusForbidden})
+		return
+	}
+	if h == nil {
+		writeError(w, r, &Error{Code: "NotImplemented", Message: fmt.Sprintf("%s %s is not implemented", r.Method, r.URL), Status: http.StatusNotImplemented})
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkRegion(w, r, op, bucketName); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := h(w, r, bucketName, key); err != nil {
+		writeError(w, r, err)
+	}
+}
+
+// checkRegion rejects a signed request for an existing bucket if it was signed for another region than the bucket's.
+// The bucket's region is returned in the x-amz-bucket-region header, as S3 does. GetBucketLocation can be
+// sent to any region. It is called with s.mu held
+func (s *Server) checkRegion(w http.ResponseWriter, r *http.Request, op, bucketName string) error {
+	region := signingRegion(r)
+	b, ok := s.buckets[bucketName]
+	if region == "" || !ok || op == "CreateBucket" || op == "GetBucketLocation" || region == b.region {
+		return nil
+	}
+	w.Header().Set("x-amz-bucket-region", b.region)
+	return &Error{Code: "AuthorizationHeaderMalformed", Message: fmt.Sprintf("The authorization header is malformed; the region '%s' is wrong; expecting '%s'", region, b.region), Resource: bucketName, Status: http.StatusBadRequest}
+}
+
+// route returns the S3 API operation of r and its handler
+func (s *Server) route(r *http.Request, bucketName, key string) (string, handler) {
+	q := r.URL.Query()
+	has := func(k string) bool { _, ok := q[k]; return ok }
+	switch {
+	case bucketName == "":
+		if r.Method == http.MethodGet {
+			return "ListBuckets", s.listBuckets
+		}
+	case key == "":
+		switch r.Method {
+		case http.MethodPut:
+			switch {
+			case has("tagging"):
+				return "PutBucketTagging", s.putBucketTagging
+			case has("versioning"):
+				return "PutBucketVersioning", s.putBucketVersioning
+			case configuration(r) != "":
+				return configurations[configuration(r)].put, s.putBucketConfiguration
+			default:
+				return "CreateBucket", s.createBucket
+			}
+		case http.MethodGet:
+			switch {
+			case has("tagging"):
+				return "GetBucketTagging", s.getBucketTagging
+			case has("versioning"):
+				return "GetBucketVersioning", s.getBucketVersioning
+			case configuration(r) != "":
+				return configurations[configuration(r)].get, s.getBucketConfiguration
+			case has("location"):
+				return "GetBucketLocation", s.getBucketLocation
+			case has("versions"):
+				return "ListObjectVersions", s.listObjectVersions
+			case q.Get("list-type") == "2":
+				return "ListObjectsV2", s.listObjects
+			default:
+				return "ListObjects", s.listObjects
+			}
+		case http.MethodHead:
+			return "HeadBucket", s.headBucket
+		case http.MethodDelete:
+			if has("tagging") {
+				return "DeleteBucketTagging", s.deleteBucketTagging
+			}
+			return "DeleteBucket", s.deleteBucket
+		case http.MethodPost:
+			if has("delete") {
+				return "DeleteObjects", s.deleteObjects
+			}
+		}
+	default:
+		switch r.Method {
+		case http.MethodPut:
+			switch {
+			case has("tagging"):
+				return "PutObjectTagging", s.putObjectTagging
+			case has("uploadId") && r.Header.Get("x-amz-copy-source") != "":
+				return "UploadPartCopy", s.uploadPartCopy
+			case has("uploadId"):
+				return "UploadPart", s.uploadPart
+			case r.Header.Get("x-amz-copy-source") != "":
+				return "CopyObject", s.copyObject
+			default:
+				return "PutObject", s.putObject
+			}
+		case http.MethodGet:
+			if has("tagging") {
+				return "GetObjectTagging", s.getObjectTagging
+			}
+			return "GetObject", s.getObject
+		case http.MethodHead:
+			return "HeadObject", s.getObject
+		case http.MethodDelete:
+			switch {
+			case has("tagging"):
+				return "DeleteObjectTagging", s.deleteObjectTagging
+			case has("uploadId"):
+				return "AbortMultipartUpload", s.abortMultipartUpload
+			default:
+				return "DeleteObject", s.deleteObject
+			}
+		case http.MethodPost:
+			switch {
+			case has("uploads"):
+				return "CreateMultipartUpload", s.createMultipartUpload
+			case has("uploadId"):
+				return "CompleteMultipartUpload", s.completeMultipartUpload
+			}
+		}
+	}
+	return "Unknown", nil
+}
+
+func (s *Server) matchFault(op, bucketName, key string) *Fault {
+	for i, f := range s.faults {
+		if (f.Operation != "" && f.Operation != op) || (f.Bucket != "" && f.Bucket != bucketName) || (f.Key != "" && f.Key != key) {
+			continue
+		}
+		if f.Times > 0 {
+			f.Times--
+			if f.Times == 0 {
+				s.faults = append(s.faults[:i:i], s.faults[i+1:]...)
+			}
+		}
+		return f
+	}
+	return nil
+}
+
+// bucket returns the named bucket or NoSuchBucket error
+func (s *Server) bucket(name string) (*bucket, error) {
+	b, ok := s.buckets[name]
+	if !ok {
+		return nil, errNoSuchBucket(name)
+	}
+	return b, nil
+}
+
+// Error is an S3 error response
+type Error struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource,omitempty"`
+	Status   int      `xml:"-"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func errNoSuchBucket(name string) *Error {
+	return &Error{Code: "NoSuchBucket", Message: "The specified bucket does not exist", Resource: name, Status: http.StatusNotFound}
+}
+
+func errNoSuchKey(key string) *Error {
+	return &Error{Code: "NoSuchKey", Message: "The specified key does not exist.", Resource: key, Status: http.StatusNotFound}
+}
+
+func errMalformedXML(err error) *Error {
+	return &Error{Code: "MalformedXML", Message: fmt.Sprintf("The XML you provided was not well-formed: %v", err), Status: http.StatusBadRequest}
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	e, ok := err.(*Error)
+	if !ok {
+		e = &Error{Code: "InternalError", Message: err.Error(), Status: http.StatusInternalServerError}
+	}
+	// responses to HEAD requests have no body
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.Status)
+		return
+	}
+	writeXML(w, e.Status, e)
+}
+
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(v)
+}
+
+func decodeXML(r *http.Request, v interface{}) error {
+	if err := xml.NewDecoder(r.Body).Decode(v); err != nil {
+		return errMalformedXML(err)
+	}
+	return nil
+}
+
+// splitPath splits a path-style request path into bucket and key
+func splitPath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+	i := strings.Index(path, "/")
+	if i < 0 {
+		return path, ""
+	}
+	return path[:i], path[i+1:]
+}
+
+// signedWith checks whether the SigV4 credential of the request (in the Authorization header or a presigned URL) is for accessKey
+func signedWith(r *http.Request, accessKey string) bool {
+	if cred := r.URL.Query().Get("X-Amz-Credential"); cred != "" {
+		return strings.HasPrefix(cred, accessKey+"/")
+	}
+	return strings.Contains(r.Header.Get("Authorization"), "Credential="+accessKey+"/")
+}
+
+// signingRegion returns the region in the SigV4 credential scope of the request, empty if it is not signed
+func signingRegion(r *http.Request) string {
+	cred := r.URL.Query().Get("X-Amz-Credential")
+	if cred == "" {
+		auth := r.Header.Get("Authorization")
+		i := strings.Index(auth, "Credential=")
+		if i < 0 {
+			return ""
+		}
+		cred = strings.SplitN(auth[i+len("Credential="):], ",", 2)[0]
+	}
+	// <access key>/<date>/<region>/<service>/aws4_request
+	parts := strings.Split(cred, "/")
+	if len(parts) != 5 {
+		return ""
+	}
+	return parts[2]
+}
+
+// sleep waits for d, returning false if ctx is done first
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func copyTags(tags map[string]string) map[string]string {
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
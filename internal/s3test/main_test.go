@@ -0,0 +1,454 @@
+package s3test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func newClient(t *testing.T, s *Server, accessKey string) *s3.S3 {
+	t.Helper()
+	sess, err := session.NewSession(&aws.Config{
+		Endpoint:         aws.String(s.URL()),
+		Region:           aws.String(s.Region()),
+		Credentials:      credentials.NewStaticCredentials(accessKey, "some-secret", ""),
+		S3ForcePathStyle: aws.Bool(true),
+		MaxRetries:       aws.Int(0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s3.New(sess)
+}
+
+func errCode(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	return ""
+}
+
+func TestServer_buckets(t *testing.T) {
+	s := New(WithRegion("eu-west-2"))
+	defer s.Close()
+	c := newClient(t, s, "some-key")
+
+	if _, err := c.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("some-bucket")}); err != nil {
+		t.Fatalf("CreateBucket() error = %v", err)
+	}
+	otherBucket := &s3.CreateBucketInput{
+		Bucket:                    aws.String("other-bucket"),
+		CreateBucketConfiguration: &s3.CreateBucketConfiguration{LocationConstraint: aws.String("ap-south-1")},
+	}
+	if _, err := c.CreateBucket(otherBucket); errCode(err) != "IllegalLocationConstraintException" {
+		t.Errorf("CreateBucket() with the location constraint of another region error = %v, want IllegalLocationConstraintException", err)
+	}
+	south := s3.New(session.Must(session.NewSession(c.Config.Copy(&aws.Config{Region: aws.String("ap-south-1")}))))
+	if _, err := south.CreateBucket(otherBucket); err != nil {
+		t.Fatalf("CreateBucket() with location constraint error = %v", err)
+	}
+	if _, err := c.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("some-bucket")}); errCode(err) != "BucketAlreadyOwnedByYou" {
+		t.Errorf("CreateBucket() for an existing bucket error = %v, want BucketAlreadyOwnedByYou", err)
+	}
+
+	list, err := c.ListBuckets(&s3.ListBucketsInput{})
+	if err != nil {
+		t.Fatalf("ListBuckets() error = %v", err)
+	}
+	if len(list.Buckets) != 2 || *list.Buckets[0].Name != "other-bucket" || *list.Buckets[1].Name != "some-bucket" {
+		t.Errorf("ListBuckets() = %v", list.Buckets)
+	}
+
+	loc, err := c.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: aws.String("other-bucket")})
+	if err != nil || aws.StringValue(loc.LocationConstraint) != "ap-south-1" {
+		t.Errorf("GetBucketLocation() = %v, %v, want ap-south-1", loc, err)
+	}
+
+	if _, err := c.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("some-bucket")}); err != nil {
+		t.Errorf("HeadBucket() error = %v", err)
+	}
+	if _, err := c.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: aws.String("other-bucket")}); errCode(err) != "AuthorizationHeaderMalformed" {
+		t.Errorf("GetBucketTagging() signed for another region than the bucket's error = %v, want AuthorizationHeaderMalformed", err)
+	}
+	if region, err := s3manager.GetBucketRegionWithClient(context.Background(), c, "other-bucket"); err != nil || region != "ap-south-1" {
+		t.Errorf("GetBucketRegion() = %v, %v, want ap-south-1", region, err)
+	}
+	if _, err := c.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("missing-bucket")}); errCode(err) != "NotFound" {
+		t.Errorf("HeadBucket() for a missing bucket error = %v, want NotFound", err)
+	}
+
+	if _, err := c.PutBucketTagging(&s3.PutBucketTaggingInput{
+		Bucket:  aws.String("some-bucket"),
+		Tagging: &s3.Tagging{TagSet: []*s3.Tag{{Key: aws.String("quota"), Value: aws.String("1Gi")}}},
+	}); err != nil {
+		t.Fatalf("PutBucketTagging() error = %v", err)
+	}
+	tags, err := c.GetBucketTagging(&s3.GetBucketTaggingInput{Bucket: aws.String("some-bucket")})
+	if err != nil || len(tags.TagSet) != 1 || *tags.TagSet[0].Key != "quota" || *tags.TagSet[0].Value != "1Gi" {
+		t.Errorf("GetBucketTagging() = %v, %v", tags, err)
+	}
+	if got, _ := s.BucketTags("some-bucket"); !reflect.DeepEqual(got, map[string]string{"quota": "1Gi"}) {
+		t.Errorf("Server.BucketTags() = %v", got)
+	}
+
+	if err := s.PutObject("some-bucket", "some-key", []byte("some data")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("some-bucket")}); errCode(err) != "BucketNotEmpty" {
+		t.Errorf("DeleteBucket() for a non-empty bucket error = %v, want BucketNotEmpty", err)
+	}
+	if _, err := south.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("other-bucket")}); err != nil {
+		t.Errorf("DeleteBucket() error = %v", err)
+	}
+	if got := s.Buckets(); !reflect.DeepEqual(got, []string{"some-bucket"}) {
+		t.Errorf("Server.Buckets() = %v", got)
+	}
+}
+
+func TestServer_bucketConfigurations(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s, "some-key")
+
+	if _, err := c.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String("some-bucket")}); errCode(err) != "ServerSideEncryptionConfigurationNotFoundError" {
+		t.Errorf("GetBucketEncryption() before it is set error = %v, want ServerSideEncryptionConfigurationNotFoundError", err)
+	}
+	if _, err := c.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String("some-bucket"),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{Rules: []*s3.ServerSideEncryptionRule{{
+			ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{SSEAlgorithm: aws.String(s3.ServerSideEncryptionAwsKms), KMSMasterKeyID: aws.String("some-key-id")},
+		}}},
+	}); err != nil {
+		t.Fatalf("PutBucketEncryption() error = %v", err)
+	}
+	enc, err := c.GetBucketEncryption(&s3.GetBucketEncryptionInput{Bucket: aws.String("some-bucket")})
+	if err != nil || aws.StringValue(enc.ServerSideEncryptionConfiguration.Rules[0].ApplyServerSideEncryptionByDefault.KMSMasterKeyID) != "some-key-id" {
+		t.Errorf("GetBucketEncryption() = %v, %v", enc, err)
+	}
+	if got, ok := s.BucketConfiguration("some-bucket", "encryption"); !ok || !strings.Contains(got, "some-key-id") {
+		t.Errorf("Server.BucketConfiguration() = %q, %v", got, ok)
+	}
+
+	lock := &s3.PutObjectLockConfigurationInput{
+		ObjectLockConfiguration: &s3.ObjectLockConfiguration{
+			ObjectLockEnabled: aws.String(s3.ObjectLockEnabledEnabled),
+			Rule:              &s3.ObjectLockRule{DefaultRetention: &s3.DefaultRetention{Mode: aws.String(s3.ObjectLockModeGovernance), Days: aws.Int64(1)}},
+		},
+	}
+	if _, err := c.PutObjectLockConfiguration(lock.SetBucket("some-bucket")); errCode(err) != "InvalidBucketState" {
+		t.Errorf("PutObjectLockConfiguration() for a bucket created without object lock error = %v, want InvalidBucketState", err)
+	}
+	if _, err := c.CreateBucket(&s3.CreateBucketInput{Bucket: aws.String("locked-bucket"), ObjectLockEnabledForBucket: aws.Bool(true)}); err != nil {
+		t.Fatalf("CreateBucket() with object lock error = %v", err)
+	}
+	if _, err := c.PutObjectLockConfiguration(lock.SetBucket("locked-bucket")); err != nil {
+		t.Errorf("PutObjectLockConfiguration() error = %v", err)
+	}
+	v, err := c.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String("locked-bucket")})
+	if err != nil || aws.StringValue(v.Status) != s3.BucketVersioningStatusEnabled {
+		t.Errorf("versioning of a bucket with object lock = %v, %v, want it enabled", v, err)
+	}
+}
+
+func TestServer_objects(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s, "some-key")
+
+	_, err := c.PutObject(&s3.PutObjectInput{
+		Bucket:   aws.String("some-bucket"),
+		Key:      aws.String("dir/some file"),
+		Body:     strings.NewReader("0123456789"),
+		Metadata: map[string]*string{"Owner": aws.String("someone")},
+		Tagging:  aws.String("a=b&c=d"),
+	})
+	if err != nil {
+		t.Fatalf("PutObject() error = %v", err)
+	}
+
+	got, err := c.GetObject(&s3.GetObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("dir/some file"), Range: aws.String("bytes=2-4")})
+	if err != nil {
+		t.Fatalf("GetObject() error = %v", err)
+	}
+	data, _ := ioutil.ReadAll(got.Body)
+	if string(data) != "234" || aws.StringValue(got.Metadata["Owner"]) != "someone" || aws.Int64Value(got.TagCount) != 2 {
+		t.Errorf("GetObject() = %s, metadata %v, tag count %d", data, got.Metadata, aws.Int64Value(got.TagCount))
+	}
+
+	if _, err := c.CopyObject(&s3.CopyObjectInput{
+		Bucket:     aws.String("some-bucket"),
+		Key:        aws.String("copy"),
+		CopySource: aws.String("some-bucket/dir/some file"),
+	}); err != nil {
+		t.Fatalf("CopyObject() error = %v", err)
+	}
+	if data, ok := s.Object("some-bucket", "copy"); !ok || string(data) != "0123456789" {
+		t.Errorf("copied object = %s, %v", data, ok)
+	}
+	tags, err := c.GetObjectTagging(&s3.GetObjectTaggingInput{Bucket: aws.String("some-bucket"), Key: aws.String("copy")})
+	if err != nil || len(tags.TagSet) != 2 {
+		t.Errorf("GetObjectTagging() of the copy = %v, %v", tags, err)
+	}
+
+	if _, err := c.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("missing")}); errCode(err) != "NotFound" {
+		t.Errorf("HeadObject() for a missing key error = %v, want NotFound", err)
+	}
+	if _, err := c.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("copy")}); err != nil {
+		t.Errorf("DeleteObject() error = %v", err)
+	}
+	if _, err := c.GetObject(&s3.GetObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("copy")}); errCode(err) != s3.ErrCodeNoSuchKey {
+		t.Errorf("GetObject() for a deleted key error = %v, want NoSuchKey", err)
+	}
+
+	del, err := c.DeleteObjects(&s3.DeleteObjectsInput{
+		Bucket: aws.String("some-bucket"),
+		Delete: &s3.Delete{Objects: []*s3.ObjectIdentifier{{Key: aws.String("dir/some file")}}},
+	})
+	if err != nil || len(del.Deleted) != 1 {
+		t.Errorf("DeleteObjects() = %v, %v", del, err)
+	}
+	if _, err := c.DeleteBucket(&s3.DeleteBucketInput{Bucket: aws.String("some-bucket")}); err != nil {
+		t.Errorf("DeleteBucket() after deleting all objects error = %v", err)
+	}
+}
+
+func TestServer_listObjects(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	for _, k := range []string{"a", "b/1", "b/2", "c/1", "d"} {
+		s.PutObject("some-bucket", k, []byte(k))
+	}
+	c := newClient(t, s, "some-key")
+
+	tests := []struct {
+		name      string
+		prefix    string
+		delimiter string
+		want      []string
+	}{
+		{
+			name: "all keys",
+			want: []string{"a", "b/1", "b/2", "c/1", "d"},
+		},
+		{
+			name:      "with delimiter",
+			delimiter: "/",
+			want:      []string{"a", "b/", "c/", "d"},
+		},
+		{
+			name:      "with prefix",
+			prefix:    "b/",
+			delimiter: "/",
+			want:      []string{"b/1", "b/2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, maxKeys := range []int64{1, 2, 1000} {
+				var v1, v2 []string
+				err := c.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+					Bucket:    aws.String("some-bucket"),
+					Prefix:    aws.String(tt.prefix),
+					Delimiter: aws.String(tt.delimiter),
+					MaxKeys:   aws.Int64(maxKeys),
+				}, func(page *s3.ListObjectsV2Output, _ bool) bool {
+					v2 = append(v2, entries(page.Contents, page.CommonPrefixes)...)
+					return true
+				})
+				if err != nil {
+					t.Fatalf("ListObjectsV2Pages() error = %v", err)
+				}
+				err = c.ListObjectsPages(&s3.ListObjectsInput{
+					Bucket:    aws.String("some-bucket"),
+					Prefix:    aws.String(tt.prefix),
+					Delimiter: aws.String(tt.delimiter),
+					MaxKeys:   aws.Int64(maxKeys),
+				}, func(page *s3.ListObjectsOutput, _ bool) bool {
+					v1 = append(v1, entries(page.Contents, page.CommonPrefixes)...)
+					return true
+				})
+				if err != nil {
+					t.Fatalf("ListObjectsPages() error = %v", err)
+				}
+				// within a page objects are listed before common prefixes
+				sort.Strings(v1)
+				sort.Strings(v2)
+				if !reflect.DeepEqual(v2, tt.want) || !reflect.DeepEqual(v1, tt.want) {
+					t.Errorf("max keys %d: ListObjectsV2 = %v, ListObjects = %v, want %v", maxKeys, v2, v1, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func entries(contents []*s3.Object, prefixes []*s3.CommonPrefix) []string {
+	var e []string
+	for _, o := range contents {
+		e = append(e, *o.Key)
+	}
+	for _, p := range prefixes {
+		e = append(e, *p.Prefix)
+	}
+	return e
+}
+
+func TestServer_multipart(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s, "some-key")
+
+	data := bytes.Repeat([]byte("0123456789"), 1200*1024)
+	u := s3manager.NewUploaderWithClient(c, func(u *s3manager.Uploader) { u.PartSize = 5 * 1024 * 1024 })
+	if _, err := u.Upload(&s3manager.UploadInput{Bucket: aws.String("some-bucket"), Key: aws.String("big"), Body: bytes.NewReader(data)}); err != nil {
+		t.Fatalf("Upload() error = %v", err)
+	}
+	got, ok := s.Object("some-bucket", "big")
+	if !ok || !bytes.Equal(got, data) {
+		t.Errorf("uploaded object has %d bytes, want %d", len(got), len(data))
+	}
+	var uploadParts int
+	for _, r := range s.Requests() {
+		if r.Operation == "UploadPart" {
+			uploadParts++
+		}
+	}
+	if uploadParts != 3 {
+		t.Errorf("upload used %d parts, want 3", uploadParts)
+	}
+
+	copied, err := c.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("some-bucket"), Key: aws.String("copy")})
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	var parts []*s3.CompletedPart
+	for i, rng := range []string{"bytes=0-9", "bytes=10-29"} {
+		out, err := c.UploadPartCopy(&s3.UploadPartCopyInput{
+			Bucket: aws.String("some-bucket"), Key: aws.String("copy"), UploadId: copied.UploadId, PartNumber: aws.Int64(int64(i + 1)),
+			CopySource: aws.String("some-bucket/big"), CopySourceRange: aws.String(rng),
+		})
+		if err != nil {
+			t.Fatalf("UploadPartCopy() error = %v", err)
+		}
+		parts = append(parts, &s3.CompletedPart{PartNumber: aws.Int64(int64(i + 1)), ETag: out.CopyPartResult.ETag})
+	}
+	if _, err := c.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket: aws.String("some-bucket"), Key: aws.String("copy"), UploadId: copied.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	}); err != nil {
+		t.Fatalf("CompleteMultipartUpload() of copied parts error = %v", err)
+	}
+	if got, _ := s.Object("some-bucket", "copy"); !bytes.Equal(got, data[:30]) {
+		t.Errorf("object copied in parts = %q, want %q", got, data[:30])
+	}
+
+	created, err := c.CreateMultipartUpload(&s3.CreateMultipartUploadInput{Bucket: aws.String("some-bucket"), Key: aws.String("aborted")})
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload() error = %v", err)
+	}
+	if _, err := c.AbortMultipartUpload(&s3.AbortMultipartUploadInput{Bucket: aws.String("some-bucket"), Key: aws.String("aborted"), UploadId: created.UploadId}); err != nil {
+		t.Errorf("AbortMultipartUpload() error = %v", err)
+	}
+	if _, err := c.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket: aws.String("some-bucket"), Key: aws.String("aborted"), UploadId: created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: aws.String("x")}}},
+	}); errCode(err) != s3.ErrCodeNoSuchUpload {
+		t.Errorf("CompleteMultipartUpload() of an aborted upload error = %v, want NoSuchUpload", err)
+	}
+}
+
+func TestServer_versioning(t *testing.T) {
+	s := New()
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s, "some-key")
+
+	if _, err := c.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket:                  aws.String("some-bucket"),
+		VersioningConfiguration: &s3.VersioningConfiguration{Status: aws.String(s3.BucketVersioningStatusEnabled)},
+	}); err != nil {
+		t.Fatalf("PutBucketVersioning() error = %v", err)
+	}
+	v, err := c.GetBucketVersioning(&s3.GetBucketVersioningInput{Bucket: aws.String("some-bucket")})
+	if err != nil || aws.StringValue(v.Status) != s3.BucketVersioningStatusEnabled {
+		t.Errorf("GetBucketVersioning() = %v, %v", v, err)
+	}
+
+	first, err := c.PutObject(&s3.PutObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("k"), Body: strings.NewReader("first")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.PutObject(&s3.PutObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("k"), Body: strings.NewReader("second")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.DeleteObject(&s3.DeleteObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("k")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GetObject(&s3.GetObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("k")}); errCode(err) != s3.ErrCodeNoSuchKey {
+		t.Errorf("GetObject() after delete error = %v, want NoSuchKey", err)
+	}
+	old, err := c.GetObject(&s3.GetObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("k"), VersionId: first.VersionId})
+	if err != nil {
+		t.Fatalf("GetObject() of the first version error = %v", err)
+	}
+	if data, _ := ioutil.ReadAll(old.Body); string(data) != "first" {
+		t.Errorf("GetObject() of the first version = %s", data)
+	}
+
+	versions, err := c.ListObjectVersions(&s3.ListObjectVersionsInput{Bucket: aws.String("some-bucket")})
+	if err != nil {
+		t.Fatalf("ListObjectVersions() error = %v", err)
+	}
+	if len(versions.Versions) != 2 || len(versions.DeleteMarkers) != 1 || !aws.BoolValue(versions.DeleteMarkers[0].IsLatest) {
+		t.Errorf("ListObjectVersions() = %v", versions)
+	}
+}
+
+func TestServer_faults(t *testing.T) {
+	s := New(WithAccessKey("some-key"))
+	defer s.Close()
+	s.CreateBucket("some-bucket")
+	c := newClient(t, s, "some-key")
+
+	s.Inject(Fault{Operation: "PutObject", Code: "SlowDown", Status: 503, Times: 1})
+	put := &s3.PutObjectInput{Bucket: aws.String("some-bucket"), Key: aws.String("k"), Body: strings.NewReader("data")}
+	if _, err := c.PutObject(put); errCode(err) != "SlowDown" {
+		t.Errorf("PutObject() with an injected fault error = %v, want SlowDown", err)
+	}
+	if _, err := c.PutObject(put); err != nil {
+		t.Errorf("PutObject() after the fault was used up error = %v", err)
+	}
+
+	s.Inject(Fault{Bucket: "some-bucket", Delay: time.Second})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.HeadBucketWithContext(ctx, &s3.HeadBucketInput{Bucket: aws.String("some-bucket")}); err == nil {
+		t.Errorf("HeadBucket() with an injected delay did not time out")
+	}
+	s.ClearFaults()
+	if _, err := c.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String("some-bucket")}); err != nil {
+		t.Errorf("HeadBucket() after clearing faults error = %v", err)
+	}
+
+	if _, err := newClient(t, s, "other-key").ListBuckets(&s3.ListBucketsInput{}); errCode(err) != "InvalidAccessKeyId" {
+		t.Errorf("ListBuckets() with a wrong access key error = %v, want InvalidAccessKeyId", err)
+	}
+}
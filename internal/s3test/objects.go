@@ -0,0 +1,478 @@
+package s3test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metaPrefix = "X-Amz-Meta-"
+
+type object struct {
+	key          string
+	versionID    string
+	data         []byte
+	etag         string
+	modified     time.Time
+	contentType  string
+	metadata     map[string]string
+	tags         map[string]string
+	deleteMarker bool
+}
+
+type upload struct {
+	key         string
+	contentType string
+	metadata    map[string]string
+	tags        map[string]string
+	parts       map[int]part
+}
+
+type part struct {
+	data []byte
+	etag string
+}
+
+func (s *Server) putObject(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	tags, err := headerTags(r)
+	if err != nil {
+		return err
+	}
+	o := &object{
+		key:         key,
+		data:        data,
+		etag:        etag(data),
+		modified:    time.Now().UTC(),
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    headerMetadata(r),
+		tags:        tags,
+	}
+	b.put(o)
+	w.Header().Set("ETag", o.etag)
+	setVersionHeader(w, b, o.versionID)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// getObject implements GetObject and HeadObject
+func (s *Server) getObject(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	o, err := lookup(b, key, r.URL.Query().Get("versionId"))
+	if err != nil {
+		if versions := b.objects[key]; len(versions) > 0 && versions[len(versions)-1].deleteMarker {
+			w.Header().Set("x-amz-delete-marker", "true")
+		}
+		return err
+	}
+	h := w.Header()
+	h.Set("ETag", o.etag)
+	h.Set("Last-Modified", o.modified.Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	if o.contentType != "" {
+		h.Set("Content-Type", o.contentType)
+	}
+	for k, v := range o.metadata {
+		h.Set(metaPrefix+k, v)
+	}
+	if len(o.tags) > 0 {
+		h.Set("x-amz-tagging-count", strconv.Itoa(len(o.tags)))
+	}
+	setVersionHeader(w, b, o.versionID)
+
+	data, status := o.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end, ok := parseRange(rng, len(o.data))
+		if !ok {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", len(o.data)))
+			return &Error{Code: "InvalidRange", Message: "The requested range is not satisfiable", Resource: key, Status: http.StatusRequestedRangeNotSatisfiable}
+		}
+		data, status = o.data[start:end+1], http.StatusPartialContent
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(o.data)))
+	}
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+	return nil
+}
+
+func (s *Server) deleteObject(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	versionID, marker := b.remove(key, r.URL.Query().Get("versionId"))
+	if marker {
+		w.Header().Set("x-amz-delete-marker", "true")
+	}
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) copyObject(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	src, err := s.copySource(r)
+	if err != nil {
+		return err
+	}
+	o := &object{
+		key:         key,
+		data:        append([]byte(nil), src.data...),
+		etag:        src.etag,
+		modified:    time.Now().UTC(),
+		contentType: src.contentType,
+		metadata:    copyTags(src.metadata),
+		tags:        copyTags(src.tags),
+	}
+	if r.Header.Get("x-amz-metadata-directive") == "REPLACE" {
+		o.contentType, o.metadata = r.Header.Get("Content-Type"), headerMetadata(r)
+	}
+	if r.Header.Get("x-amz-tagging-directive") == "REPLACE" {
+		if o.tags, err = headerTags(r); err != nil {
+			return err
+		}
+	}
+	b.put(o)
+	setVersionHeader(w, b, o.versionID)
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyObjectResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{Xmlns: xmlns, ETag: o.etag, LastModified: o.modified.Format(timeFormat)})
+	return nil
+}
+
+func (s *Server) putObjectTagging(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	o, err := s.taggedObject(r, bucketName, key)
+	if err != nil {
+		return err
+	}
+	tags, err := decodeTagging(r)
+	if err != nil {
+		return err
+	}
+	o.tags = tags
+	w.Header().Set("x-amz-version-id", o.versionID)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) getObjectTagging(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	o, err := s.taggedObject(r, bucketName, key)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("x-amz-version-id", o.versionID)
+	writeXML(w, http.StatusOK, encodeTagging(o.tags))
+	return nil
+}
+
+func (s *Server) deleteObjectTagging(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	o, err := s.taggedObject(r, bucketName, key)
+	if err != nil {
+		return err
+	}
+	o.tags = nil
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (s *Server) taggedObject(r *http.Request, bucketName, key string) (*object, error) {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	return lookup(b, key, r.URL.Query().Get("versionId"))
+}
+
+func (s *Server) createMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return err
+	}
+	tags, err := headerTags(r)
+	if err != nil {
+		return err
+	}
+	id := newID()
+	b.uploads[id] = &upload{
+		key:         key,
+		contentType: r.Header.Get("Content-Type"),
+		metadata:    headerMetadata(r),
+		tags:        tags,
+		parts:       make(map[int]part),
+	}
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadID string   `xml:"UploadId"`
+	}{Xmlns: xmlns, Bucket: bucketName, Key: key, UploadID: id})
+	return nil
+}
+
+func (s *Server) uploadPart(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	u, err := s.upload(r, bucketName, key)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		return &Error{Code: "InvalidArgument", Message: "Part number must be an integer between 1 and 10000, inclusive", Status: http.StatusBadRequest}
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	p := part{data: data, etag: etag(data)}
+	u.parts[n] = p
+	w.Header().Set("ETag", p.etag)
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+func (s *Server) uploadPartCopy(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	u, err := s.upload(r, bucketName, key)
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > 10000 {
+		return &Error{Code: "InvalidArgument", Message: "Part number must be an integer between 1 and 10000, inclusive", Status: http.StatusBadRequest}
+	}
+	src, err := s.copySource(r)
+	if err != nil {
+		return err
+	}
+	data := src.data
+	if rng := r.Header.Get("x-amz-copy-source-range"); rng != "" {
+		var first, last int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &first, &last); err != nil || first > last || last >= len(data) {
+			return &Error{Code: "InvalidArgument", Message: "The x-amz-copy-source-range value must be of the form bytes=first-last where first and last are the zero-based offsets of the first and last bytes to copy", Status: http.StatusBadRequest}
+		}
+		data = data[first : last+1]
+	}
+	p := part{data: append([]byte(nil), data...), etag: etag(data)}
+	u.parts[n] = p
+	writeXML(w, http.StatusOK, struct {
+		XMLName      xml.Name `xml:"CopyPartResult"`
+		Xmlns        string   `xml:"xmlns,attr"`
+		ETag         string   `xml:"ETag"`
+		LastModified string   `xml:"LastModified"`
+	}{Xmlns: xmlns, ETag: p.etag, LastModified: time.Now().UTC().Format(timeFormat)})
+	return nil
+}
+
+func (s *Server) completeMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	u, err := s.upload(r, bucketName, key)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int    `xml:"PartNumber"`
+			ETag       string `xml:"ETag"`
+		} `xml:"Part"`
+	}
+	if err := decodeXML(r, &req); err != nil {
+		return err
+	}
+	if len(req.Parts) == 0 {
+		return errMalformedXML(fmt.Errorf("no parts"))
+	}
+	var data []byte
+	var sums []byte
+	for i, rp := range req.Parts {
+		if i > 0 && rp.PartNumber <= req.Parts[i-1].PartNumber {
+			return &Error{Code: "InvalidPartOrder", Message: "The list of parts was not in ascending order.", Status: http.StatusBadRequest}
+		}
+		p, ok := u.parts[rp.PartNumber]
+		if !ok || strings.Trim(rp.ETag, `"`) != strings.Trim(p.etag, `"`) {
+			return &Error{Code: "InvalidPart", Message: fmt.Sprintf("Part %d could not be found or its ETag does not match", rp.PartNumber), Status: http.StatusBadRequest}
+		}
+		data = append(data, p.data...)
+		sum, _ := hex.DecodeString(strings.Trim(p.etag, `"`))
+		sums = append(sums, sum...)
+	}
+	b := s.buckets[bucketName]
+	sum := md5.Sum(sums)
+	o := &object{
+		key:         key,
+		data:        data,
+		etag:        fmt.Sprintf(`"%s-%d"`, hex.EncodeToString(sum[:]), len(req.Parts)),
+		modified:    time.Now().UTC(),
+		contentType: u.contentType,
+		metadata:    u.metadata,
+		tags:        u.tags,
+	}
+	b.put(o)
+	delete(b.uploads, r.URL.Query().Get("uploadId"))
+	setVersionHeader(w, b, o.versionID)
+	writeXML(w, http.StatusOK, struct {
+		XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+		Xmlns    string   `xml:"xmlns,attr"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Xmlns: xmlns, Location: fmt.Sprintf("%s/%s/%s", s.URL(), bucketName, key), Bucket: bucketName, Key: key, ETag: o.etag})
+	return nil
+}
+
+func (s *Server) abortMultipartUpload(w http.ResponseWriter, r *http.Request, bucketName, key string) error {
+	if _, err := s.upload(r, bucketName, key); err != nil {
+		return err
+	}
+	delete(s.buckets[bucketName].uploads, r.URL.Query().Get("uploadId"))
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// upload returns the multipart upload of the request or NoSuchUpload error
+func (s *Server) upload(r *http.Request, bucketName, key string) (*upload, error) {
+	b, err := s.bucket(bucketName)
+	if err != nil {
+		return nil, err
+	}
+	u, ok := b.uploads[r.URL.Query().Get("uploadId")]
+	if !ok || u.key != key {
+		return nil, &Error{Code: "NoSuchUpload", Message: "The specified upload does not exist.", Resource: key, Status: http.StatusNotFound}
+	}
+	return u, nil
+}
+
+// copySource returns the object named by the request's x-amz-copy-source header
+func (s *Server) copySource(r *http.Request) (*object, error) {
+	source, err := url.PathUnescape(r.Header.Get("x-amz-copy-source"))
+	if err != nil {
+		return nil, &Error{Code: "InvalidArgument", Message: "Invalid copy source encoding", Status: http.StatusBadRequest}
+	}
+	sourceVersion := ""
+	if i := strings.Index(source, "?versionId="); i >= 0 {
+		source, sourceVersion = source[:i], source[i+len("?versionId="):]
+	}
+	srcBucketName, srcKey := splitPath(source)
+	srcBucket, err := s.bucket(srcBucketName)
+	if err != nil {
+		return nil, err
+	}
+	return lookup(srcBucket, srcKey, sourceVersion)
+}
+
+// lookup returns the given version of key, or the current version if versionID is empty
+func lookup(b *bucket, key, versionID string) (*object, error) {
+	var o *object
+	if versionID == "" {
+		o = b.current(key)
+	} else {
+		o = b.version(key, versionID)
+	}
+	if o == nil || o.deleteMarker {
+		return nil, errNoSuchKey(key)
+	}
+	return o, nil
+}
+
+func setVersionHeader(w http.ResponseWriter, b *bucket, versionID string) {
+	if b.versioning != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+}
+
+// headerMetadata returns user metadata from x-amz-meta-* headers
+func headerMetadata(r *http.Request) map[string]string {
+	m := make(map[string]string)
+	for k := range r.Header {
+		if strings.HasPrefix(k, metaPrefix) {
+			m[k[len(metaPrefix):]] = r.Header.Get(k)
+		}
+	}
+	return m
+}
+
+// headerTags parses tags from the URL query encoded x-amz-tagging header
+func headerTags(r *http.Request) (map[string]string, error) {
+	h := r.Header.Get("x-amz-tagging")
+	if h == "" {
+		return nil, nil
+	}
+	q, err := url.ParseQuery(h)
+	if err != nil {
+		return nil, &Error{Code: "InvalidArgument", Message: "The header 'x-amz-tagging' shall be encoded as UTF-8 then URLEncoded URL query parameters without tag name duplicates.", Status: http.StatusBadRequest}
+	}
+	tags := make(map[string]string, len(q))
+	for k := range q {
+		tags[k] = q.Get(k)
+	}
+	return tags, nil
+}
+
+// parseRange parses a single range of a Range header into inclusive start and end offsets
+func parseRange(h string, size int) (int, int, bool) {
+	spec := strings.TrimPrefix(h, "bytes=")
+	if spec == h || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	i := strings.Index(spec, "-")
+	if i < 0 {
+		return 0, 0, false
+	}
+	from, to := spec[:i], spec[i+1:]
+	if from == "" {
+		// suffix range, the last n bytes
+		n, err := strconv.Atoi(to)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, false
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	start, err := strconv.Atoi(from)
+	if err != nil || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if to != "" {
+		if end, err = strconv.Atoi(to); err != nil || end < start {
+			return 0, 0, false
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end, true
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
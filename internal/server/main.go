@@ -0,0 +1,45 @@
+package server
+
+import (
+	csi "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/cache"
+	"github.com/irbekrm/csi-s3/internal/config"
+	csis3 "github.com/irbekrm/csi-s3/internal/csi-s3"
+	"github.com/irbekrm/csi-s3/internal/filesystem"
+	"github.com/irbekrm/csi-s3/internal/logging"
+	"github.com/irbekrm/csi-s3/internal/metrics"
+	"github.com/irbekrm/csi-s3/internal/mount"
+	"github.com/irbekrm/csi-s3/internal/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+)
+
+// New returns a gRPC server that serves the CSI services selected by the plugin type of the current config.
+// Volumes are cached in cc, which is nil if caching is disabled. opts are appended to the driver's own server options
+func New(cfg *config.Holder, m mount.Mounter, fs filesystem.FS, mt *metrics.Metrics, cc *cache.Cache, opts ...grpc.ServerOption) *grpc.Server {
+	c := cfg.Load()
+	s := grpc.NewServer(append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(
+		tracing.UnaryServerInterceptor(),
+		logging.UnaryServerInterceptor(),
+		mt.UnaryServerInterceptor(),
+	)}, opts...)...)
+
+	// register CSI Identity service
+	i := csis3.NewIdentityServer(c.DriverVersion, m, c.ServesController())
+	csi.RegisterIdentityServer(s, i)
+
+	// register CSI Node service
+	if c.ServesNode() {
+		n := csis3.NewNodeServer(m, fs, c.NodeID, mt, cfg, cc)
+		csi.RegisterNodeServer(s, n)
+	}
+
+	// register CSI Controller service
+	if c.ServesController() {
+		csi.RegisterControllerServer(s, csis3.NewControllerServer(cfg))
+	}
+
+	// For debugging purposes register reflection service
+	reflection.Register(s)
+	return s
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/endpoint"
+	"github.com/irbekrm/csi-s3/internal/fake"
+	"github.com/irbekrm/csi-s3/internal/metrics"
+	"github.com/irbekrm/csi-s3/internal/s3test"
+	"github.com/kubernetes-csi/csi-test/v4/pkg/sanity"
+)
+
+// secretNames are the secrets the sanity suite passes with each RPC.
+// ListSnapshots is called without secrets, so the driver falls back to env credentials
+var secretNames = []string{
+	"CreateVolumeSecret",
+	"DeleteVolumeSecret",
+	"ControllerValidateVolumeCapabilitiesSecret",
+	"ControllerExpandVolumeSecret",
+	"CreateSnapshotSecret",
+	"DeleteSnapshotSecret",
+	"NodePublishVolumeSecret",
+}
+
+// TestSanity runs the CSI sanity suite against the driver's gRPC server serving all services,
+// with a fake mounter and filesystem and an in-memory S3
+func TestSanity(t *testing.T) {
+	dir := t.TempDir()
+	address := "unix://" + filepath.Join(dir, "csi.sock")
+	l, err := endpoint.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s3 := s3test.New()
+	defer s3.Close()
+	s3.CreateBucket("snapshots")
+
+	cfg := config.Default()
+	cfg.NodeID = "some-node"
+	cfg.Plugin.Type = config.PluginTypeMonolith
+	cfg.S3 = config.S3Config{Endpoint: s3.URL(), Region: s3.Region(), PathStyle: true}
+	cfg.Snapshots.Bucket = "snapshots"
+	cfg.Credentials.Providers = []string{config.CredentialsFromSecrets, config.CredentialsFromEnv}
+	// the suite expects NodeGetInfo to report topology, as the controller advertises accessibility constraints.
+	// The region is not s3's default, so that volumes created for the node's topology are in another region than
+	// the configured one, which s3test only serves requests for if they are signed for it
+	cfg.Topology = map[string]string{"topology.s3.csi.irbe.dev/region": "eu-west-3"}
+	// the suite expects NodeGetVolumeStats to report usage, which is only calculated for quotas
+	cfg.Quota.Enforce = true
+	for k, v := range map[string]string{"AWS_ACCESS_KEY_ID": "some-key", "AWS_SECRET_ACCESS_KEY": "some-secret"} {
+		os.Setenv(k, v)
+		defer os.Unsetenv(k)
+	}
+	node := fake.NewNode()
+	m := node.Mounter()
+	s := New(config.NewHolder(cfg), m, node.FS(), metrics.New(m.Type(), func() (int, error) {
+		return len(node.Mounts()), nil
+	}), nil)
+	go s.Serve(l)
+	defer s.Stop()
+
+	sc := sanity.NewTestConfig()
+	sc.Address = address
+	sc.TargetPath = filepath.Join(dir, "target")
+	sc.StagingPath = filepath.Join(dir, "staging")
+	sc.SecretsFile = filepath.Join(dir, "secrets.yaml")
+	var secrets strings.Builder
+	for _, n := range secretNames {
+		secrets.WriteString(n + ":\n  AWS_ACCESS_KEY_ID: some-key\n  AWS_SECRET_ACCESS_KEY: some-secret\n")
+	}
+	if err := ioutil.WriteFile(sc.SecretsFile, []byte(secrets.String()), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sanity.Test(t, sc)
+
+	if mounts := node.Mounts(); len(mounts) != 0 {
+		t.Errorf("volumes left mounted after the sanity suite: %v", mounts)
+	}
+	// everything but the snapshots bucket is created by the suite, which should clean up after itself
+	if buckets := s3.Buckets(); len(buckets) != 1 {
+		t.Errorf("buckets left after the sanity suite: %v", buckets)
+	}
+}
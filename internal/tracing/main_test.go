@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func Test_UnaryServerInterceptor(t *testing.T) {
+	const parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name        string
+		md          metadata.MD
+		err         error
+		wantStatus  otelcodes.Code
+		wantTraceID string
+		wantErr     bool
+	}{
+		{
+			name:       "successful RPC",
+			wantStatus: otelcodes.Unset,
+		},
+		{
+			name:       "failed RPC",
+			err:        status.Error(codes.Internal, "some error"),
+			wantStatus: otelcodes.Error,
+			wantErr:    true,
+		},
+		{
+			name:        "continues trace from the caller",
+			md:          metadata.Pairs("traceparent", "00-"+parentTraceID+"-00f067aa0ba902b7-01"),
+			wantStatus:  otelcodes.Unset,
+			wantTraceID: parentTraceID,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sr := tracetest.NewSpanRecorder()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+			otel.SetTextMapPropagator(propagation.TraceContext{})
+			ctx := context.TODO()
+			if tt.md != nil {
+				ctx = metadata.NewIncomingContext(ctx, tt.md)
+			}
+
+			var handlerTraceID string
+			handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+				handlerTraceID = TraceID(ctx)
+				return nil, tt.err
+			}
+			info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Node/NodePublishVolume"}
+			if _, err := UnaryServerInterceptor()(ctx, nil, info, handler); (err != nil) != tt.wantErr {
+				t.Fatalf("interceptor error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			spans := sr.Ended()
+			if len(spans) != 1 {
+				t.Fatalf("expected 1 span, got %d", len(spans))
+			}
+			span := spans[0]
+			if span.Name() != "csi.v1.Node/NodePublishVolume" {
+				t.Errorf("span name = %s, want csi.v1.Node/NodePublishVolume", span.Name())
+			}
+			if span.Status().Code != tt.wantStatus {
+				t.Errorf("span status = %v, want %v", span.Status().Code, tt.wantStatus)
+			}
+			if handlerTraceID != span.SpanContext().TraceID().String() {
+				t.Errorf("handler saw trace id %s, span has %s", handlerTraceID, span.SpanContext().TraceID())
+			}
+			if tt.wantTraceID != "" && handlerTraceID != tt.wantTraceID {
+				t.Errorf("trace id = %s, want %s", handlerTraceID, tt.wantTraceID)
+			}
+		})
+	}
+}
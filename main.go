@@ -1,70 +1,241 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 
-	csi "github.com/container-storage-interface/spec/lib/go/csi"
-	csis3 "github.com/irbekrm/csi-s3/internal/csi-s3"
+	"github.com/irbekrm/csi-s3/internal/cache"
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/endpoint"
 	"github.com/irbekrm/csi-s3/internal/filesystem"
+	"github.com/irbekrm/csi-s3/internal/logging"
+	"github.com/irbekrm/csi-s3/internal/metrics"
 	"github.com/irbekrm/csi-s3/internal/mount"
+	"github.com/irbekrm/csi-s3/internal/server"
+	"github.com/irbekrm/csi-s3/internal/tracing"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/reflection"
-	"k8s.io/klog"
+	"google.golang.org/grpc/credentials"
+	"k8s.io/klog/v2"
 )
 
 func main() {
-	var (
-		csiAddress        string
-		driverVersion     string
-		mounter           string
-		mounterBinaryPath string
-		nodeid            string
-	)
-	flag.StringVar(&csiAddress, "csi-address", "/csi/csi.sock", "Path of the UDS on which the gRPC server will serve Identity, Node, Controller services")
-	flag.StringVar(&driverVersion, "driver-version", "test", "driver release version")
-	flag.StringVar(&mounter, mounter, "s3fs", "Mount backend. Currently only s3fs is supported")
-	flag.StringVar(&mounterBinaryPath, "mounterBinaryPath", "/usr/local/bin/s3fs", "Path to the selected mount backend binary")
-	flag.StringVar(&nodeid, "nodeid", "", "id of the kubernetes node on which this driver is currently running")
+	os.Exit(run())
+}
+
+// run runs the driver until it fails or is signalled to stop and returns the exit code
+func run() int {
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "Path to a YAML or JSON config file. Flags set on the command line override values from the file")
+	flags := config.RegisterFlags(flag.CommandLine)
 
 	klog.InitFlags(nil)
 
 	flag.Parse()
 
-	if err := os.RemoveAll(csiAddress); err != nil {
-		klog.Errorf("could not remove socket %s: %v", csiAddress, err)
+	cfg, err := loadConfig(configPath, flags)
+	if err != nil {
+		klog.ErrorS(err, "Invalid configuration")
+		return 1
 	}
-	l, err := net.Listen("unix", csiAddress)
+	if err := logging.Setup(cfg.Logging.Format, os.Stderr); err != nil {
+		klog.ErrorS(err, "Failed to set up logging")
+		return 1
+	}
+	defer klog.Flush()
+	setVerbosity(cfg.Logging.Verbosity)
+	current := config.NewHolder(cfg)
+
+	// start listening for signals before the socket is created so that it is always cleaned up
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+
+	csiAddress := cfg.CSIAddress
+	l, err := endpoint.Listen(csiAddress)
 	if err != nil {
-		klog.Errorf("could not listen on %s: %v", csiAddress, err)
-		os.Exit(1)
+		klog.ErrorS(err, "Could not listen", "address", csiAddress)
+		return 1
 	}
-	klog.V(1).Infof("listening on unix socket at %s", csiAddress)
+	klog.V(1).InfoS("Listening", "address", csiAddress, "pluginType", cfg.Plugin.Type, "tls", cfg.TLS.CertFile != "", "clientAuth", cfg.TLS.ClientCAFile != "")
+	defer removeSocket(csiAddress)
 	defer l.Close()
 
-	m, err := mount.New(mounter, mounterBinaryPath)
+	m, err := mount.New(cfg.Mounter.Name, cfg.MounterBinaryPath(), mount.WithMinFreeDisk(cfg.Cache.MinFreeDiskMB))
 	if err != nil {
-		klog.Errorf("failed to set up mount backend: %v", err)
-		os.Exit(1)
+		klog.ErrorS(err, "Failed to set up mount backend", "mounter", cfg.Mounter.Name)
+		return 1
 	}
 	fs := filesystem.New()
 
-	s := grpc.NewServer()
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Exporter:       cfg.Tracing.Exporter,
+		Endpoint:       cfg.Tracing.Endpoint,
+		Insecure:       cfg.Tracing.Insecure,
+		ServiceVersion: cfg.DriverVersion,
+	})
+	if err != nil {
+		klog.ErrorS(err, "Failed to set up tracing")
+		return 1
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			klog.ErrorS(err, "Failed to flush trace spans")
+		}
+	}()
+
+	mt := metrics.New(m.Type(), func() (int, error) {
+		return filesystem.CountMounts(m.Type())
+	})
+	serveErr := make(chan error, 2)
+	if metricsAddress := cfg.Metrics.Address; metricsAddress != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", mt.Handler())
+		ms := &http.Server{Addr: metricsAddress, Handler: mux}
+		go func() {
+			klog.V(1).InfoS("Serving metrics", "address", metricsAddress, "path", "/metrics")
+			if err := ms.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErr <- err
+			}
+		}()
+		defer ms.Close()
+	}
+
+	var serverOpts []grpc.ServerOption
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err := endpoint.TLSConfig(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile)
+		if err != nil {
+			klog.ErrorS(err, "Failed to set up TLS")
+			return 1
+		}
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	var cc *cache.Cache
+	if c := cfg.Cache; c.Dir != "" {
+		cc = cache.New(c.Dir, c.MaxSizeMB<<20)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go cc.Run(ctx, c.EvictionInterval.Duration)
+	}
+	s := server.New(current, m, fs, mt, cc, serverOpts...)
+
+	go func() {
+		if err := s.Serve(l); err != nil {
+			serveErr <- err
+		}
+	}()
+
+	exitCode := 0
+	for running := true; running; {
+		select {
+		case err := <-serveErr:
+			klog.ErrorS(err, "Failed to run server")
+			s.Stop()
+			exitCode = 1
+			running = false
+		case sig := <-stop:
+			timeout := current.Load().Shutdown.Timeout.Duration
+			klog.InfoS("Shutting down", "signal", sig.String(), "timeout", timeout)
+			gracefulStop(s, timeout)
+			running = false
+		case <-reload:
+			reloadConfig(configPath, flags, current)
+		}
+	}
+
+	if shutdown := current.Load().Shutdown; shutdown.UnmountVolumes {
+		unmountAll(fs, m.Type(), shutdown.Timeout.Duration)
+	}
+	return exitCode
+}
+
+// loadConfig reads config file at path (if any) and overrides it with flags set on the command line
+func loadConfig(path string, flags *config.Flags) (*config.Config, error) {
+	cfg := config.Default()
+	if path != "" {
+		var err error
+		if cfg, err = config.Load(path); err != nil {
+			return nil, err
+		}
+	}
+	flags.Apply(cfg)
+	return cfg, cfg.Validate()
+}
+
+// reloadConfig re-reads the config file and applies changes to its reloadable fields.
+// If the new config is invalid, the current one is kept
+func reloadConfig(path string, flags *config.Flags, current *config.Holder) {
+	if path == "" {
+		klog.InfoS("Received SIGHUP, but no config file is set, nothing to reload")
+		return
+	}
+	next, err := loadConfig(path, flags)
+	if err != nil {
+		klog.ErrorS(err, "Failed to reload config, keeping the current config", "path", path)
+		return
+	}
+	cfg, ignored := current.Load().Reload(next)
+	if len(ignored) > 0 {
+		klog.InfoS("Config changes that require a restart were not applied", "fields", ignored)
+	}
+	current.Store(cfg)
+	setVerbosity(cfg.Logging.Verbosity)
+	klog.InfoS("Reloaded config", "path", path)
+}
 
-	// register CSI Identity service
-	i := csis3.NewIdentityServer(driverVersion, m)
-	csi.RegisterIdentityServer(s, i)
+// setVerbosity sets klog's verbosity without marking -v as set on the command line
+func setVerbosity(v int) {
+	if f := flag.Lookup("v"); f != nil {
+		if err := f.Value.Set(strconv.Itoa(v)); err != nil {
+			klog.ErrorS(err, "Failed to set log verbosity", "verbosity", v)
+		}
+	}
+}
 
-	// register CSI Node service
-	n := csis3.NewNodeServer(m, fs, nodeid)
-	csi.RegisterNodeServer(s, n)
+// gracefulStop stops accepting new RPCs and waits for in-flight ones to finish.
+// If they take longer than timeout, they are cancelled
+func gracefulStop(s *grpc.Server, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		s.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		klog.InfoS("In-flight RPCs did not finish in time, cancelling them", "timeout", timeout)
+		s.Stop()
+	}
+}
 
-	// For debugging purposes register reflection service
-	reflection.Register(s)
+// unmountAll removes all mounts of fsType on the node
+func unmountAll(fs filesystem.FS, fsType string, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	paths, err := filesystem.ListMounts(fsType)
+	if err != nil {
+		klog.ErrorS(err, "Failed to list mounts to unmount", "fsType", fsType)
+		return
+	}
+	for _, p := range paths {
+		if err := fs.EnsureMountRemoved(ctx, p); err != nil {
+			klog.ErrorS(err, "Failed to unmount", "path", p)
+		}
+	}
+}
 
-	if err := s.Serve(l); err != nil {
-		klog.Errorf("failed to run grpc server: %v", err)
-		os.Exit(1)
+// removeSocket removes the UDS (if the driver listens on one) so that a stale socket is not left behind for the next driver process
+func removeSocket(address string) {
+	if err := endpoint.Cleanup(address); err != nil {
+		klog.ErrorS(err, "Could not remove socket", "address", address)
 	}
 }
@@ -5,6 +5,7 @@
 package mocks
 
 import (
+	context "context"
 	os "os"
 	reflect "reflect"
 
@@ -37,46 +38,46 @@ func (m *MockFS) EXPECT() *MockFSMockRecorder {
 }
 
 // EnsureDirExists mocks base method.
-func (m *MockFS) EnsureDirExists(arg0 string) error {
+func (m *MockFS) EnsureDirExists(arg0 context.Context, arg1 string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "EnsureDirExists", arg0)
+	ret := m.ctrl.Call(m, "EnsureDirExists", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // EnsureDirExists indicates an expected call of EnsureDirExists.
-func (mr *MockFSMockRecorder) EnsureDirExists(arg0 interface{}) *gomock.Call {
+func (mr *MockFSMockRecorder) EnsureDirExists(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureDirExists", reflect.TypeOf((*MockFS)(nil).EnsureDirExists), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureDirExists", reflect.TypeOf((*MockFS)(nil).EnsureDirExists), arg0, arg1)
 }
 
 // EnsureMountRemoved mocks base method.
-func (m *MockFS) EnsureMountRemoved(arg0 string) error {
+func (m *MockFS) EnsureMountRemoved(arg0 context.Context, arg1 string) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "EnsureMountRemoved", arg0)
+	ret := m.ctrl.Call(m, "EnsureMountRemoved", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // EnsureMountRemoved indicates an expected call of EnsureMountRemoved.
-func (mr *MockFSMockRecorder) EnsureMountRemoved(arg0 interface{}) *gomock.Call {
+func (mr *MockFSMockRecorder) EnsureMountRemoved(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureMountRemoved", reflect.TypeOf((*MockFS)(nil).EnsureMountRemoved), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "EnsureMountRemoved", reflect.TypeOf((*MockFS)(nil).EnsureMountRemoved), arg0, arg1)
 }
 
 // FindMount mocks base method.
-func (m *MockFS) FindMount(arg0 string) (filesystem0.Matcher, error) {
+func (m *MockFS) FindMount(arg0 context.Context, arg1 string) (filesystem0.Matcher, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "FindMount", arg0)
+	ret := m.ctrl.Call(m, "FindMount", arg0, arg1)
 	ret0, _ := ret[0].(filesystem0.Matcher)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // FindMount indicates an expected call of FindMount.
-func (mr *MockFSMockRecorder) FindMount(arg0 interface{}) *gomock.Call {
+func (mr *MockFSMockRecorder) FindMount(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindMount", reflect.TypeOf((*MockFS)(nil).FindMount), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FindMount", reflect.TypeOf((*MockFS)(nil).FindMount), arg0, arg1)
 }
 
 // MockMatcher is a mock of Matcher interface.
@@ -168,18 +169,18 @@ func (mr *MockSysMockRecorder) IsDir(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsDir", reflect.TypeOf((*MockSys)(nil).IsDir), arg0)
 }
 
-// Mkdir mocks base method.
-func (m *MockSys) Mkdir(arg0 string, arg1 os.FileMode) error {
+// MkdirAll mocks base method.
+func (m *MockSys) MkdirAll(arg0 string, arg1 os.FileMode) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Mkdir", arg0, arg1)
+	ret := m.ctrl.Call(m, "MkdirAll", arg0, arg1)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
-// Mkdir indicates an expected call of Mkdir.
-func (mr *MockSysMockRecorder) Mkdir(arg0, arg1 interface{}) *gomock.Call {
+// MkdirAll indicates an expected call of MkdirAll.
+func (mr *MockSysMockRecorder) MkdirAll(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Mkdir", reflect.TypeOf((*MockSys)(nil).Mkdir), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MkdirAll", reflect.TypeOf((*MockSys)(nil).MkdirAll), arg0, arg1)
 }
 
 // Remove mocks base method.
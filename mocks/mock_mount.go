@@ -5,9 +5,11 @@
 package mocks
 
 import (
+	context "context"
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	mount "github.com/irbekrm/csi-s3/internal/mount"
 )
 
 // MockMounter is a mock of Mounter interface.
@@ -34,32 +36,32 @@ func (m *MockMounter) EXPECT() *MockMounterMockRecorder {
 }
 
 // IsReady mocks base method.
-func (m *MockMounter) IsReady() (bool, error) {
+func (m *MockMounter) IsReady(arg0 context.Context) (bool, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "IsReady")
+	ret := m.ctrl.Call(m, "IsReady", arg0)
 	ret0, _ := ret[0].(bool)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
 // IsReady indicates an expected call of IsReady.
-func (mr *MockMounterMockRecorder) IsReady() *gomock.Call {
+func (mr *MockMounterMockRecorder) IsReady(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsReady", reflect.TypeOf((*MockMounter)(nil).IsReady))
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "IsReady", reflect.TypeOf((*MockMounter)(nil).IsReady), arg0)
 }
 
 // Mount mocks base method.
-func (m *MockMounter) Mount(arg0, arg1, arg2, arg3 string, arg4 bool) error {
+func (m *MockMounter) Mount(arg0 context.Context, arg1 string, arg2 mount.Volume) error {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "Mount", arg0, arg1, arg2, arg3, arg4)
+	ret := m.ctrl.Call(m, "Mount", arg0, arg1, arg2)
 	ret0, _ := ret[0].(error)
 	return ret0
 }
 
 // Mount indicates an expected call of Mount.
-func (mr *MockMounterMockRecorder) Mount(arg0, arg1, arg2, arg3, arg4 interface{}) *gomock.Call {
+func (mr *MockMounterMockRecorder) Mount(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Mount", reflect.TypeOf((*MockMounter)(nil).Mount), arg0, arg1, arg2, arg3, arg4)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Mount", reflect.TypeOf((*MockMounter)(nil).Mount), arg0, arg1, arg2)
 }
 
 // Type mocks base method.
@@ -75,3 +77,17 @@ func (mr *MockMounterMockRecorder) Type() *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Type", reflect.TypeOf((*MockMounter)(nil).Type))
 }
+
+// Validate mocks base method.
+func (m *MockMounter) Validate(arg0 mount.Volume) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Validate", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Validate indicates an expected call of Validate.
+func (mr *MockMounterMockRecorder) Validate(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Validate", reflect.TypeOf((*MockMounter)(nil).Validate), arg0)
+}
@@ -0,0 +1,143 @@
+// fake-s3fs mimics the s3fs command line for end-to-end tests.
+// Instead of mounting a bucket, it serves a FUSE filesystem of type fuse.s3fs that passes through to
+// the bucket's directory under $FAKE_S3FS_ROOT. Like s3fs, it stays in the background after mounting
+//
+//	fake-s3fs --version
+//	fake-s3fs <bucket> <mountpoint> [-o <option>]...
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/hanwen/go-fuse/v2/fs"
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+const (
+	// versionOutput is checked by the driver's readiness probe
+	versionOutput = "Amazon Simple Storage Service File System V1.90 (fake)"
+	// envRoot is the directory containing a directory per bucket
+	envRoot = "FAKE_S3FS_ROOT"
+	// envServe is set for the background process that serves the mount
+	envServe = "FAKE_S3FS_SERVE"
+)
+
+func main() {
+	if len(os.Args) == 2 && os.Args[1] == "--version" {
+		fmt.Println(versionOutput)
+		return
+	}
+	bucket, mountpoint, opts, err := parseArgs(os.Args[1:])
+	if err != nil {
+		fail(err)
+	}
+	if os.Getenv(envServe) != "" {
+		serve(bucket, mountpoint, opts)
+		return
+	}
+	if os.Getenv("AWSACCESSKEYID") == "" || os.Getenv("AWSSECRETACCESSKEY") == "" {
+		fail(fmt.Errorf("could not determine how to establish security credentials"))
+	}
+	if err := daemonize(); err != nil {
+		fail(err)
+	}
+}
+
+// parseArgs returns bucket, mountpoint and values of -o options
+func parseArgs(args []string) (string, string, []string, error) {
+	var positional, opts []string
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-o" {
+			if i+1 == len(args) {
+				return "", "", nil, fmt.Errorf("-o requires an argument")
+			}
+			i++
+			opts = append(opts, args[i])
+			continue
+		}
+		positional = append(positional, args[i])
+	}
+	if len(positional) != 2 {
+		return "", "", nil, fmt.Errorf("usage: fake-s3fs <bucket> <mountpoint> [-o <option>]...")
+	}
+	return positional[0], positional[1], opts, nil
+}
+
+// daemonize starts a copy of this process in its own session to serve the mount
+// and exits once it reports that the filesystem is mounted
+func daemonize() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(os.Args[0], os.Args[1:]...)
+	cmd.Env = append(os.Environ(), envServe+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	w.Close()
+	// the child writes an empty message once mounted or an error, the pipe is closed without a message if it dies
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(msg) == 0 {
+		if _, err := os.Stat(os.Args[2]); err != nil {
+			return fmt.Errorf("mount process exited: %v", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%s", msg)
+}
+
+func serve(bucket, mountpoint string, opts []string) {
+	ready := os.NewFile(3, "ready")
+	report := func(err error) {
+		fmt.Fprint(ready, err)
+		os.Exit(1)
+	}
+	root, err := fs.NewLoopbackRoot(filepath.Join(os.Getenv(envRoot), bucket))
+	if err != nil {
+		report(err)
+	}
+	mountOpts := fuse.MountOptions{
+		FsName:      bucket,
+		Name:        "s3fs",
+		DirectMount: true,
+		AllowOther:  true,
+	}
+	readonly := false
+	for _, o := range opts {
+		if o == "ro" {
+			readonly = true
+			mountOpts.Options = append(mountOpts.Options, "ro")
+		}
+	}
+	server, err := fs.Mount(mountpoint, root, &fs.Options{MountOptions: mountOpts})
+	if err != nil {
+		report(err)
+	}
+	// go-fuse only passes ro to the filesystem, whereas s3fs (via libfuse) also makes the mount itself read-only,
+	// which is what the driver checks
+	if readonly {
+		if err := syscall.Mount("", mountpoint, "", syscall.MS_REMOUNT|syscall.MS_BIND|syscall.MS_RDONLY, ""); err != nil {
+			server.Unmount()
+			report(err)
+		}
+	}
+	ready.Close()
+	server.Wait()
+}
+
+func fail(err error) {
+	fmt.Fprintf(os.Stderr, "fake-s3fs: %s\n", strings.TrimSpace(err.Error()))
+	os.Exit(1)
+}
@@ -0,0 +1,315 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e tests the driver's Node service end-to-end with real FUSE mounts served by fake-s3fs.
+// The tests mount filesystems, so they must run as root in a privileged container, see hack/test_e2e.sh
+package e2e
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/irbekrm/csi-s3/internal/config"
+	"github.com/irbekrm/csi-s3/internal/endpoint"
+	"github.com/irbekrm/csi-s3/internal/filesystem"
+	"github.com/irbekrm/csi-s3/internal/metrics"
+	"github.com/irbekrm/csi-s3/internal/mount"
+	"github.com/irbekrm/csi-s3/internal/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const bucket = "some-bucket"
+
+var (
+	// backingDir is the tmpfs directory that holds the buckets' contents
+	backingDir string
+	// mounterPath is the path to the built fake-s3fs binary
+	mounterPath string
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(run(m))
+}
+
+func run(m *testing.M) int {
+	if os.Geteuid() != 0 {
+		fmt.Fprintln(os.Stderr, "e2e tests must run as root in a privileged container, see hack/test_e2e.sh")
+		return 1
+	}
+	dir, err := ioutil.TempDir("", "csi-s3-e2e")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+
+	mounterPath = filepath.Join(dir, "fake-s3fs")
+	build := exec.Command("go", "build", "-o", mounterPath, "./fake-s3fs")
+	build.Stdout, build.Stderr = os.Stdout, os.Stderr
+	if err := build.Run(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed building fake-s3fs: %v\n", err)
+		return 1
+	}
+
+	backingDir = filepath.Join(dir, "buckets")
+	if err := os.Mkdir(backingDir, 0755); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := syscall.Mount("tmpfs", backingDir, "tmpfs", 0, "size=64m"); err != nil {
+		fmt.Fprintf(os.Stderr, "failed mounting tmpfs: %v\n", err)
+		return 1
+	}
+	defer syscall.Unmount(backingDir, 0)
+	os.Setenv("FAKE_S3FS_ROOT", backingDir)
+
+	return m.Run()
+}
+
+// driver is a running driver with a Node service client
+type driver struct {
+	csi.NodeClient
+	metrics *metrics.Metrics
+	// dir holds target paths
+	dir string
+}
+
+func startDriver(t *testing.T) *driver {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(backingDir, bucket), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(filepath.Join(backingDir, bucket)) })
+
+	cfg := config.Default()
+	cfg.NodeID = "some-node"
+	cfg.Mounter.Binaries = map[string]string{"s3fs": mounterPath}
+	m, err := mount.New(cfg.Mounter.Name, cfg.MounterBinaryPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mt := metrics.New(m.Type(), func() (int, error) { return filesystem.CountMounts(m.Type()) })
+	s := server.New(config.NewHolder(cfg), m, filesystem.New(), mt, nil)
+
+	address := "unix://" + filepath.Join(dir, "csi.sock")
+	l, err := endpoint.Listen(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial(address, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	d := &driver{NodeClient: csi.NewNodeClient(conn), metrics: mt, dir: dir}
+	// unmount anything a failed test left behind
+	t.Cleanup(func() {
+		paths, _ := filesystem.ListMounts(m.Type())
+		for _, p := range paths {
+			if strings.HasPrefix(p, dir) {
+				syscall.Unmount(p, syscall.MNT_DETACH)
+			}
+		}
+	})
+	return d
+}
+
+func (d *driver) publish(targetPath string, readonly bool) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:   bucket,
+		TargetPath: targetPath,
+		Readonly:   readonly,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+		Secrets: map[string]string{"AWS_ACCESS_KEY_ID": "some-key", "AWS_SECRET_ACCESS_KEY": "some-secret"},
+	})
+	return err
+}
+
+func (d *driver) unpublish(targetPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := d.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: bucket, TargetPath: targetPath})
+	return err
+}
+
+// mountsAt returns the number of fuse.s3fs mounts at path
+func mountsAt(t *testing.T, path string) int {
+	t.Helper()
+	paths, err := filesystem.ListMounts("fuse.s3fs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for _, p := range paths {
+		if p == path {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPublishUnpublish(t *testing.T) {
+	d := startDriver(t)
+	// kubelet creates the parent of the target path, but not the target path itself
+	target := filepath.Join(d.dir, "pods", "some-pod", "volume")
+
+	if err := d.publish(target, false); err != nil {
+		t.Fatalf("NodePublishVolume() error = %v", err)
+	}
+	if n := mountsAt(t, target); n != 1 {
+		t.Fatalf("found %d mounts at target path, want 1", n)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "some-file"), []byte("some data"), 0644); err != nil {
+		t.Fatalf("writing to the volume failed: %v", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(backingDir, bucket, "some-file")); err != nil || string(data) != "some data" {
+		t.Errorf("file written to the volume is not in the bucket: %s, %v", data, err)
+	}
+
+	// publishing again with the same arguments succeeds without mounting again
+	if err := d.publish(target, false); err != nil {
+		t.Errorf("repeated NodePublishVolume() error = %v", err)
+	}
+	if n := mountsAt(t, target); n != 1 {
+		t.Errorf("found %d mounts at target path after repeated publish, want 1", n)
+	}
+	// publishing with incompatible arguments fails
+	if err := d.publish(target, true); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("NodePublishVolume() read-only over a writable mount error = %v, want AlreadyExists", err)
+	}
+
+	if err := d.unpublish(target); err != nil {
+		t.Fatalf("NodeUnpublishVolume() error = %v", err)
+	}
+	if _, err := os.Stat(target); !os.IsNotExist(err) {
+		t.Errorf("target path still exists after unpublish: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(backingDir, bucket, "some-file")); err != nil {
+		t.Errorf("bucket contents were removed on unpublish: %v", err)
+	}
+	// unpublishing again succeeds
+	if err := d.unpublish(target); err != nil {
+		t.Errorf("repeated NodeUnpublishVolume() error = %v", err)
+	}
+}
+
+func TestPublishReadonly(t *testing.T) {
+	d := startDriver(t)
+	target := filepath.Join(d.dir, "readonly")
+
+	if err := d.publish(target, true); err != nil {
+		t.Fatalf("NodePublishVolume() error = %v", err)
+	}
+	defer d.unpublish(target)
+	err := ioutil.WriteFile(filepath.Join(target, "some-file"), []byte("some data"), 0644)
+	if !errors.Is(err, syscall.EROFS) {
+		t.Errorf("writing to a read-only volume error = %v, want EROFS", err)
+	}
+	if err := d.publish(target, true); err != nil {
+		t.Errorf("repeated read-only NodePublishVolume() error = %v", err)
+	}
+}
+
+func TestPublishWithoutCredentials(t *testing.T) {
+	d := startDriver(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err := d.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+		VolumeId:   bucket,
+		TargetPath: filepath.Join(d.dir, "no-credentials"),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("NodePublishVolume() without credentials error = %v, want InvalidArgument", err)
+	}
+}
+
+func TestMounterCrashRecovery(t *testing.T) {
+	d := startDriver(t)
+	target := filepath.Join(d.dir, "crash")
+	if err := d.publish(target, false); err != nil {
+		t.Fatalf("NodePublishVolume() error = %v", err)
+	}
+
+	killMounter(t, target)
+	if _, err := os.Stat(target); !errors.Is(err, syscall.ENOTCONN) {
+		t.Fatalf("stat of the target path after the mounter died error = %v, want ENOTCONN", err)
+	}
+
+	// publishing again replaces the stale mount
+	if err := d.publish(target, false); err != nil {
+		t.Fatalf("NodePublishVolume() over a stale mount error = %v", err)
+	}
+	if n := mountsAt(t, target); n != 1 {
+		t.Errorf("found %d mounts at target path after recovery, want 1", n)
+	}
+	if err := ioutil.WriteFile(filepath.Join(target, "some-file"), []byte("some data"), 0644); err != nil {
+		t.Errorf("writing to the recovered volume failed: %v", err)
+	}
+
+	// a stale mount can be unpublished
+	killMounter(t, target)
+	if err := d.unpublish(target); err != nil {
+		t.Fatalf("NodeUnpublishVolume() of a stale mount error = %v", err)
+	}
+	if n := mountsAt(t, target); n != 0 {
+		t.Errorf("found %d mounts at target path after unpublish, want 0", n)
+	}
+}
+
+// killMounter kills the fake-s3fs process serving the mount at target
+func killMounter(t *testing.T, target string) {
+	t.Helper()
+	procs, err := filepath.Glob("/proc/[0-9]*/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range procs {
+		cmdline, err := ioutil.ReadFile(p)
+		if err != nil {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(cmdline), "\x00"), "\x00")
+		if len(args) < 3 || args[0] != mounterPath || args[2] != target {
+			continue
+		}
+		var pid int
+		fmt.Sscanf(filepath.Base(filepath.Dir(p)), "%d", &pid)
+		if err := syscall.Kill(pid, syscall.SIGKILL); err != nil {
+			t.Fatal(err)
+		}
+		// wait for the kernel to notice that the FUSE server has gone
+		for i := 0; i < 50; i++ {
+			if _, err := os.Stat(target); errors.Is(err, syscall.ENOTCONN) {
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		return
+	}
+	t.Fatalf("no fake-s3fs process found for %s", target)
+}